@@ -2,32 +2,118 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"os/signal"
 	"runtime/debug"
 	"syscall"
 
+	"github.com/pushbits/server/internal/appservice"
 	"github.com/pushbits/server/internal/authentication/credentials"
+	"github.com/pushbits/server/internal/backend"
+	"github.com/pushbits/server/internal/batch"
+	"github.com/pushbits/server/internal/callback"
+	"github.com/pushbits/server/internal/command"
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/database"
 	"github.com/pushbits/server/internal/dispatcher"
+	"github.com/pushbits/server/internal/expiry"
 	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/queue"
+	"github.com/pushbits/server/internal/quiet"
+	"github.com/pushbits/server/internal/ratelimit"
 	"github.com/pushbits/server/internal/router"
 	"github.com/pushbits/server/internal/runner"
+	"github.com/pushbits/server/internal/scheduler"
+	"github.com/pushbits/server/internal/stream"
 )
 
-func setupCleanup(db *database.Database, dp *dispatcher.Dispatcher) {
+// Stops the background jobs and closes the connections on SIGINT and SIGTERM, as the deferred calls of main do not run on exit.
+// The queue, the quiet hours and the limiter are nil if they are disabled.
+func setupCleanup(db *database.Database, dp *backend.Registry, q *queue.Queue, s *scheduler.Scheduler, sweeper *expiry.Sweeper, batcher *batch.Batcher, quietHours *quiet.Hours, limiter *ratelimit.Limiter, hub *stream.Hub) {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-c
+		s.Close()
+		if q != nil {
+			q.Close()
+		}
+		sweeper.Close()
+		batcher.Close()
+		if quietHours != nil {
+			quietHours.Close()
+		}
+		if limiter != nil {
+			limiter.Close()
+		}
+		hub.Close()
 		dp.Close()
 		db.Close()
 		os.Exit(1)
 	}()
 }
 
+func setupBackends(c *configuration.Configuration, matrix *dispatcher.Identities) *backend.Registry {
+	backends := backend.CreateRegistry()
+	backends.Register(model.BackendMatrix, matrix)
+
+	if c.Backends.SMTP.Enabled {
+		backends.Register(model.BackendSMTP, backend.CreateSMTP(c.Backends.SMTP))
+	}
+
+	if c.Backends.Webhook.Enabled {
+		backends.Register(model.BackendWebhook, backend.CreateWebhook(c.Backends.Webhook))
+	}
+
+	if c.Backends.Log.Enabled {
+		backends.Register(model.BackendLog, backend.CreateLogSink())
+	}
+
+	return backends
+}
+
+// Returns a handler that passes commands and interactions with notifications to the enabled features
+func setupInteractions(c *configuration.Configuration, db *database.Database, dp *dispatcher.Identities) func(i *model.Interaction) {
+	var forwarder *callback.Forwarder
+	if c.Callbacks.Enabled {
+		forwarder = callback.Create(db, c.Callbacks)
+	}
+
+	var commands *command.Handler
+	if c.Commands.Enabled {
+		commands = command.Create(db, dp)
+	}
+
+	return func(i *model.Interaction) {
+		if i.Type == model.InteractionCommand {
+			if commands != nil {
+				commands.Handle(i)
+			}
+		} else if forwarder != nil {
+			forwarder.Handle(i)
+		}
+	}
+}
+
+// Writes the registration file of the application service for the homeserver
+func writeRegistration(c *configuration.Configuration, path string) {
+	registration, err := appservice.CreateRegistration(c.Matrix)
+	if err != nil {
+		log.L.Fatal(err)
+		return
+	}
+
+	if err := registration.Save(path); err != nil {
+		log.L.Fatal(err)
+		return
+	}
+
+	log.L.Printf("Wrote the registration of the application service to %s.", path)
+}
+
 func printStarupMessage() {
 	buildInfo, ok := debug.ReadBuildInfo()
 	if !ok {
@@ -54,6 +140,9 @@ func printStarupMessage() {
 
 // @securityDefinitions.basic BasicAuth
 func main() {
+	registrationPath := flag.String("generate-registration", "", "Write the registration file of the application service to this path and exit")
+	flag.Parse()
+
 	printStarupMessage()
 
 	c := configuration.Get()
@@ -63,6 +152,11 @@ func main() {
 		log.L.Printf("%+v", c)
 	}
 
+	if *registrationPath != "" {
+		writeRegistration(c, *registrationPath)
+		return
+	}
+
 	cm := credentials.CreateManager(c.Security.CheckHIBP, c.Crypto)
 
 	db, err := database.Create(cm, c.Database.Dialect, c.Database.Connection)
@@ -80,7 +174,7 @@ func main() {
 		log.L.Fatal(err)
 	}
 
-	dp, err := dispatcher.Create(c.Matrix.Homeserver, c.Matrix.Username, c.Matrix.Password, c.Formatting)
+	dp, err := dispatcher.CreateIdentities(c.Matrix, db, c.Formatting, c.HistoryScan)
 	if err != nil {
 		log.L.Fatal(err)
 		return
@@ -89,17 +183,90 @@ func main() {
 		log.L.Fatal("dp is nil but error was nil")
 		return
 	}
-	defer dp.Close()
 
-	setupCleanup(db, dp)
+	if c.Matrix.Encryption.Enabled {
+		store, dialect := db.RawSQL()
+		if err := dp.EnableEncryption(c.Matrix.Encryption, store, dialect); err != nil {
+			log.L.Fatal(err)
+			return
+		}
+	}
+
+	if c.Callbacks.Enabled || c.Commands.Enabled {
+		if err := dp.ListenForInteractions(setupInteractions(c, db, dp)); err != nil {
+			log.L.Fatal(err)
+			return
+		}
+	}
+
+	backends := setupBackends(c, dp)
+	defer backends.Close()
+
+	// The limiter is set up first, so that the accounts are limited for messages sent by the background jobs as well.
+	var limiter *ratelimit.Limiter
+	if c.RateLimit.Enabled {
+		limiter = ratelimit.Create(db, backends, c.RateLimit)
+		backends.SetLimiter(limiter)
+		limiter.Start()
+		defer limiter.Close()
+	}
+
+	// Batching comes first, so that digests are held back during quiet hours like any other notification.
+	batcher := batch.Create(db, backends, c.Batching, c.Formatting)
+	backends.AddPolicy(batcher)
+
+	var quietHours *quiet.Hours
+	if c.QuietHours.Enabled {
+		quietHours = quiet.Create(db, backends, c.QuietHours)
+		backends.AddPolicy(quietHours)
+		quietHours.Start()
+		defer quietHours.Close()
+	}
+
+	hub := stream.Create(c.Stream)
+	defer hub.Close()
+
+	var q *queue.Queue
+	var s *scheduler.Scheduler
+	if c.Queue.Enabled {
+		q = queue.Create(db, backends, hub, c.Queue)
+		defer q.Close()
+
+		s = scheduler.Create(db, backends, q, hub, c.Scheduler)
+	} else {
+		s = scheduler.Create(db, backends, nil, hub, c.Scheduler)
+	}
+	defer s.Close()
 
-	err = db.RepairChannels(dp, &c.RepairBehavior)
+	sweeper := expiry.Create(db, backends, c.Expiry)
+	defer sweeper.Close()
+
+	setupCleanup(db, backends, q, s, sweeper, batcher, quietHours, limiter, hub)
+
+	err = db.RepairChannels(backends, &c.RepairBehavior)
 	if err != nil {
 		log.L.Fatal(err)
 		return
 	}
 
-	engine, err := router.Create(c.Debug, c.HTTP.TrustedProxies, cm, db, dp, &c.Alertmanager)
+	if q != nil {
+		q.Start()
+	}
+
+	s.CatchUp()
+	s.Start()
+
+	sweeper.Start()
+
+	batcher.Start()
+	defer batcher.Close()
+
+	var appService *appservice.Listener
+	if c.Matrix.AppService.Enabled {
+		appService = appservice.Create(db, dp, c.Matrix.AppService)
+	}
+
+	engine, err := router.Create(c.Debug, c.HTTP.TrustedProxies, cm, db, backends, q, s, limiter, appService, hub, c.Matrix.IdentityNames(), &c.Dedup, &c.Alertmanager)
 	if err != nil {
 		log.L.Fatal(err)
 		return
@@ -3,7 +3,6 @@ package alertmanager
 
 import (
 	"net/http"
-	"net/url"
 
 	"github.com/gin-gonic/gin"
 
@@ -13,9 +12,26 @@ import (
 	"github.com/pushbits/server/internal/model"
 )
 
+// The Database interface for encapsulating database access.
+type Database interface {
+	api.NotificationDatabase
+
+	GetTrackedAlert(application *model.Application, fingerprint string) (*model.TrackedAlert, error)
+	SaveTrackedAlert(alert *model.TrackedAlert) error
+}
+
+// The Limiter interface for charging the alerts of a webhook call against the rate limit of the application.
+type Limiter interface {
+	Limit(ctx *gin.Context, a *model.Application, n int) bool
+}
+
 // Handler holds information for processing alerts received via Alertmanager.
 type Handler struct {
+	DB       Database
 	DP       api.NotificationDispatcher
+	Queue    api.NotificationQueue
+	Stream   api.NotificationStream
+	Limiter  Limiter
 	Settings HandlerSettings
 }
 
@@ -23,6 +39,7 @@ type Handler struct {
 type HandlerSettings struct {
 	TitleAnnotation   string
 	MessageAnnotation string
+	TrackAlerts       bool
 }
 
 // CreateAlert godoc
@@ -35,6 +52,7 @@ type HandlerSettings struct {
 // @Param token query string true "Channels token, can also be provieded in the header"
 // @Param data body model.AlertmanagerWebhook true "alertmanager webhook call"
 // @Success 200 {object} []model.Notification
+// @Success 202 {object} []model.Notification "The notifications were queued, see queue_id"
 // @Failure 500,404,403 ""
 // @Router /alert [post]
 func (h *Handler) CreateAlert(ctx *gin.Context) {
@@ -50,18 +68,100 @@ func (h *Handler) CreateAlert(ctx *gin.Context) {
 		return
 	}
 
+	// Every alert is sent as a notification of its own, so each of them counts against the rate limit.
+	if h.Limiter != nil && !h.Limiter.Limit(ctx, application, len(hook.Alerts)) {
+		return
+	}
+
+	status := http.StatusOK
+	errStatus, firstErr := http.StatusOK, error(nil)
 	notifications := make([]model.Notification, len(hook.Alerts))
 	for i, alert := range hook.Alerts {
 		notification := alert.ToNotification(h.Settings.TitleAnnotation, h.Settings.MessageAnnotation)
 		notification.Sanitize(application)
-		messageID, err := h.DP.SendNotification(application, &notification)
-		if success := api.SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
-			return
+
+		// An alert that cannot be processed does not keep the other alerts of the webhook call from being reported.
+		alertStatus, err := h.processAlert(application, &alert, &notification)
+		if err != nil {
+			log.L.Printf("Cannot process alert %s for application %s: %s", alert.GetFingerprint(), application.Name, err)
+			if firstErr == nil {
+				errStatus, firstErr = alertStatus, err
+			}
+			continue
+		}
+
+		if alertStatus == http.StatusAccepted {
+			status = alertStatus
 		}
 
-		notification.ID = messageID
-		notification.URLEncodedID = url.QueryEscape(messageID)
 		notifications[i] = notification
 	}
-	ctx.JSON(http.StatusOK, &notifications)
+
+	if success := api.SuccessOrAbort(ctx, errStatus, firstErr); !success {
+		return
+	}
+
+	ctx.JSON(status, &notifications)
+}
+
+// Sends the notification for an alert, unless it only repeats or resolves an alert that was already reported
+func (h *Handler) processAlert(a *model.Application, alert *model.AlertmanagerAlert, n *model.Notification) (int, error) {
+	if !h.Settings.TrackAlerts {
+		return api.DeliverNotification(h.DB, h.DP, h.Queue, h.Stream, a, n)
+	}
+
+	fingerprint := alert.GetFingerprint()
+
+	tracked, err := h.DB.GetTrackedAlert(a, fingerprint)
+	if err != nil || tracked == nil {
+		tracked = &model.TrackedAlert{ApplicationID: a.ID, Fingerprint: fingerprint}
+	}
+
+	eventID := h.trackedEventID(tracked)
+	reported := eventID != "" || tracked.QueueID != 0
+
+	switch {
+	case reported && tracked.Status == alert.Status:
+		log.L.Printf("Suppressing repeated %s alert %s for application %s.", alert.Status, fingerprint, a.Name)
+		n.ID = eventID
+		n.QueueID = tracked.QueueID
+		return http.StatusOK, nil
+	case eventID != "" && alert.Status == model.AlertStatusResolved:
+		log.L.Printf("Marking alert %s for application %s as resolved.", fingerprint, a.Name)
+		n.ID = eventID
+		err := api.ReplaceNotification(h.DB, h.DP, h.Stream, a, n)
+		if err == nil {
+			tracked.Status = alert.Status
+			return http.StatusOK, h.DB.SaveTrackedAlert(tracked)
+		}
+
+		// The message may have been deleted or cannot be edited anymore, so the resolution is reported with a new one.
+		log.L.Printf("Cannot edit message of alert %s for application %s, sending a new one: %s", fingerprint, a.Name, err)
+		n.ID = ""
+	}
+
+	status, err := api.DeliverNotification(h.DB, h.DP, h.Queue, h.Stream, a, n)
+	if err != nil {
+		return status, err
+	}
+
+	tracked.Status = alert.Status
+	tracked.EventID = n.ID
+	tracked.QueueID = n.QueueID
+
+	return status, h.DB.SaveTrackedAlert(tracked)
+}
+
+// Returns the ID of the message an alert was reported with, which is only known after delivery for queued notifications
+func (h *Handler) trackedEventID(tracked *model.TrackedAlert) string {
+	if tracked.EventID != "" || tracked.QueueID == 0 {
+		return tracked.EventID
+	}
+
+	queued, err := h.DB.GetQueuedNotification(tracked.QueueID)
+	if err != nil || queued == nil {
+		return ""
+	}
+
+	return queued.MessageID
 }
@@ -0,0 +1,192 @@
+package alertmanager
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/tests"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+type countingDispatcher struct {
+	mockups.MockDispatcher
+	sent      int
+	updated   int
+	failTitle string
+	updateErr error
+}
+
+func (d *countingDispatcher) SendNotification(a *model.Application, n *model.Notification) (string, error) {
+	if d.failTitle != "" && strings.Contains(n.Title, d.failTitle) {
+		return "", errors.New("cannot send")
+	}
+
+	d.sent++
+	return d.MockDispatcher.SendNotification(a, n)
+}
+
+func (d *countingDispatcher) UpdateNotification(_ *model.Application, _ *model.Notification, _ string) error {
+	d.updated++
+	return d.updateErr
+}
+
+func cleanup() {
+	if err := os.Remove("pushbits-test.db"); err != nil {
+		log.L.Warnln("Cannot delete test database: ", err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	cleanup()
+
+	gin.SetMode(gin.TestMode)
+
+	m.Run()
+
+	cleanup()
+}
+
+func TestAlertmanager_TrackAlerts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	db, err := mockups.GetEmptyDatabase(configuration.CryptoConfig{})
+	require.NoError(err)
+
+	application := mockups.GetApplication1()
+	require.NoError(db.CreateApplication(application))
+
+	dp := &countingDispatcher{}
+	handler := Handler{DB: db, DP: dp, Settings: HandlerSettings{TitleAnnotation: "title", MessageAnnotation: "message", TrackAlerts: true}}
+
+	firing := `{"alerts": [{"status": "firing", "fingerprint": "abc", "labels": {"alertname": "disk"}}]}`
+	resolved := `{"alerts": [{"status": "resolved", "fingerprint": "abc", "labels": {"alertname": "disk"}}]}`
+
+	testCases := make([]tests.Request, 0)
+	testCases = append(testCases, tests.Request{Name: "First firing", Method: "POST", Endpoint: "/alert", Data: firing, ShouldReturn: [2]int{1, 0}})
+	testCases = append(testCases, tests.Request{Name: "Repeated firing", Method: "POST", Endpoint: "/alert", Data: firing, ShouldReturn: [2]int{1, 0}})
+	testCases = append(testCases, tests.Request{Name: "Resolved", Method: "POST", Endpoint: "/alert", Data: resolved, ShouldReturn: [2]int{1, 1}})
+	testCases = append(testCases, tests.Request{Name: "Repeated resolved", Method: "POST", Endpoint: "/alert", Data: resolved, ShouldReturn: [2]int{1, 1}})
+	testCases = append(testCases, tests.Request{Name: "Firing again", Method: "POST", Endpoint: "/alert", Data: firing, ShouldReturn: [2]int{2, 1}})
+
+	for _, req := range testCases {
+		req.Headers = map[string]string{"Content-Type": "application/json"}
+
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("app", application)
+		handler.CreateAlert(c)
+
+		counts, ok := req.ShouldReturn.([2]int)
+		require.True(ok)
+
+		assert.Equalf(200, w.Code, "(Test case: \"%s\") Unexpected status code", req.Name)
+		assert.Equalf(counts[0], dp.sent, "(Test case: \"%s\") Unexpected number of sent messages", req.Name)
+		assert.Equalf(counts[1], dp.updated, "(Test case: \"%s\") Unexpected number of edited messages", req.Name)
+	}
+}
+
+type countingLimiter struct {
+	charged []int
+}
+
+func (l *countingLimiter) Limit(_ *gin.Context, _ *model.Application, n int) bool {
+	l.charged = append(l.charged, n)
+	return true
+}
+
+func TestAlertmanager_LimitEveryAlert(t *testing.T) {
+	require := require.New(t)
+
+	cleanup()
+
+	db, err := mockups.GetEmptyDatabase(configuration.CryptoConfig{})
+	require.NoError(err)
+	defer db.Close()
+
+	application := mockups.GetApplication1()
+	require.NoError(db.CreateApplication(application))
+
+	limiter := &countingLimiter{}
+	handler := Handler{DB: db, DP: &countingDispatcher{}, Limiter: limiter, Settings: HandlerSettings{TitleAnnotation: "title", MessageAnnotation: "message"}}
+
+	req := tests.Request{Name: "Three alerts", Method: "POST", Endpoint: "/alert", Headers: map[string]string{"Content-Type": "application/json"},
+		Data: `{"alerts": [{"status": "firing", "labels": {"alertname": "a"}}, {"status": "firing", "labels": {"alertname": "b"}}, {"status": "firing", "labels": {"alertname": "c"}}]}`}
+
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", application)
+	handler.CreateAlert(c)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []int{3}, limiter.charged)
+}
+
+func TestAlertmanager_ResolveFallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cleanup()
+
+	db, err := mockups.GetEmptyDatabase(configuration.CryptoConfig{})
+	require.NoError(err)
+	defer db.Close()
+
+	application := mockups.GetApplication1()
+	require.NoError(db.CreateApplication(application))
+
+	dp := &countingDispatcher{}
+	stream := &mockups.MockStream{}
+	handler := Handler{DB: db, DP: dp, Stream: stream, Settings: HandlerSettings{TitleAnnotation: "title", MessageAnnotation: "message", TrackAlerts: true}}
+
+	send := func(data string) int {
+		req := tests.Request{Method: "POST", Endpoint: "/alert", Data: data, Headers: map[string]string{"Content-Type": "application/json"}}
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("app", application)
+		handler.CreateAlert(c)
+
+		return w.Code
+	}
+
+	// Resolved alerts are edited into their message and pushed to the stream again.
+	assert.Equal(200, send(`{"alerts": [{"status": "firing", "fingerprint": "abc", "labels": {"title": "disk"}}]}`))
+	assert.Equal(200, send(`{"alerts": [{"status": "resolved", "fingerprint": "abc", "labels": {"title": "disk"}}]}`))
+	assert.Equal(1, dp.sent)
+	assert.Equal(1, dp.updated)
+	require.Len(stream.Published, 2)
+	assert.Equal(stream.Published[0].ID, stream.Published[1].ID)
+	assert.Equal("[RES] disk", stream.Published[1].Title)
+
+	// If the message cannot be edited, the resolution is sent as a new message.
+	dp.updateErr = errors.New("cannot edit")
+	assert.Equal(200, send(`{"alerts": [{"status": "firing", "fingerprint": "def", "labels": {"title": "cpu"}}]}`))
+	assert.Equal(200, send(`{"alerts": [{"status": "resolved", "fingerprint": "def", "labels": {"title": "cpu"}}]}`))
+	assert.Equal(3, dp.sent)
+	assert.Equal(2, dp.updated)
+
+	tracked, err := db.GetTrackedAlert(application, "def")
+	require.NoError(err)
+	assert.Equal(model.AlertStatusResolved, tracked.Status)
+
+	// An alert that fails does not drop the following ones.
+	dp.failTitle = "broken"
+	assert.Equal(500, send(`{"alerts": [{"status": "firing", "fingerprint": "ghi", "labels": {"title": "broken"}}, {"status": "firing", "fingerprint": "jkl", "labels": {"title": "memory"}}]}`))
+	assert.Equal(4, dp.sent)
+
+	// Fingerprints that do not fit into the tracked alerts are hashed.
+	long := model.AlertmanagerAlert{Fingerprint: strings.Repeat("f", 100)}
+	assert.Len(long.GetFingerprint(), model.MaxFingerprintLength)
+}
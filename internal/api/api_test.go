@@ -79,8 +79,9 @@ func CreateTestContext(_ *testing.T) *TestContext {
 	ctx.Database = db
 
 	ctx.ApplicationHandler = &ApplicationHandler{
-		DB: ctx.Database,
-		DP: &mockups.MockDispatcher{},
+		DB:               ctx.Database,
+		DP:               &mockups.MockDispatcher{},
+		MatrixIdentities: []string{"", "internal"},
 	}
 
 	ctx.Users = mockups.GetUsers(ctx.Config)
@@ -2,20 +2,59 @@ package api
 
 import (
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/pushbits/server/internal/authentication"
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/log"
 	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
 
 	"github.com/gin-gonic/gin"
 )
 
+// The maximum size of application images in bytes
+const maxImageSize = 5 << 20
+
+// The formats of application images, as detected by http.DetectContentType
+var imageContentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
 // ApplicationHandler holds information for processing requests about applications.
 type ApplicationHandler struct {
 	DB Database
 	DP Dispatcher
+	// The names of the configured Matrix identities, the default account with the empty name is always available.
+	MatrixIdentities []string
+}
+
+// Aborts with an error if the Matrix identity is not configured
+func (h *ApplicationHandler) validateMatrixIdentity(ctx *gin.Context, identity string) error {
+	if identity == "" || slices.Contains(h.MatrixIdentities, identity) {
+		return nil
+	}
+
+	SuccessOrAbort(ctx, http.StatusBadRequest, pberrors.ErrUnknownMatrixIdentity)
+
+	return pberrors.ErrUnknownMatrixIdentity
+}
+
+// Checks that an application is bound to a room ID or alias only if it uses the matrix backend
+func validateRoom(a *model.Application) error {
+	if !a.IsBoundToRoom() {
+		return nil
+	}
+
+	isRoomID := strings.HasPrefix(a.Room, "!") || strings.HasPrefix(a.Room, "#")
+	if a.Backend != model.BackendMatrix || !isRoomID || !strings.Contains(a.Room, ":") {
+		return pberrors.ErrInvalidRoom
+	}
+
+	return nil
 }
 
 func (h *ApplicationHandler) applicationExists(token string) bool {
@@ -27,6 +66,27 @@ func (h *ApplicationHandler) generateToken(compat bool) string {
 	return authentication.GenerateNotExistingToken(authentication.GenerateApplicationToken, compat, h.applicationExists)
 }
 
+// Rejects a room that another application is relayed to already, as commands and replies there could not be told apart.
+// The application is deregistered from the room again, which the other application keeps.
+func (h *ApplicationHandler) checkRoomInUse(a *model.Application, u *model.User, roomID string) error {
+	others, err := h.DB.CountApplicationsByMatrixID(roomID, a.ID)
+	if err != nil {
+		return err
+	}
+
+	if others == 0 {
+		return nil
+	}
+
+	joined := *a
+	joined.MatrixID = roomID
+	if err := h.DP.DeregisterApplication(&joined, u); err != nil {
+		log.L.Printf("Cannot deregister application %s from room %s: %s", a.Name, roomID, err)
+	}
+
+	return pberrors.ErrRoomInUse
+}
+
 func (h *ApplicationHandler) registerApplication(ctx *gin.Context, a *model.Application, u *model.User) error {
 	if a == nil || u == nil {
 		return errors.New("nil parameters provided")
@@ -34,7 +94,12 @@ func (h *ApplicationHandler) registerApplication(ctx *gin.Context, a *model.Appl
 
 	log.L.Printf("Registering application %s.", a.Name)
 
-	channelID, err := h.DP.RegisterApplication(a.ID, a.Name, u.MatrixID)
+	channelID, err := h.DP.RegisterApplication(a, u)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return err
+	}
+
+	err = h.checkRoomInUse(a, u, channelID)
 	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
 		return err
 	}
@@ -49,17 +114,39 @@ func (h *ApplicationHandler) registerApplication(ctx *gin.Context, a *model.Appl
 	return nil
 }
 
-func (h *ApplicationHandler) createApplication(ctx *gin.Context, u *model.User, name string, compat bool) (*model.Application, error) {
-	if u == nil {
+func (h *ApplicationHandler) createApplication(ctx *gin.Context, u *model.User, createApplication *model.CreateApplication) (*model.Application, error) {
+	if u == nil || createApplication == nil {
 		return nil, errors.New("nil parameters provided")
 	}
 
-	log.L.Printf("Creating application %s.", name)
+	log.L.Printf("Creating application %s.", createApplication.Name)
 
 	application := model.Application{}
-	application.Name = name
-	application.Token = h.generateToken(compat)
+	application.Name = createApplication.Name
+	application.Token = h.generateToken(createApplication.StrictCompatibility)
+	application.TokenCreatedAt = time.Now()
 	application.UserID = u.ID
+	application.Backend = createApplication.Backend
+	application.Target = createApplication.Target
+	application.MatrixIdentity = createApplication.MatrixIdentity
+
+	if application.MatrixIdentity == "" {
+		application.MatrixIdentity = u.MatrixIdentity
+	}
+
+	if err := h.validateMatrixIdentity(ctx, application.MatrixIdentity); err != nil {
+		return nil, err
+	}
+
+	if application.Backend == "" {
+		application.Backend = model.BackendMatrix
+	}
+
+	application.Room = strings.TrimSpace(createApplication.RoomID)
+	if err := validateRoom(&application); err != nil {
+		SuccessOrAbort(ctx, http.StatusBadRequest, err)
+		return nil, err
+	}
 
 	err := h.DB.CreateApplication(&application)
 	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
@@ -98,6 +185,122 @@ func (h *ApplicationHandler) deleteApplication(ctx *gin.Context, a *model.Applic
 	return nil
 }
 
+// Applies changes of the callback URL, creating a new secret when callbacks are enabled or a refresh is requested
+func updateCallback(a *model.Application, updateApplication *model.UpdateApplication) error {
+	if updateApplication.CallbackURL != nil {
+		callbackURL := strings.TrimSpace(*updateApplication.CallbackURL)
+
+		if callbackURL == "" {
+			log.L.Print("Disabling callbacks.")
+			a.CallbackURL = ""
+			a.CallbackSecret = ""
+			return nil
+		}
+
+		u, err := url.Parse(callbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return pberrors.ErrInvalidCallbackURL
+		}
+
+		log.L.Printf("Updating callback URL to '%s'.", callbackURL)
+		a.CallbackURL = callbackURL
+	}
+
+	refresh := updateApplication.RefreshCallbackSecret != nil && (*updateApplication.RefreshCallbackSecret)
+	if a.CallbackURL != "" && (a.CallbackSecret == "" || refresh) {
+		log.L.Print("Updating callback secret.")
+		a.CallbackSecret = authentication.GenerateCallbackSecret()
+	}
+
+	return nil
+}
+
+// Applies changes of the digest interval and the priority that bypasses it
+func updateDigest(a *model.Application, updateApplication *model.UpdateApplication) error {
+	if (updateApplication.DigestInterval != nil && *updateApplication.DigestInterval < 0) ||
+		(updateApplication.DigestBypassPriority != nil && *updateApplication.DigestBypassPriority < 0) {
+		return pberrors.ErrInvalidDigestSettings
+	}
+
+	if updateApplication.DigestInterval != nil {
+		log.L.Printf("Updating digest interval to %d seconds.", *updateApplication.DigestInterval)
+		a.DigestInterval = *updateApplication.DigestInterval
+	}
+
+	if updateApplication.DigestBypassPriority != nil {
+		log.L.Printf("Updating digest bypass priority to %d.", *updateApplication.DigestBypassPriority)
+		a.DigestBypassPriority = *updateApplication.DigestBypassPriority
+	}
+
+	return nil
+}
+
+// Applies changes of the title and message templates and of their engine, which must parse afterwards
+func updateTemplates(a *model.Application, updateApplication *model.UpdateApplication) error {
+	updated := *a
+
+	if updateApplication.TitleTemplate != nil {
+		updated.TitleTemplate = *updateApplication.TitleTemplate
+	}
+
+	if updateApplication.MessageTemplate != nil {
+		updated.MessageTemplate = *updateApplication.MessageTemplate
+	}
+
+	if updateApplication.TemplateEngine != nil {
+		updated.TemplateEngine = *updateApplication.TemplateEngine
+	}
+
+	if err := updated.ValidateTemplates(); err != nil {
+		return err
+	}
+
+	if updated != *a {
+		log.L.Printf("Updating templates with engine '%s'.", updated.TemplateEngine)
+		*a = updated
+	}
+
+	return nil
+}
+
+// Moves the application to another existing room, or to a new channel if the room is empty, and leaves the previous one afterwards
+func (h *ApplicationHandler) updateRoom(a *model.Application, u *model.User, updateApplication *model.UpdateApplication) error {
+	if updateApplication.RoomID == nil {
+		return nil
+	}
+
+	room := strings.TrimSpace(*updateApplication.RoomID)
+	if room == a.Room {
+		return nil
+	}
+
+	previous := *a
+	a.Room = room
+
+	if err := validateRoom(a); err != nil {
+		return err
+	}
+
+	log.L.Printf("Updating room of the application to '%s'.", room)
+
+	channelID, err := h.DP.RegisterApplication(a, u)
+	if err != nil {
+		return err
+	}
+
+	if err := h.checkRoomInUse(a, u, channelID); err != nil {
+		return err
+	}
+
+	a.MatrixID = channelID
+
+	if err := h.DP.DeregisterApplication(&previous, u); err != nil {
+		log.L.Printf("Cannot leave the previous channel %s: %s", previous.MatrixID, err)
+	}
+
+	return nil
+}
+
 func (h *ApplicationHandler) updateApplication(ctx *gin.Context, a *model.Application, updateApplication *model.UpdateApplication) error {
 	if a == nil || updateApplication == nil {
 		return errors.New("nil parameters provided")
@@ -114,6 +317,32 @@ func (h *ApplicationHandler) updateApplication(ctx *gin.Context, a *model.Applic
 		log.L.Print("Updating application token.")
 		compat := updateApplication.StrictCompatibility != nil && (*updateApplication.StrictCompatibility)
 		a.Token = h.generateToken(compat)
+		a.TokenCreatedAt = time.Now()
+	}
+
+	if updateApplication.RedactOnDelete != nil {
+		log.L.Printf("Updating redaction of deleted notifications to %t.", *updateApplication.RedactOnDelete)
+		a.RedactOnDelete = *updateApplication.RedactOnDelete
+	}
+
+	if err := updateCallback(a, updateApplication); err != nil {
+		SuccessOrAbort(ctx, http.StatusBadRequest, err)
+		return err
+	}
+
+	if err := updateDigest(a, updateApplication); err != nil {
+		SuccessOrAbort(ctx, http.StatusBadRequest, err)
+		return err
+	}
+
+	if err := updateTemplates(a, updateApplication); err != nil {
+		SuccessOrAbort(ctx, http.StatusBadRequest, err)
+		return err
+	}
+
+	if err := h.updateRoom(a, authentication.GetUser(ctx), updateApplication); err != nil {
+		SuccessOrAbort(ctx, http.StatusInternalServerError, err)
+		return err
 	}
 
 	err := h.DB.UpdateApplication(a)
@@ -121,7 +350,7 @@ func (h *ApplicationHandler) updateApplication(ctx *gin.Context, a *model.Applic
 		return err
 	}
 
-	err = h.DP.UpdateApplication(a, &configuration.RepairBehavior{ResetRoomName: true, ResetRoomTopic: true})
+	err = h.DP.UpdateApplication(a, &configuration.RepairBehavior{ResetRoomName: true, ResetRoomTopic: true, ResetRoomAvatar: true})
 	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
 		return err
 	}
@@ -138,8 +367,12 @@ func (h *ApplicationHandler) updateApplication(ctx *gin.Context, a *model.Applic
 // @Produce json
 // @Param name query string true "Name of the application"
 // @Param strict_compatibility query boolean false "Use strict compatibility mode"
+// @Param backend query string false "Backend that delivers the notifications (matrix, smtp, webhook, or log)"
+// @Param target query string false "Backend-specific destination, like an email address or a webhook URL"
+// @Param matrix_identity query string false "Matrix identity that sends the notifications, defaults to the one of the user"
+// @Param room_id query string false "ID or alias of an existing room to post the notifications to instead of creating a channel"
 // @Success 200 {object} model.Application
-// @Failure 400 ""
+// @Failure 400,403 ""
 // @Security BasicAuth
 // @Router /application [post]
 func (h *ApplicationHandler) CreateApplication(ctx *gin.Context) {
@@ -155,7 +388,7 @@ func (h *ApplicationHandler) CreateApplication(ctx *gin.Context) {
 		return
 	}
 
-	application, err := h.createApplication(ctx, user, createApplication.Name, createApplication.StrictCompatibility)
+	application, err := h.createApplication(ctx, user, &createApplication)
 	if err != nil {
 		return
 	}
@@ -260,6 +493,15 @@ func (h *ApplicationHandler) DeleteApplication(ctx *gin.Context) {
 // @Param name query string false "New name for the application"
 // @Param refresh_token query bool false "Generate new refresh token for the application"
 // @Param strict_compatibility query bool false "Whether to use strict compataibility mode"
+// @Param callback_url query string false "URL that replies and reactions are posted to, empty to disable callbacks"
+// @Param refresh_callback_secret query bool false "Generate a new secret for signing callbacks"
+// @Param redact_on_delete query bool false "Whether deleted notifications are redacted instead of struck through"
+// @Param digest_interval query int false "Seconds to collect notifications for before sending them as one digest, 0 to disable"
+// @Param digest_bypass_priority query int false "Notifications with at least this priority are sent immediately, 0 to batch all notifications"
+// @Param room_id query string false "ID or alias of an existing room to post the notifications to, empty to use a channel created for the application"
+// @Param title_template query string false "Template that titles of notifications are rendered with, empty to keep them as they are"
+// @Param message_template query string false "Template that messages of notifications are rendered with, empty to keep them as they are"
+// @Param template_engine query string false "Engine the templates are parsed with (text or html)"
 // @Success 200 ""
 // @Failure 500,404,403 ""
 // @Security BasicAuth
@@ -285,3 +527,213 @@ func (h *ApplicationHandler) UpdateApplication(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{})
 }
+
+// Returns the content type that a notification with the given extras is displayed with
+func displayContentType(extras map[string]interface{}) string {
+	if display, ok := extras["client::display"].(map[string]interface{}); ok {
+		if contentType, ok := display["contentType"].(string); ok {
+			return strings.ToLower(contentType)
+		}
+	}
+
+	return "text/plain"
+}
+
+// RenderApplicationTemplates godoc
+// @Summary Render Application Templates
+// @Description Render a notification with the templates of an application without sending it, templates given in the request replace the ones of the application
+// @ID post-application-id-render
+// @Tags Application
+// @Accept json
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Param render body model.RenderTemplates true "Notification to render and templates to try out"
+// @Success 200 {object} model.RenderedNotification
+// @Failure 500,404,403,400 ""
+// @Security BasicAuth
+// @Router /application/{id}/render [post]
+func (h *ApplicationHandler) RenderApplicationTemplates(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	var render model.RenderTemplates
+	if err := ctx.Bind(&render); err != nil {
+		return
+	}
+
+	if render.TitleTemplate != nil {
+		application.TitleTemplate = *render.TitleTemplate
+	}
+
+	if render.MessageTemplate != nil {
+		application.MessageTemplate = *render.MessageTemplate
+	}
+
+	if render.TemplateEngine != nil {
+		application.TemplateEngine = *render.TemplateEngine
+	}
+
+	notification := &model.Notification{
+		Title:    render.Title,
+		Message:  render.Message,
+		Priority: render.Priority,
+		Extras:   render.Extras,
+	}
+	notification.Sanitize(application)
+
+	rendered, err := application.RenderTemplates(notification)
+	if err != nil {
+		// Errors of parsing and executing the templates are the result of the dry run, not a failure of the request.
+		ctx.JSON(http.StatusOK, &model.RenderedNotification{Error: err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &model.RenderedNotification{
+		Title:       rendered.Title,
+		Message:     rendered.Message,
+		ContentType: displayContentType(rendered.Extras),
+	})
+}
+
+// Reads the uploaded image and checks its size and format
+func readImage(ctx *gin.Context) ([]byte, string, error) {
+	header, err := ctx.FormFile("file")
+	if err != nil {
+		return nil, "", pberrors.ErrInvalidImage
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := http.DetectContentType(data)
+	if len(data) > maxImageSize || !slices.Contains(imageContentTypes, contentType) {
+		return nil, "", pberrors.ErrInvalidImage
+	}
+
+	return data, contentType, nil
+}
+
+// UploadApplicationImage godoc
+// @Summary Upload Application Image
+// @Description Upload an image for an application, which becomes the avatar of its channel, compatible with Gotify
+// @ID post-application-id-image
+// @Tags Application
+// @Accept mpfd
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Param file formData file true "PNG, JPEG, GIF, or WebP image of at most 5 MiB"
+// @Success 200 {object} model.Application
+// @Failure 500,404,403,400 ""
+// @Security BasicAuth
+// @Router /application/{id}/image [post]
+func (h *ApplicationHandler) UploadApplicationImage(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	data, contentType, err := readImage(ctx)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	avatar, err := h.DP.UploadAvatar(application, data, contentType)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	log.L.Printf("Updating image of application %s to %s.", application.Name, avatar)
+	application.Avatar = avatar
+
+	err = h.DB.UpdateApplication(application)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	err = h.DP.UpdateApplication(application, &configuration.RepairBehavior{ResetRoomAvatar: true})
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &application)
+}
+
+// GetApplicationMessages godoc
+// @Summary Get Application Messages
+// @Description Get the message history of an application, compatible with Gotify
+// @ID get-application-id-message
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Param limit query integer false "The maximum number of messages to return (1-200)"
+// @Param since query integer false "Return only messages with an ID lower than this one"
+// @Success 200 {object} model.PagedMessages
+// @Failure 500,404,403,400 ""
+// @Security BasicAuth
+// @Router /application/{id}/message [get]
+func (h *ApplicationHandler) GetApplicationMessages(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	messages, err := getPagedMessages(ctx, h.DB, []uint{application.ID})
+	if err != nil {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, messages)
+}
+
+// DeleteApplicationMessages godoc
+// @Summary Delete Application Messages
+// @Description Delete the message history of an application, compatible with Gotify
+// @ID delete-application-id-message
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Success 200 ""
+// @Failure 500,404,403 ""
+// @Security BasicAuth
+// @Router /application/{id}/message [delete]
+func (h *ApplicationHandler) DeleteApplicationMessages(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	err = h.DB.DeleteStoredNotifications(application)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
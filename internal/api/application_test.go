@@ -1,15 +1,18 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
 	"github.com/pushbits/server/tests"
 )
 
@@ -282,3 +285,354 @@ func validateAllApplications(user *model.User, apps []model.Application) bool {
 
 	return true
 }
+
+func TestApi_UpdateCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	application := model.Application{}
+
+	invalid := "ftp://example.com/callback"
+	assert.Equal(pberrors.ErrInvalidCallbackURL, updateCallback(&application, &model.UpdateApplication{CallbackURL: &invalid}))
+	assert.Empty(application.CallbackURL)
+
+	valid := "https://example.com/callback"
+	assert.NoError(updateCallback(&application, &model.UpdateApplication{CallbackURL: &valid}))
+	assert.Equal(valid, application.CallbackURL)
+	assert.NotEmpty(application.CallbackSecret)
+
+	secret := application.CallbackSecret
+	assert.NoError(updateCallback(&application, &model.UpdateApplication{}))
+	assert.Equal(secret, application.CallbackSecret, "Secret should be kept when not refreshed")
+
+	refresh := true
+	assert.NoError(updateCallback(&application, &model.UpdateApplication{RefreshCallbackSecret: &refresh}))
+	assert.NotEqual(secret, application.CallbackSecret)
+
+	disabled := ""
+	assert.NoError(updateCallback(&application, &model.UpdateApplication{CallbackURL: &disabled}))
+	assert.Empty(application.CallbackURL)
+	assert.Empty(application.CallbackSecret)
+}
+
+func TestApi_UpdateDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	application := model.Application{}
+
+	negative := -1
+	assert.Equal(pberrors.ErrInvalidDigestSettings, updateDigest(&application, &model.UpdateApplication{DigestInterval: &negative}))
+	assert.Equal(0, application.DigestInterval)
+
+	interval := 900
+	bypass := 10
+	assert.NoError(updateDigest(&application, &model.UpdateApplication{DigestInterval: &interval, DigestBypassPriority: &bypass}))
+	assert.Equal(900, application.DigestInterval)
+	assert.Equal(10, application.DigestBypassPriority)
+
+	assert.True(application.Batches(&model.Notification{Priority: 9}))
+	assert.False(application.Batches(&model.Notification{Priority: 10}), "Notifications with the bypass priority should not be batched")
+
+	disabled := 0
+	assert.NoError(updateDigest(&application, &model.UpdateApplication{DigestInterval: &disabled}))
+	assert.False(application.Batches(&model.Notification{Priority: 0}))
+}
+
+func TestApi_CreateApplicationMatrixIdentity(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The user is not stored, so that the users of the other tests keep their IDs.
+	user := &model.User{ID: 4242, Name: "identityuser", MatrixID: "@identityuser:example.com", MatrixIdentity: "internal"}
+
+	req := tests.Request{Name: "Unknown identity", Method: "POST", Endpoint: "/application", Data: `{"name": "app", "matrix_identity": "external"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	ctx.ApplicationHandler.CreateApplication(c)
+	assert.Equal(400, w.Code, "Application with unknown Matrix identity should be rejected")
+
+	req = tests.Request{Name: "Identity of the user", Method: "POST", Endpoint: "/application", Data: `{"name": "app"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err = req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	ctx.ApplicationHandler.CreateApplication(c)
+	require.Equal(200, w.Code)
+
+	var application model.Application
+	require.NoError(json.NewDecoder(w.Body).Decode(&application))
+	assert.Equal("internal", application.MatrixIdentity, "Application should use the Matrix identity of its user")
+}
+
+func TestApi_Subscribers(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The user is not stored, so that the users of the other tests keep their IDs.
+	user := &model.User{ID: 4343, Name: "subscriberuser", MatrixID: "@subscriberuser:example.com"}
+
+	req := tests.Request{Name: "Create application", Method: "POST", Endpoint: "/application", Data: `{"name": "shared"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	ctx.ApplicationHandler.CreateApplication(c)
+	require.Equal(200, w.Code)
+
+	var application model.Application
+	require.NoError(json.NewDecoder(w.Body).Decode(&application))
+
+	testCases := []tests.Request{
+		{Name: "Subscriber", Data: `{"matrix_id": "@colleague:example.com"}`, ShouldStatus: 200},
+		{Name: "Duplicate subscriber", Data: `{"matrix_id": "@colleague:example.com"}`, ShouldStatus: 400},
+		{Name: "Owner as subscriber", Data: `{"matrix_id": "@subscriberuser:example.com"}`, ShouldStatus: 400},
+		{Name: "Invalid Matrix ID", Data: `{"matrix_id": "colleague"}`, ShouldStatus: 400},
+		{Name: "Unknown user", Data: `{"user_id": 4711}`, ShouldStatus: 400},
+	}
+
+	var subscriber model.Subscriber
+	for _, req := range testCases {
+		req.Method = "POST"
+		req.Endpoint = fmt.Sprintf("/application/%d/subscribers", application.ID)
+		req.Headers = map[string]string{"Content-Type": "application/json"}
+
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("user", user)
+		c.Set("id", application.ID)
+		ctx.ApplicationHandler.AddSubscriber(c)
+		assert.Equalf(req.ShouldStatus, w.Code, "AddSubscriber (Test case: \"%s\") Expected status code %v but have %v.", req.Name, req.ShouldStatus, w.Code)
+
+		if w.Code == 200 {
+			require.NoError(json.NewDecoder(w.Body).Decode(&subscriber))
+		}
+	}
+
+	req = tests.Request{Name: "List subscribers", Method: "GET", Endpoint: fmt.Sprintf("/application/%d/subscribers", application.ID)}
+	w, c, err = req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	c.Set("id", application.ID)
+	ctx.ApplicationHandler.GetSubscribers(c)
+	require.Equal(200, w.Code)
+
+	var subscribers []model.Subscriber
+	require.NoError(json.NewDecoder(w.Body).Decode(&subscribers))
+	if assert.Len(subscribers, 1) {
+		assert.Equal("@colleague:example.com", subscribers[0].MatrixID)
+	}
+
+	req = tests.Request{Name: "Remove subscriber", Method: "DELETE", Endpoint: fmt.Sprintf("/application/%d/subscribers/%d", application.ID, subscriber.ID)}
+	w, c, err = req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	c.Set("id", application.ID)
+	c.Set("subscriberid", subscriber.ID)
+	ctx.ApplicationHandler.RemoveSubscriber(c)
+	assert.Equal(200, w.Code)
+
+	subscribers, err = ctx.Database.GetSubscribers(application.ID)
+	require.NoError(err)
+	assert.Empty(subscribers, "Subscriber should be removed")
+}
+
+func TestApi_ApplicationRoom(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The user is not stored, so that the users of the other tests keep their IDs.
+	user := &model.User{ID: 4444, Name: "roomuser", MatrixID: "@roomuser:example.com"}
+
+	testCases := []tests.Request{
+		{Name: "Room alias", Data: `{"name": "ops", "room_id": "#ops:example.com"}`, ShouldStatus: 200},
+		{Name: "Room in use", Data: `{"name": "deploys", "room_id": "#ops:example.com"}`, ShouldStatus: 400},
+		{Name: "Invalid room", Data: `{"name": "ops", "room_id": "ops"}`, ShouldStatus: 400},
+		{Name: "Room for webhook backend", Data: `{"name": "ops", "backend": "webhook", "target": "https://example.com", "room_id": "!ops:example.com"}`, ShouldStatus: 400},
+	}
+
+	var application model.Application
+	for _, req := range testCases {
+		req.Method = "POST"
+		req.Endpoint = "/application"
+		req.Headers = map[string]string{"Content-Type": "application/json"}
+
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("user", user)
+		ctx.ApplicationHandler.CreateApplication(c)
+		assert.Equalf(req.ShouldStatus, w.Code, "CreateApplication (Test case: \"%s\") Expected status code %v but have %v.", req.Name, req.ShouldStatus, w.Code)
+
+		if w.Code == 200 {
+			require.NoError(json.NewDecoder(w.Body).Decode(&application))
+		}
+	}
+
+	assert.Equal("#ops:example.com", application.Room)
+	assert.True(application.IsBoundToRoom())
+
+	req := tests.Request{Name: "Unbind room", Method: "PUT", Endpoint: fmt.Sprintf("/application/%d", application.ID), Data: `{"room_id": ""}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	c.Set("id", application.ID)
+	ctx.ApplicationHandler.UpdateApplication(c)
+	require.Equal(200, w.Code)
+
+	updated, err := ctx.Database.GetApplicationByID(application.ID)
+	require.NoError(err)
+	assert.False(updated.IsBoundToRoom(), "Application should use its own channel again")
+	assert.Equal(fmt.Sprintf("%d-%s", application.ID, application.Name), updated.MatrixID)
+}
+
+// Builds a multipart form with the given content as form field file
+func imageForm(t *testing.T, content []byte) (string, string) {
+	var body bytes.Buffer
+
+	form := multipart.NewWriter(&body)
+	if content != nil {
+		file, err := form.CreateFormFile("file", "image")
+		require.NoError(t, err)
+		_, err = file.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, form.Close())
+
+	return body.String(), form.FormDataContentType()
+}
+
+func TestApi_UploadApplicationImage(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The user is not stored, so that the users of the other tests keep their IDs.
+	user := &model.User{ID: 4545, Name: "imageuser", MatrixID: "@imageuser:example.com"}
+
+	req := tests.Request{Name: "Create application", Method: "POST", Endpoint: "/application", Data: `{"name": "pictured"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	ctx.ApplicationHandler.CreateApplication(c)
+	require.Equal(200, w.Code)
+
+	var application model.Application
+	require.NoError(json.NewDecoder(w.Body).Decode(&application))
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	testCases := []struct {
+		name         string
+		content      []byte
+		shouldStatus int
+	}{
+		{"Missing file", nil, 400},
+		{"Text file", []byte("not an image"), 400},
+		{"Too large", append(png, make([]byte, 5<<20)...), 400},
+		{"PNG image", png, 200},
+	}
+
+	for _, tc := range testCases {
+		body, contentType := imageForm(t, tc.content)
+
+		req := tests.Request{Name: tc.name, Method: "POST", Endpoint: fmt.Sprintf("/application/%d/image", application.ID), Data: body, Headers: map[string]string{"Content-Type": contentType}}
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("user", user)
+		c.Set("id", application.ID)
+		ctx.ApplicationHandler.UploadApplicationImage(c)
+		assert.Equalf(tc.shouldStatus, w.Code, "UploadApplicationImage (Test case: \"%s\") Expected status code %v but have %v.", tc.name, tc.shouldStatus, w.Code)
+	}
+
+	updated, err := ctx.Database.GetApplicationByID(application.ID)
+	require.NoError(err)
+	assert.Equal(fmt.Sprintf("mxc://example.com/%d", application.ID), updated.Avatar)
+}
+
+func TestApi_UpdateTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	application := model.Application{}
+
+	unclosed := "{{ .Title"
+	assert.Equal(pberrors.ErrInvalidTemplate, updateTemplates(&application, &model.UpdateApplication{TitleTemplate: &unclosed}))
+	assert.Empty(application.TitleTemplate)
+
+	unknown := "jinja"
+	assert.Equal(pberrors.ErrInvalidTemplate, updateTemplates(&application, &model.UpdateApplication{TemplateEngine: &unknown}))
+	assert.Empty(application.TemplateEngine)
+
+	title := "[{{ .Application }}] {{ .Title }}"
+	engine := model.TemplateEngineHTML
+	assert.NoError(updateTemplates(&application, &model.UpdateApplication{TitleTemplate: &title, TemplateEngine: &engine}))
+	assert.Equal(title, application.TitleTemplate)
+	assert.Equal(model.TemplateEngineHTML, application.TemplateEngine)
+	assert.True(application.HasTemplates())
+}
+
+func TestApi_RenderApplicationTemplates(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The user is not stored, so that the users of the other tests keep their IDs.
+	user := &model.User{ID: 4646, Name: "templateuser", MatrixID: "@templateuser:example.com"}
+
+	req := tests.Request{Name: "Create application", Method: "POST", Endpoint: "/application", Data: `{"name": "templated"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", user)
+	ctx.ApplicationHandler.CreateApplication(c)
+	require.Equal(200, w.Code)
+
+	var application model.Application
+	require.NoError(json.NewDecoder(w.Body).Decode(&application))
+
+	testCases := []struct {
+		name     string
+		data     string
+		rendered model.RenderedNotification
+	}{
+		{"Without templates", `{"message": "Disk full"}`, model.RenderedNotification{Title: "templated", Message: "Disk full", ContentType: "text/plain"}},
+		{"Text templates", `{"message": "Disk full", "extras": {"host": "db1"}, "title_template": "{{ .Extras.host }}", "message_template": "{{ .Priority }}: {{ .Message }}"}`, model.RenderedNotification{Title: "db1", Message: "0: Disk full", ContentType: "text/plain"}},
+		{"HTML template", `{"message": "<b>", "message_template": "<p>{{ .Message }}</p>", "template_engine": "html"}`, model.RenderedNotification{Title: "templated", Message: "<p>&lt;b&gt;</p>", ContentType: "text/html"}},
+		{"HTML title template", `{"title": "<b>", "message": "Disk & CPU", "title_template": "<i>{{ .Title }}</i>", "template_engine": "html"}`, model.RenderedNotification{Title: "<i>&lt;b&gt;</i>", Message: "Disk &amp; CPU", ContentType: "text/html"}},
+		{"HTML template for HTML", `{"title": "<b>db1</b>", "message": "<b>", "message_template": "<p>{{ .Message }}</p>", "template_engine": "html", "extras": {"client::display": {"contentType": "text/html"}}}`, model.RenderedNotification{Title: "<b>db1</b>", Message: "<p>&lt;b&gt;</p>", ContentType: "text/html"}},
+		{"Unclosed action", `{"message": "Disk full", "message_template": "{{ .Message"}`, model.RenderedNotification{Error: "template: message:1: unclosed action"}},
+	}
+
+	for _, tc := range testCases {
+		req := tests.Request{Name: tc.name, Method: "POST", Endpoint: fmt.Sprintf("/application/%d/render", application.ID), Data: tc.data, Headers: map[string]string{"Content-Type": "application/json"}}
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("user", user)
+		c.Set("id", application.ID)
+		ctx.ApplicationHandler.RenderApplicationTemplates(c)
+		require.Equalf(200, w.Code, "RenderApplicationTemplates (Test case: \"%s\")", tc.name)
+
+		var rendered model.RenderedNotification
+		require.NoError(json.NewDecoder(w.Body).Decode(&rendered))
+		assert.Equalf(tc.rendered, rendered, "RenderApplicationTemplates (Test case: \"%s\")", tc.name)
+	}
+
+	stored, err := ctx.Database.GetApplicationByID(application.ID)
+	require.NoError(err)
+	assert.False(stored.HasTemplates(), "A dry run should not store the templates")
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/pushbits/server/internal/authentication"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The ClientStream interface for closing the stream connections of deleted clients.
+type ClientStream interface {
+	Disconnect(clientID uint)
+}
+
+// ClientHandler holds information for processing requests about the clients of users.
+type ClientHandler struct {
+	DB     Database
+	Stream ClientStream
+}
+
+func (h *ClientHandler) clientExists(token string) bool {
+	client, _ := h.DB.GetClientByToken(token)
+	return client != nil
+}
+
+// CreateClient godoc
+// @Summary Create Client
+// @Description Create a client token that Gotify clients receive the notifications of the user with via /stream
+// @ID post-client
+// @Tags Client
+// @Accept json,mpfd
+// @Produce json
+// @Param name query string true "Name of the client"
+// @Success 200 {object} model.Client
+// @Failure 500,400,403 ""
+// @Security BasicAuth
+// @Router /client [post]
+func (h *ClientHandler) CreateClient(ctx *gin.Context) {
+	var createClient model.CreateClient
+
+	if err := ctx.Bind(&createClient); err != nil {
+		log.L.Println(err)
+		return
+	}
+
+	user := authentication.GetUser(ctx)
+	if user == nil {
+		return
+	}
+
+	log.L.Printf("Creating client %s for user %s.", createClient.Name, user.Name)
+
+	client := model.Client{
+		Token:  authentication.GenerateNotExistingToken(func(bool) string { return authentication.GenerateClientToken() }, false, h.clientExists),
+		UserID: user.ID,
+		Name:   createClient.Name,
+	}
+
+	err := h.DB.CreateClient(&client)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &client)
+}
+
+// GetClients godoc
+// @Summary Get Clients
+// @Description Get the clients of the current user
+// @ID get-client
+// @Tags Client
+// @Accept json,mpfd
+// @Produce json
+// @Success 200 {array} model.Client
+// @Failure 500,403 ""
+// @Security BasicAuth
+// @Router /client [get]
+func (h *ClientHandler) GetClients(ctx *gin.Context) {
+	user := authentication.GetUser(ctx)
+	if user == nil {
+		return
+	}
+
+	clients, err := h.DB.GetClients(user)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &clients)
+}
+
+// DeleteClient godoc
+// @Summary Delete Client
+// @Description Delete a client and close its stream connections
+// @ID delete-client-id
+// @Tags Client
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the client"
+// @Success 200 ""
+// @Failure 500,404,403 ""
+// @Security BasicAuth
+// @Router /client/{id} [delete]
+func (h *ClientHandler) DeleteClient(ctx *gin.Context) {
+	client, err := getClient(ctx, h.DB)
+	if err != nil || client == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, client.UserID) {
+		return
+	}
+
+	log.L.Printf("Deleting client %s (ID %d).", client.Name, client.ID)
+
+	err = h.DB.DeleteClient(client)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	if h.Stream != nil {
+		h.Stream.Disconnect(client.ID)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/tests"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+func TestApi_Clients(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The users are not stored, so that the users of the other tests keep their IDs.
+	owner := &model.User{ID: 4747, Name: "clientowner", MatrixID: "@clientowner:example.com"}
+	other := &model.User{ID: 4748, Name: "clientother", MatrixID: "@clientother:example.com"}
+
+	stream := &mockups.MockStream{}
+	handler := ClientHandler{DB: ctx.Database, Stream: stream}
+
+	req := tests.Request{Name: "Missing name", Method: "POST", Endpoint: "/client", Data: `{}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", owner)
+	handler.CreateClient(c)
+	assert.Equal(400, w.Code)
+
+	req = tests.Request{Name: "Create client", Method: "POST", Endpoint: "/client", Data: `{"name": "phone"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	w, c, err = req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", owner)
+	handler.CreateClient(c)
+	require.Equal(200, w.Code)
+
+	var client model.Client
+	require.NoError(json.NewDecoder(w.Body).Decode(&client))
+	assert.Equal("phone", client.Name)
+	assert.Regexp("^C[A-Za-z0-9]{63}$", client.Token)
+
+	stored, err := ctx.Database.GetClientByToken(client.Token)
+	require.NoError(err)
+	assert.Equal(owner.ID, stored.UserID)
+
+	req = tests.Request{Name: "Get clients", Method: "GET", Endpoint: "/client"}
+	w, c, err = req.GetRequest()
+	require.NoError(err)
+
+	c.Set("user", owner)
+	handler.GetClients(c)
+	require.Equal(200, w.Code)
+
+	var clients []model.Client
+	require.NoError(json.NewDecoder(w.Body).Decode(&clients))
+	assert.Equal([]model.Client{client}, clients)
+
+	testCases := []struct {
+		name         string
+		user         *model.User
+		shouldStatus int
+	}{
+		{"Other user", other, 403},
+		{"Owner", owner, 200},
+	}
+
+	for _, tc := range testCases {
+		req := tests.Request{Name: tc.name, Method: "DELETE", Endpoint: fmt.Sprintf("/client/%d", client.ID)}
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("user", tc.user)
+		c.Set("id", client.ID)
+		handler.DeleteClient(c)
+		assert.Equalf(tc.shouldStatus, w.Code, "DeleteClient (Test case: \"%s\") Expected status code %v but have %v.", tc.name, tc.shouldStatus, w.Code)
+	}
+
+	assert.Equal([]uint{client.ID}, stream.Disconnected, "Stream connections of the deleted client should be closed")
+
+	_, err = ctx.Database.GetClientByToken(client.Token)
+	assert.Error(err)
+}
@@ -31,6 +31,17 @@ func getMessageID(ctx *gin.Context) (string, error) {
 	return id, nil
 }
 
+func getSubscriberID(ctx *gin.Context) (uint, error) {
+	id, ok := ctx.MustGet("subscriberid").(uint)
+	if !ok {
+		err := errors.New("an error occurred while retrieving subscriber ID from context")
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
 func getApplication(ctx *gin.Context, db Database) (*model.Application, error) {
 	id, err := getID(ctx)
 	if err != nil {
@@ -50,6 +61,25 @@ func getApplication(ctx *gin.Context, db Database) (*model.Application, error) {
 	return application, nil
 }
 
+func getClient(ctx *gin.Context, db Database) (*model.Client, error) {
+	id, err := getID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := db.GetClientByID(id)
+	if success := SuccessOrAbort(ctx, http.StatusNotFound, err); !success {
+		return nil, err
+	}
+	if client == nil {
+		err := errors.New("client not found")
+		ctx.AbortWithError(http.StatusNotFound, err)
+		return nil, err
+	}
+
+	return client, nil
+}
+
 func getUser(ctx *gin.Context, db Database) (*model.User, error) {
 	id, err := getID(ctx)
 	if err != nil {
@@ -14,8 +14,24 @@ type Database interface {
 	DeleteApplication(application *model.Application) error
 	GetApplicationByID(ID uint) (*model.Application, error)
 	GetApplicationByToken(token string) (*model.Application, error)
+	CountApplicationsByMatrixID(matrixID string, excludeID uint) (int64, error)
 	UpdateApplication(application *model.Application) error
 
+	CreateSubscriber(s *model.Subscriber) error
+	DeleteSubscriber(s *model.Subscriber) error
+	GetSubscriber(ID uint) (*model.Subscriber, error)
+	GetSubscribers(applicationID uint) ([]model.Subscriber, error)
+	GetSubscriptions(userID uint) ([]model.Subscriber, error)
+
+	CreateClient(client *model.Client) error
+	DeleteClient(client *model.Client) error
+	GetClientByID(ID uint) (*model.Client, error)
+	GetClientByToken(token string) (*model.Client, error)
+	GetClients(user *model.User) ([]model.Client, error)
+
+	GetStoredNotifications(applicationIDs []uint, since uint, limit int) ([]model.StoredNotification, error)
+	DeleteStoredNotifications(application *model.Application) error
+
 	AdminUserCount() (int64, error)
 	CreateUser(user model.CreateUser) (*model.User, error)
 	DeleteUser(user *model.User) error
@@ -26,11 +42,19 @@ type Database interface {
 	UpdateUser(user *model.User) error
 }
 
+// The MessageDatabase interface for encapsulating access to the message history.
+type MessageDatabase interface {
+	GetStoredNotifications(applicationIDs []uint, since uint, limit int) ([]model.StoredNotification, error)
+}
+
 // The Dispatcher interface for relaying notifications.
 type Dispatcher interface {
-	RegisterApplication(id uint, name, user string) (string, error)
+	RegisterApplication(a *model.Application, u *model.User) (string, error)
 	DeregisterApplication(a *model.Application, u *model.User) error
 	UpdateApplication(a *model.Application, behavior *configuration.RepairBehavior) error
+	InviteSubscriber(a *model.Application, matrixID string) error
+	RemoveSubscriber(a *model.Application, matrixID string) error
+	UploadAvatar(a *model.Application, data []byte, contentType string) (string, error)
 }
 
 // The CredentialsManager interface for updating credentials.
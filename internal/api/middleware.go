@@ -14,6 +14,11 @@ type messageIDInURI struct {
 	MessageID string `uri:"messageid" binding:"required"`
 }
 
+// subscriberIDInURI is used to retrieve a subscriber ID from a context.
+type subscriberIDInURI struct {
+	SubscriberID uint `uri:"subscriberid" binding:"required"`
+}
+
 // RequireIDInURI returns a Gin middleware which requires an ID to be supplied in the URI of the request.
 func RequireIDInURI() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
@@ -39,3 +44,16 @@ func RequireMessageIDInURI() gin.HandlerFunc {
 		ctx.Set("messageid", requestModel.MessageID)
 	}
 }
+
+// RequireSubscriberIDInURI returns a Gin middleware which requires a subscriber ID to be supplied in the URI of the request.
+func RequireSubscriberIDInURI() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var requestModel subscriberIDInURI
+
+		if err := ctx.BindUri(&requestModel); err != nil {
+			return
+		}
+
+		ctx.Set("subscriberid", requestModel.SubscriberID)
+	}
+}
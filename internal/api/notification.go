@@ -1,30 +1,222 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/pushbits/server/internal/authentication"
+	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/log"
 	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
 
 	"github.com/gin-gonic/gin"
 )
 
 // The NotificationDatabase interface for encapsulating database access.
-type NotificationDatabase interface{}
+type NotificationDatabase interface {
+	GetApplications(user *model.User) ([]model.Application, error)
+
+	CreateStoredNotification(n *model.StoredNotification) error
+	GetStoredNotifications(applicationIDs []uint, since uint, limit int) ([]model.StoredNotification, error)
+	GetStoredNotificationByEventID(application *model.Application, eventID string) (*model.StoredNotification, error)
+	UpdateStoredNotification(n *model.StoredNotification) error
+	GetCollapsibleStoredNotification(application *model.Application, collapseKey string, since time.Time) (*model.StoredNotification, error)
+	DeleteStoredNotification(n *model.StoredNotification) error
+
+	GetQueuedNotification(ID uint) (*model.QueuedNotification, error)
+	GetQueuedNotifications(application *model.Application, status model.QueueStatus) ([]model.QueuedNotification, error)
+
+	GetScheduledNotification(ID uint) (*model.ScheduledNotification, error)
+	GetScheduledNotifications(application *model.Application, status model.ScheduleStatus) ([]model.ScheduledNotification, error)
+}
 
 // The NotificationDispatcher interface for relaying notifications.
 type NotificationDispatcher interface {
 	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+	Admits(a *model.Application, n *model.Notification) bool
+	UpdateNotification(a *model.Application, n *model.Notification, roomID string) error
 	DeleteNotification(a *model.Application, n *model.DeleteNotification) error
 }
 
+// The NotificationQueue interface for delivering notifications in the background.
+type NotificationQueue interface {
+	Enqueue(a *model.Application, n *model.Notification) (*model.QueuedNotification, error)
+}
+
+// The NotificationStream interface for pushing sent notifications to connected clients.
+type NotificationStream interface {
+	Publish(a *model.Application, n *model.StoredNotification)
+}
+
+// The NotificationScheduler interface for holding back notifications until a later time.
+type NotificationScheduler interface {
+	Schedule(a *model.Application, n *model.Notification, deliverAt time.Time) (*model.ScheduledNotification, error)
+	Cancel(a *model.Application, id uint) error
+}
+
 // NotificationHandler holds information for processing requests about notifications.
 type NotificationHandler struct {
-	DB NotificationDatabase
-	DP NotificationDispatcher
+	DB        NotificationDatabase
+	DP        NotificationDispatcher
+	Queue     NotificationQueue
+	Scheduler NotificationScheduler
+	Stream    NotificationStream
+	Dedup     configuration.Dedup
+}
+
+// DeliverNotification sends a sanitized notification right away or, if a queue is given, adds it to the queue.
+// Sent notifications are added to the message history and, if a stream is given, pushed to it.
+// This includes suppressed notifications and those held back for a digest, which stream clients see right away.
+// It returns the HTTP status code that signals the outcome to the client.
+func DeliverNotification(db NotificationDatabase, dp NotificationDispatcher, queue NotificationQueue, stream NotificationStream, a *model.Application, n *model.Notification) (int, error) {
+	if queue != nil {
+		queued, err := queue.Enqueue(a, n)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		n.QueueID = queued.ID
+
+		return http.StatusAccepted, nil
+	}
+
+	messageID, err := dp.SendNotification(a, n)
+	if errors.Is(err, pberrors.ErrNotificationSuppressed) {
+		// Suppressed notifications are kept in the message history, so clients polling it still see them.
+		messageID = ""
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	n.ID = messageID
+	n.URLEncodedID = url.QueryEscape(messageID)
+
+	// Stream clients identify notifications by their ID in the message history, so only stored ones are pushed.
+	stored := model.NewStoredNotification(n, a.MatrixID, messageID)
+	if err := db.CreateStoredNotification(stored); err != nil {
+		log.L.Printf("Cannot add notification to message history: %s", err)
+	} else if stream != nil {
+		stream.Publish(a, stored)
+	}
+
+	return http.StatusOK, nil
+}
+
+// ReplaceNotification replaces the content of the sent notification with the ID of the given sanitized notification.
+// The message history is updated accordingly and the edited notification is pushed to the stream again.
+func ReplaceNotification(db NotificationDatabase, dp NotificationDispatcher, stream NotificationStream, a *model.Application, n *model.Notification) error {
+	// Notifications sent before event mappings were recorded are not in the message history.
+	roomID := ""
+	stored, err := db.GetStoredNotificationByEventID(a, n.ID)
+	if stored != nil && err == nil {
+		roomID = stored.RoomID
+	}
+
+	if err := dp.UpdateNotification(a, n, roomID); err != nil {
+		return err
+	}
+
+	if stored != nil {
+		stored.Title = n.Title
+		stored.Message = n.Message
+		stored.Priority = n.Priority
+		stored.Extras = n.Extras
+		if n.ExpiresIn > 0 {
+			stored.ExpiresAt = n.ExpiresAt()
+			stored.ExpiryMode = n.ExpiryMode
+		}
+
+		if err := db.UpdateStoredNotification(stored); err != nil {
+			log.L.Printf("Cannot update notification in message history: %s", err)
+		} else if stream != nil {
+			stream.Publish(a, stored)
+		}
+	}
+
+	return nil
+}
+
+// Edits the previous notification with the same collapse key to show the new content and how often it was sent.
+// The edited notification is pushed to the stream again, with the ID it has in the message history.
+// It returns false if there is no such notification within the collapse window or if it cannot be edited.
+func (h *NotificationHandler) collapseNotification(a *model.Application, n *model.Notification) bool {
+	if n.CollapseKey == "" && h.Dedup.Identical {
+		n.CollapseKey = n.ContentKey()
+	}
+
+	if n.CollapseKey == "" {
+		return false
+	}
+
+	// Notifications that are suppressed or held back must not edit the previous one either, they are stored or held like any other.
+	if !h.DP.Admits(a, n) {
+		return false
+	}
+
+	window := h.Dedup.Window
+	if n.CollapseWindow > 0 {
+		window = time.Duration(n.CollapseWindow) * time.Second
+	}
+
+	previous, err := h.DB.GetCollapsibleStoredNotification(a, n.CollapseKey, n.Date.Add(-window))
+	if err != nil || previous == nil {
+		return false
+	}
+
+	count := previous.CollapseCount + 1
+	title := n.Title
+
+	n.ID = previous.EventID
+	n.URLEncodedID = url.QueryEscape(previous.EventID)
+	n.Title = fmt.Sprintf("%s (×%d)", title, count)
+
+	if err := h.DP.UpdateNotification(a, n, previous.RoomID); err != nil {
+		log.L.Printf("Cannot collapse notification into %s, sending it separately: %s", previous.EventID, err)
+		n.ID = ""
+		n.URLEncodedID = ""
+		n.Title = title
+		return false
+	}
+
+	log.L.Printf("Collapsed notification into %s for application %s (×%d).", previous.EventID, a.Name, count)
+
+	previous.Title = n.Title
+	previous.Message = n.Message
+	previous.Priority = n.Priority
+	previous.Extras = n.Extras
+	previous.Date = n.Date
+	previous.CollapseCount = count
+	previous.ExpiresAt = n.ExpiresAt()
+	previous.ExpiryMode = n.ExpiryMode
+
+	if err := h.DB.UpdateStoredNotification(previous); err != nil {
+		log.L.Printf("Cannot update notification in message history: %s", err)
+	} else if h.Stream != nil {
+		h.Stream.Publish(a, previous)
+	}
+
+	return true
+}
+
+// Holds a notification back until the given time and responds with its ID in the schedule
+func (h *NotificationHandler) scheduleNotification(ctx *gin.Context, a *model.Application, n *model.Notification, deliverAt time.Time) {
+	if h.Scheduler == nil {
+		ctx.AbortWithError(http.StatusNotImplemented, errors.New("scheduling is not available"))
+		return
+	}
+
+	scheduled, err := h.Scheduler.Schedule(a, n, deliverAt)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	n.ScheduledID = scheduled.ID
+
+	ctx.JSON(http.StatusAccepted, n)
 }
 
 // CreateNotification godoc
@@ -38,9 +230,16 @@ type NotificationHandler struct {
 // @Param title query string false "The title to send"
 // @Param priority query integer false "The notifications priority"
 // @Param extras query model.NotificationExtras false "JSON object with additional information"
+// @Param collapse_key query string false "Notifications with the same key edit the previous one instead of posting again, at most 128 characters and not with deliver_at or delay"
+// @Param collapse_window query integer false "Seconds within which notifications with the same key are collapsed"
+// @Param deliver_at query string false "Hold the notification back until this time (RFC 3339)"
+// @Param delay query string false "Hold the notification back for this duration, for example 10m"
+// @Param expires_in query integer false "Seconds after which the notification is deleted, at most one year"
+// @Param expiry_mode query string false "How the notification is deleted when it expires (strikethrough, redact)"
 // @Param token query string true "Channels token, can also be provieded in the header"
 // @Success 200 {object} model.Notification
-// @Failure 500,404,403 ""
+// @Success 202 {object} model.Notification "The notification was queued or scheduled, see queue_id or scheduled_id"
+// @Failure 500,404,403,400 ""
 // @Router /message [post]
 func (h *NotificationHandler) CreateNotification(ctx *gin.Context) {
 	application := authentication.GetApplication(ctx)
@@ -57,13 +256,104 @@ func (h *NotificationHandler) CreateNotification(ctx *gin.Context) {
 
 	notification.Sanitize(application)
 
-	messageID, err := h.DP.SendNotification(application, &notification)
-	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+	if !model.ValidExpiryMode(notification.ExpiryMode) {
+		ctx.AbortWithError(http.StatusBadRequest, pberrors.ErrInvalidExpiryMode)
+		return
+	}
+
+	if !model.ValidExpiresIn(notification.ExpiresIn) {
+		ctx.AbortWithError(http.StatusBadRequest, pberrors.ErrInvalidExpiresIn)
+		return
+	}
+
+	if !model.ValidCollapseKey(notification.CollapseKey) {
+		ctx.AbortWithError(http.StatusBadRequest, pberrors.ErrInvalidCollapseKey)
+		return
+	}
+
+	deliverAt, err := notification.ScheduledTime(notification.Date)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if !deliverAt.IsZero() {
+		if notification.CollapseKey != "" {
+			ctx.AbortWithError(http.StatusBadRequest, pberrors.ErrScheduledCollapseKey)
+			return
+		}
+
+		h.scheduleNotification(ctx, application, &notification, deliverAt)
 		return
 	}
 
-	notification.ID = messageID
-	notification.URLEncodedID = url.QueryEscape(messageID)
+	if h.collapseNotification(application, &notification) {
+		ctx.JSON(http.StatusOK, &notification)
+		return
+	}
+
+	status, err := DeliverNotification(h.DB, h.DP, h.Queue, h.Stream, application, &notification)
+	if success := SuccessOrAbort(ctx, status, err); !success {
+		return
+	}
+
+	ctx.JSON(status, &notification)
+}
+
+// UpdateNotification godoc
+// @Summary Update a Notification
+// @Description Replaces the title and message of a notification that was already sent
+// @ID put-message-id
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param message_id path string true "ID of the message to update"
+// @Param message query string true "The new message"
+// @Param title query string false "The new title"
+// @Param priority query integer false "The notifications priority"
+// @Param extras query model.NotificationExtras false "JSON object with additional information"
+// @Param expires_in query integer false "Seconds after which the notification is deleted, counted from now and at most one year"
+// @Param expiry_mode query string false "How the notification is deleted when it expires (strikethrough, redact)"
+// @Param token query string true "Channels token, can also be provieded in the header"
+// @Success 200 {object} model.Notification
+// @Failure 500,404,403,400 ""
+// @Router /message/{message_id} [put]
+func (h *NotificationHandler) UpdateNotification(ctx *gin.Context) {
+	application := authentication.GetApplication(ctx)
+	if application == nil {
+		return
+	}
+
+	log.L.Printf("Updating notification for application %s.", application.Name)
+
+	id, err := getMessageID(ctx)
+	if success := SuccessOrAbort(ctx, http.StatusUnprocessableEntity, err); !success {
+		return
+	}
+
+	var notification model.Notification
+	if err := ctx.Bind(&notification); err != nil {
+		return
+	}
+
+	notification.Sanitize(application)
+	notification.ID = id
+
+	if !model.ValidExpiryMode(notification.ExpiryMode) {
+		ctx.AbortWithError(http.StatusBadRequest, pberrors.ErrInvalidExpiryMode)
+		return
+	}
+
+	if !model.ValidExpiresIn(notification.ExpiresIn) {
+		ctx.AbortWithError(http.StatusBadRequest, pberrors.ErrInvalidExpiresIn)
+		return
+	}
+
+	notification.URLEncodedID = url.QueryEscape(id)
+
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, ReplaceNotification(h.DB, h.DP, h.Stream, application, &notification)); !success {
+		return
+	}
 
 	ctx.JSON(http.StatusOK, &notification)
 }
@@ -76,9 +366,11 @@ func (h *NotificationHandler) CreateNotification(ctx *gin.Context) {
 // @Accept json,mpfd
 // @Produce json
 // @Param message_id path string true "ID of the message to delete"
+// @Param redact query bool false "Redact the message instead of striking it through, defaults to the setting of the application"
+// @Param reason query string false "The reason for the redaction"
 // @Param token query string true "Channels token, can also be provieded in the header"
 // @Success 200 ""
-// @Failure 500,404,403 ""
+// @Failure 500,404,403,400 ""
 // @Router /message/{message_id} [DELETE]
 func (h *NotificationHandler) DeleteNotification(ctx *gin.Context) {
 	application := authentication.GetApplication(ctx)
@@ -93,14 +385,236 @@ func (h *NotificationHandler) DeleteNotification(ctx *gin.Context) {
 		return
 	}
 
+	var query model.DeleteNotificationQuery
+	if err := ctx.BindQuery(&query); err != nil {
+		return
+	}
+
 	n := model.DeleteNotification{
-		ID:   id,
-		Date: time.Now(),
+		ID:     id,
+		Date:   time.Now(),
+		Redact: application.RedactOnDelete,
+		Reason: query.Reason,
+	}
+	if query.Redact != nil {
+		n.Redact = *query.Redact
+	}
+
+	// Notifications sent before event mappings were recorded are not in the message history.
+	stored, err := h.DB.GetStoredNotificationByEventID(application, id)
+	if stored != nil && err == nil {
+		n.RoomID = stored.RoomID
 	}
 
 	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, h.DP.DeleteNotification(application, &n)); !success {
 		return
 	}
 
+	if stored != nil {
+		if err := h.DB.DeleteStoredNotification(stored); err != nil {
+			log.L.Printf("Cannot remove notification from message history: %s", err)
+		}
+	}
+
 	ctx.Status(http.StatusOK)
 }
+
+// GetQueuedNotifications godoc
+// @Summary Get queued Notifications
+// @Description Get the delivery state of all queued notifications of the channel
+// @ID get-queue
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param status query string false "Only return notifications with this status (pending, delivered, dead)"
+// @Param token query string true "Channels token, can also be provieded in the header"
+// @Success 200 {array} model.QueuedNotification
+// @Failure 500,403 ""
+// @Router /queue [get]
+func (h *NotificationHandler) GetQueuedNotifications(ctx *gin.Context) {
+	application := authentication.GetApplication(ctx)
+	if application == nil {
+		return
+	}
+
+	status := model.QueueStatus(ctx.Query("status"))
+
+	queued, err := h.DB.GetQueuedNotifications(application, status)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &queued)
+}
+
+// GetQueuedNotification godoc
+// @Summary Get a queued Notification
+// @Description Get the delivery state of a single queued notification
+// @ID get-queue-id
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the queued notification"
+// @Param token query string true "Channels token, can also be provieded in the header"
+// @Success 200 {object} model.QueuedNotification
+// @Failure 404,403 ""
+// @Router /queue/{id} [get]
+func (h *NotificationHandler) GetQueuedNotification(ctx *gin.Context) {
+	application := authentication.GetApplication(ctx)
+	if application == nil {
+		return
+	}
+
+	id, err := getID(ctx)
+	if err != nil {
+		return
+	}
+
+	queued, err := h.DB.GetQueuedNotification(id)
+	if success := SuccessOrAbort(ctx, http.StatusNotFound, err); !success {
+		return
+	}
+
+	if queued == nil || queued.ApplicationID != application.ID {
+		ctx.AbortWithError(http.StatusNotFound, errors.New("queued notification not found"))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, queued)
+}
+
+// GetScheduledNotifications godoc
+// @Summary Get scheduled Notifications
+// @Description Get all notifications of the channel that are held back until a later time
+// @ID get-schedule
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param status query string false "Only return notifications with this status (pending, delivered, failed)"
+// @Param token query string true "Channels token, can also be provieded in the header"
+// @Success 200 {array} model.ScheduledNotification
+// @Failure 500,403 ""
+// @Router /schedule [get]
+func (h *NotificationHandler) GetScheduledNotifications(ctx *gin.Context) {
+	application := authentication.GetApplication(ctx)
+	if application == nil {
+		return
+	}
+
+	status := model.ScheduleStatus(ctx.Query("status"))
+
+	scheduled, err := h.DB.GetScheduledNotifications(application, status)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &scheduled)
+}
+
+// GetScheduledNotification godoc
+// @Summary Get a scheduled Notification
+// @Description Get the delivery state of a single scheduled notification
+// @ID get-schedule-id
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the scheduled notification"
+// @Param token query string true "Channels token, can also be provieded in the header"
+// @Success 200 {object} model.ScheduledNotification
+// @Failure 404,403 ""
+// @Router /schedule/{id} [get]
+func (h *NotificationHandler) GetScheduledNotification(ctx *gin.Context) {
+	application := authentication.GetApplication(ctx)
+	if application == nil {
+		return
+	}
+
+	id, err := getID(ctx)
+	if err != nil {
+		return
+	}
+
+	scheduled, err := h.DB.GetScheduledNotification(id)
+	if success := SuccessOrAbort(ctx, http.StatusNotFound, err); !success {
+		return
+	}
+
+	if scheduled == nil || scheduled.ApplicationID != application.ID {
+		ctx.AbortWithError(http.StatusNotFound, errors.New("scheduled notification not found"))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, scheduled)
+}
+
+// CancelScheduledNotification godoc
+// @Summary Cancel a scheduled Notification
+// @Description Removes a notification that was not delivered yet from the schedule
+// @ID delete-schedule-id
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the scheduled notification"
+// @Param token query string true "Channels token, can also be provieded in the header"
+// @Success 200 ""
+// @Failure 500,404,403 ""
+// @Router /schedule/{id} [delete]
+func (h *NotificationHandler) CancelScheduledNotification(ctx *gin.Context) {
+	application := authentication.GetApplication(ctx)
+	if application == nil {
+		return
+	}
+
+	id, err := getID(ctx)
+	if err != nil {
+		return
+	}
+
+	if h.Scheduler == nil {
+		ctx.AbortWithError(http.StatusNotFound, pberrors.ErrMessageNotFound)
+		return
+	}
+
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, h.Scheduler.Cancel(application, id)); !success {
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+// GetMessages godoc
+// @Summary Get Messages
+// @Description Get the message history of all applications of the current user, compatible with Gotify
+// @ID get-message
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param limit query integer false "The maximum number of messages to return (1-200)"
+// @Param since query integer false "Return only messages with an ID lower than this one"
+// @Success 200 {object} model.PagedMessages
+// @Failure 500,400 ""
+// @Security BasicAuth
+// @Router /message [get]
+func (h *NotificationHandler) GetMessages(ctx *gin.Context) {
+	user := authentication.GetUser(ctx)
+	if user == nil {
+		return
+	}
+
+	applications, err := h.DB.GetApplications(user)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	applicationIDs := make([]uint, len(applications))
+	for i, application := range applications {
+		applicationIDs[i] = application.ID
+	}
+
+	messages, err := getPagedMessages(ctx, h.DB, applicationIDs)
+	if err != nil {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, messages)
+}
@@ -2,14 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/scheduler"
 	"github.com/pushbits/server/tests"
+	"github.com/pushbits/server/tests/mockups"
 )
 
 func TestApi_CreateNotification(t *testing.T) {
@@ -32,6 +38,10 @@ func TestApi_CreateNotification(t *testing.T) {
 	testCases = append(testCases, tests.Request{Name: "Valid with message, title and priority", Method: "POST", Endpoint: "/message?token=123456&message=testmessage&title=abcdefghijklmnop&priority=3", ShouldStatus: 200, ShouldReturn: model.Notification{Message: "testmessage", Title: "abcdefghijklmnop", Priority: 3}})
 	testCases = append(testCases, tests.Request{Name: "Invalid with wrong field message2", Method: "POST", Endpoint: "/message?token=123456&message2=testmessage", ShouldStatus: 400})
 	testCases = append(testCases, tests.Request{Name: "No form data", Method: "POST", Endpoint: "/message", ShouldStatus: 400})
+	testCases = append(testCases, tests.Request{Name: "Invalid with expiry beyond one year", Method: "POST", Endpoint: "/message?token=123456&message=testmessage&expires_in=9223372036", ShouldStatus: 400})
+	testCases = append(testCases, tests.Request{Name: "Valid with collapse key of 128 characters", Method: "POST", Endpoint: "/message?token=123456&message=testmessage&collapse_key=" + strings.Repeat("%C3%A4", 128), ShouldStatus: 200, ShouldReturn: model.Notification{Message: "testmessage", Title: "Test Application"}})
+	testCases = append(testCases, tests.Request{Name: "Invalid with too long collapse key", Method: "POST", Endpoint: "/message?token=123456&message=testmessage&collapse_key=" + strings.Repeat("k", 129), ShouldStatus: 400})
+	testCases = append(testCases, tests.Request{Name: "Invalid with too long collapse key in extras", Method: "POST", Endpoint: "/message?token=123456", Data: `{"message": "testmessage", "extras": {"pushbits::collapse_key": "` + strings.Repeat("k", 129) + `"}}`, Headers: map[string]string{"Content-Type": "application/json"}, ShouldStatus: 400})
 
 	for _, req := range testCases {
 		var notification model.Notification
@@ -95,3 +105,378 @@ func TestApi_DeleteNotification(t *testing.T) {
 		assert.Equalf(w.Code, req.ShouldStatus, "(Test case: \"%s\") Expected status code %v but have %v.", req.Name, req.ShouldStatus, w.Code)
 	}
 }
+
+func TestApi_CreateNotificationQueued(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testApplication := model.Application{
+		ID:       1,
+		Token:    "123456",
+		UserID:   1,
+		Name:     "Test Application",
+		MatrixID: "@testuser:test.de",
+	}
+
+	handler := NotificationHandler{DB: ctx.Database, DP: ctx.NotificationHandler.DP, Queue: &mockups.MockQueue{}}
+
+	req := tests.Request{Name: "Valid with message", Method: "POST", Endpoint: "/message?token=123456&message=testmessage", ShouldStatus: 202}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", &testApplication)
+	handler.CreateNotification(c)
+
+	var notification model.Notification
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &notification))
+
+	assert.Equal(req.ShouldStatus, w.Code)
+	assert.Equal(uint(1), notification.QueueID)
+	assert.Empty(notification.ID)
+	assert.Equal("testmessage", notification.Message)
+}
+
+func TestApi_CreateNotificationStreamed(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testApplication := model.Application{
+		ID:       1,
+		Token:    "123456",
+		UserID:   1,
+		Name:     "Test Application",
+		MatrixID: "@testuser:test.de",
+	}
+
+	stream := &mockups.MockStream{}
+	handler := NotificationHandler{DB: ctx.Database, DP: ctx.NotificationHandler.DP, Stream: stream}
+
+	req := tests.Request{Name: "Valid with message", Method: "POST", Endpoint: "/message?token=123456&message=streamed&priority=4", ShouldStatus: 200}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", &testApplication)
+	handler.CreateNotification(c)
+	require.Equal(req.ShouldStatus, w.Code)
+
+	require.Len(stream.Published, 1)
+	assert.NotZero(stream.Published[0].ID, "Streamed notifications should carry the ID of the message history")
+	assert.Equal(uint(1), stream.Published[0].ApplicationID)
+	assert.Equal("streamed", stream.Published[0].Message)
+	assert.Equal("Test Application", stream.Published[0].Title)
+	assert.Equal(4, stream.Published[0].Priority)
+
+	queued := NotificationHandler{DB: ctx.Database, DP: ctx.NotificationHandler.DP, Queue: &mockups.MockQueue{}, Stream: stream}
+
+	w, c, err = req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", &testApplication)
+	queued.CreateNotification(c)
+	require.Equal(202, w.Code)
+	assert.Len(stream.Published, 1, "Queued notifications should be streamed once they are delivered")
+}
+
+func TestApi_GetMessages(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	user := ctx.Users[0]
+	application := model.Application{ID: 1, UserID: user.ID, Name: "Test Application"}
+
+	for i := 0; i < 3; i++ {
+		notification := model.Notification{Message: fmt.Sprintf("history %d", i)}
+		notification.Sanitize(&application)
+		require.NoError(ctx.Database.CreateStoredNotification(model.NewStoredNotification(&notification, "!room:test.de", fmt.Sprintf("$event%d", i))))
+	}
+
+	testCases := make([]tests.Request, 0)
+	testCases = append(testCases, tests.Request{Name: "Default paging", Method: "GET", Endpoint: "/message", ShouldStatus: 200})
+	testCases = append(testCases, tests.Request{Name: "Limited paging", Method: "GET", Endpoint: "/message?limit=2", ShouldStatus: 200})
+	testCases = append(testCases, tests.Request{Name: "Invalid limit", Method: "GET", Endpoint: "/message?limit=0", ShouldStatus: 400})
+
+	for _, req := range testCases {
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("user", user)
+		ctx.NotificationHandler.GetMessages(c)
+
+		assert.Equalf(req.ShouldStatus, w.Code, "(Test case: \"%s\") Expected status code %v but have %v.", req.Name, req.ShouldStatus, w.Code)
+		if w.Code != 200 {
+			continue
+		}
+
+		var paged model.PagedMessages
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &paged))
+
+		assert.Equalf(len(paged.Messages), paged.Paging.Size, "(Test case: \"%s\") Size does not match the number of messages", req.Name)
+		if paged.Paging.Limit == 2 {
+			assert.Equalf(2, paged.Paging.Size, "(Test case: \"%s\") Expected a full page", req.Name)
+			assert.Containsf(paged.Paging.Next, fmt.Sprintf("since=%d", paged.Messages[1].ID), "(Test case: \"%s\") Next page is not linked", req.Name)
+			assert.Greaterf(paged.Messages[0].ID, paged.Messages[1].ID, "(Test case: \"%s\") Messages are not ordered newest first", req.Name)
+		} else {
+			assert.GreaterOrEqualf(paged.Paging.Size, 3, "(Test case: \"%s\") Expected all stored messages", req.Name)
+		}
+	}
+}
+
+func TestApi_DeleteNotificationRemovesHistory(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	application := model.Application{ID: 1, UserID: 1, Name: "Test Application", MatrixID: "!room:test.de"}
+
+	notification := model.Notification{Message: "to be deleted"}
+	notification.Sanitize(&application)
+	require.NoError(ctx.Database.CreateStoredNotification(model.NewStoredNotification(&notification, application.MatrixID, "$deleted")))
+
+	req := tests.Request{Name: "Stored notification", Method: "DELETE", Endpoint: "/message/$deleted", ShouldStatus: 200}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", &application)
+	c.Set("messageid", "$deleted")
+	ctx.NotificationHandler.DeleteNotification(c)
+
+	assert.Equal(req.ShouldStatus, w.Code)
+
+	stored, err := ctx.Database.GetStoredNotificationByEventID(&application, "$deleted")
+	assert.Error(err)
+	assert.Nil(stored)
+}
+
+func TestApi_UpdateNotification(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	application := model.Application{ID: 1, UserID: 1, Name: "Test Application", MatrixID: "!room:test.de"}
+
+	notification := model.Notification{Message: "backup 30%"}
+	notification.Sanitize(&application)
+	require.NoError(ctx.Database.CreateStoredNotification(model.NewStoredNotification(&notification, application.MatrixID, "$progress")))
+
+	testCases := make([]tests.Request, 0)
+	testCases = append(testCases, tests.Request{Name: "Valid with message", Method: "PUT", Endpoint: "/message/$progress?message=backup%2060%25", ShouldStatus: 200, ShouldReturn: model.Notification{Message: "backup 60%", Title: "Test Application"}})
+	testCases = append(testCases, tests.Request{Name: "Valid with message and title", Method: "PUT", Endpoint: "/message/$progress?message=done&title=Backup", ShouldStatus: 200, ShouldReturn: model.Notification{Message: "done", Title: "Backup"}})
+	testCases = append(testCases, tests.Request{Name: "Invalid without message", Method: "PUT", Endpoint: "/message/$progress?title=Backup", ShouldStatus: 400})
+	testCases = append(testCases, tests.Request{Name: "Invalid with expiry beyond one year", Method: "PUT", Endpoint: "/message/$progress?message=done&expires_in=31536001", ShouldStatus: 400})
+
+	for _, req := range testCases {
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("app", &application)
+		c.Set("messageid", "$progress")
+		ctx.NotificationHandler.UpdateNotification(c)
+
+		assert.Equalf(req.ShouldStatus, w.Code, "(Test case: \"%s\") Expected status code %v but have %v.", req.Name, req.ShouldStatus, w.Code)
+		if w.Code != 200 {
+			continue
+		}
+
+		var updated model.Notification
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &updated))
+
+		shouldNotification, ok := req.ShouldReturn.(model.Notification)
+		require.True(ok)
+
+		assert.Equalf("$progress", updated.ID, "(Test case: \"%s\") Notification ID changed", req.Name)
+		assert.Equalf(shouldNotification.Message, updated.Message, "(Test case: \"%s\") Unexpected message", req.Name)
+		assert.Equalf(shouldNotification.Title, updated.Title, "(Test case: \"%s\") Unexpected title", req.Name)
+
+		stored, err := ctx.Database.GetStoredNotificationByEventID(&application, "$progress")
+		require.NoError(err)
+		assert.Equalf(shouldNotification.Message, stored.Message, "(Test case: \"%s\") Message history was not updated", req.Name)
+	}
+}
+
+func TestApi_CreateNotificationCollapsed(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	application := model.Application{ID: 1, UserID: 1, Name: "Test Application", MatrixID: "!room:test.de"}
+	stream := &mockups.MockStream{}
+	handler := NotificationHandler{DB: ctx.Database, DP: ctx.NotificationHandler.DP, Stream: stream, Dedup: configuration.Dedup{Window: time.Minute}}
+
+	send := func(endpoint string) model.Notification {
+		req := tests.Request{Name: "Collapsible", Method: "POST", Endpoint: endpoint}
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("app", &application)
+		handler.CreateNotification(c)
+		require.Equal(200, w.Code)
+
+		var notification model.Notification
+		require.NoError(json.Unmarshal(w.Body.Bytes(), &notification))
+		return notification
+	}
+
+	first := send("/message?message=down&title=Health&collapse_key=health")
+	second := send("/message?message=still%20down&title=Health&collapse_key=health")
+	third := send("/message?message=down&title=Health&collapse_key=other")
+
+	assert.Equal(first.ID, second.ID, "Notification with the same key should edit the previous one")
+	assert.Equal("Health (×2)", second.Title)
+	assert.NotEqual(first.ID, third.ID, "Notification with another key should be sent separately")
+
+	stored, err := ctx.Database.GetStoredNotificationByEventID(&application, first.ID)
+	require.NoError(err)
+	assert.Equal(2, stored.CollapseCount)
+	assert.Equal("still down", stored.Message)
+
+	require.Len(stream.Published, 3)
+	assert.Equal(stream.Published[0].ID, stream.Published[1].ID, "Collapsed notifications should be streamed with the ID of the previous one")
+	assert.Equal("Health (×2)", stream.Published[1].Title)
+	assert.Equal("still down", stream.Published[1].Message)
+
+	// Outside of the window, the notification is sent again.
+	fourth := send("/message?message=down&title=Health&collapse_key=health&collapse_window=1")
+	assert.Equal(first.ID, fourth.ID)
+	stored.Date = stored.Date.Add(-time.Hour)
+	require.NoError(ctx.Database.UpdateStoredNotification(stored))
+	fifth := send("/message?message=down&title=Health&collapse_key=health&collapse_window=1")
+	assert.NotEqual(first.ID, fifth.ID)
+
+	// Notifications that are suppressed do not edit the previous one.
+	muted := application
+	muted.MinPriority = 5
+	handler.DP = &mockups.MockDispatcher{}
+	req := tests.Request{Name: "Suppressed", Method: "POST", Endpoint: "/message?message=down&title=Health&collapse_key=other"}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", &muted)
+	handler.CreateNotification(c)
+
+	var suppressed model.Notification
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &suppressed))
+	assert.NotEqual(third.ID, suppressed.ID, "Suppressed notifications should not be collapsed into the previous one")
+
+	stored, err = ctx.Database.GetStoredNotificationByEventID(&application, third.ID)
+	require.NoError(err)
+	assert.Equal(1, stored.CollapseCount)
+}
+
+func TestApi_CreateNotificationScheduled(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	application := model.Application{ID: 1, UserID: 1, Name: "Test Application", MatrixID: "!room:test.de"}
+	s := scheduler.Create(ctx.Database, ctx.NotificationHandler.DP, nil, nil, configuration.Scheduler{PollInterval: time.Hour, MaxAttempts: 1, RetryInterval: time.Hour})
+	handler := NotificationHandler{DB: ctx.Database, DP: ctx.NotificationHandler.DP, Scheduler: s}
+
+	testCases := []tests.Request{
+		{Name: "Delayed", Method: "POST", Endpoint: "/message?message=later&delay=1h", ShouldStatus: 202},
+		{Name: "Absolute", Method: "POST", Endpoint: "/message?message=later&deliver_at=2999-01-01T00:00:00Z", ShouldStatus: 202},
+		{Name: "Both", Method: "POST", Endpoint: "/message?message=later&delay=1h&deliver_at=2999-01-01T00:00:00Z", ShouldStatus: 400},
+		{Name: "Negative delay", Method: "POST", Endpoint: "/message?message=later&delay=-1h", ShouldStatus: 400},
+		{Name: "In the past", Method: "POST", Endpoint: "/message?message=now&deliver_at=2000-01-01T00:00:00Z", ShouldStatus: 200},
+		{Name: "Collapse key", Method: "POST", Endpoint: "/message?message=later&delay=1h&collapse_key=health", ShouldStatus: 400},
+		{Name: "Collapse key in extras", Method: "POST", Endpoint: "/message", Data: `{"message": "later", "delay": "1h", "extras": {"pushbits::collapse_key": "health"}}`, Headers: map[string]string{"Content-Type": "application/json"}, ShouldStatus: 400},
+	}
+
+	scheduledIDs := make([]uint, 0)
+	for _, req := range testCases {
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("app", &application)
+		handler.CreateNotification(c)
+		assert.Equalf(req.ShouldStatus, w.Code, "Request %s", req.Name)
+
+		if w.Code == 202 {
+			var notification model.Notification
+			require.NoError(json.Unmarshal(w.Body.Bytes(), &notification))
+			assert.NotZerof(notification.ScheduledID, "Request %s should return a scheduled ID", req.Name)
+			scheduledIDs = append(scheduledIDs, notification.ScheduledID)
+		}
+	}
+
+	pending, err := ctx.Database.GetScheduledNotifications(&application, model.ScheduleStatusPending)
+	require.NoError(err)
+	assert.Len(pending, 2)
+
+	req := tests.Request{Name: "Cancel", Method: "DELETE", Endpoint: fmt.Sprintf("/schedule/%d", scheduledIDs[0])}
+	w, c, err := req.GetRequest()
+	require.NoError(err)
+
+	c.Set("app", &application)
+	c.Set("id", scheduledIDs[0])
+	handler.CancelScheduledNotification(c)
+	assert.Equal(200, w.Code)
+
+	pending, err = ctx.Database.GetScheduledNotifications(&application, model.ScheduleStatusPending)
+	require.NoError(err)
+	assert.Len(pending, 1)
+	assert.Equal(scheduledIDs[1], pending[0].ID)
+}
+
+type redactionDispatcher struct {
+	mockups.MockDispatcher
+	deleted *model.DeleteNotification
+}
+
+func (d *redactionDispatcher) DeleteNotification(_ *model.Application, n *model.DeleteNotification) error {
+	d.deleted = n
+	return nil
+}
+
+func TestApi_DeleteNotificationRedact(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dp := &redactionDispatcher{}
+	handler := NotificationHandler{DB: ctx.Database, DP: dp}
+
+	testCases := []struct {
+		req            tests.Request
+		redactOnDelete bool
+		redact         bool
+		reason         string
+	}{
+		{tests.Request{Name: "Default", Method: "DELETE", Endpoint: "/message/$event", ShouldStatus: 200}, false, false, ""},
+		{tests.Request{Name: "Requested", Method: "DELETE", Endpoint: "/message/$event?redact=true&reason=leaked", ShouldStatus: 200}, false, true, "leaked"},
+		{tests.Request{Name: "Application setting", Method: "DELETE", Endpoint: "/message/$event", ShouldStatus: 200}, true, true, ""},
+		{tests.Request{Name: "Overridden", Method: "DELETE", Endpoint: "/message/$event?redact=false", ShouldStatus: 200}, true, false, ""},
+		{tests.Request{Name: "Invalid", Method: "DELETE", Endpoint: "/message/$event?redact=maybe", ShouldStatus: 400}, false, false, ""},
+	}
+
+	for _, testCase := range testCases {
+		dp.deleted = nil
+		application := model.Application{ID: 1, UserID: 1, Name: "Test Application", MatrixID: "!room:test.de", RedactOnDelete: testCase.redactOnDelete}
+
+		w, c, err := testCase.req.GetRequest()
+		require.NoError(err)
+
+		c.Set("app", &application)
+		c.Set("messageid", "$event")
+		handler.DeleteNotification(c)
+
+		assert.Equalf(testCase.req.ShouldStatus, w.Code, "Request %s", testCase.req.Name)
+		if w.Code != 200 {
+			continue
+		}
+
+		require.NotNil(dp.deleted)
+		assert.Equalf(testCase.redact, dp.deleted.Redact, "Request %s", testCase.req.Name)
+		assert.Equalf(testCase.reason, dp.deleted.Reason, "Request %s", testCase.req.Name)
+	}
+}
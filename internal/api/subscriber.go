@@ -0,0 +1,176 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pushbits/server/internal/authentication"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resolves the Matrix ID of a new subscriber and checks that it does not receive the notifications of the application already
+func (h *ApplicationHandler) newSubscriber(a *model.Application, owner *model.User, createSubscriber *model.CreateSubscriber) (*model.Subscriber, error) {
+	subscriber := model.Subscriber{ApplicationID: a.ID}
+
+	if createSubscriber.UserID != nil {
+		user, err := h.DB.GetUserByID(*createSubscriber.UserID)
+		if err != nil || user == nil {
+			return nil, pberrors.ErrInvalidSubscriber
+		}
+
+		subscriber.UserID = &user.ID
+		subscriber.MatrixID = user.MatrixID
+	} else {
+		subscriber.MatrixID = strings.TrimSpace(createSubscriber.MatrixID)
+	}
+
+	if !strings.HasPrefix(subscriber.MatrixID, "@") || !strings.Contains(subscriber.MatrixID, ":") {
+		return nil, pberrors.ErrInvalidSubscriber
+	}
+
+	subscribers, err := h.DB.GetSubscribers(a.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recipient := range model.Recipients(owner, subscribers) {
+		if recipient == subscriber.MatrixID {
+			return nil, pberrors.ErrSubscriberExists
+		}
+	}
+
+	return &subscriber, nil
+}
+
+// GetSubscribers godoc
+// @Summary Get Subscribers
+// @Description Get the additional recipients of the notifications of an application
+// @ID get-application-id-subscribers
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Success 200 {array} model.Subscriber
+// @Failure 500,404,403 ""
+// @Security BasicAuth
+// @Router /application/{id}/subscribers [get]
+func (h *ApplicationHandler) GetSubscribers(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	subscribers, err := h.DB.GetSubscribers(application.ID)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, &subscribers)
+}
+
+// AddSubscriber godoc
+// @Summary Add Subscriber
+// @Description Invite a Matrix ID or another user to the channel of an application, so they receive its notifications as well
+// @ID post-application-id-subscribers
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Param matrix_id query string false "Matrix ID of the subscriber in the format @user:domain.tld"
+// @Param user_id query int false "ID of a user to subscribe with their Matrix ID instead"
+// @Success 200 {object} model.Subscriber
+// @Failure 500,404,403,400 ""
+// @Security BasicAuth
+// @Router /application/{id}/subscribers [post]
+func (h *ApplicationHandler) AddSubscriber(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	var createSubscriber model.CreateSubscriber
+	if err := ctx.Bind(&createSubscriber); err != nil {
+		return
+	}
+
+	subscriber, err := h.newSubscriber(application, authentication.GetUser(ctx), &createSubscriber)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	log.L.Printf("Adding subscriber %s to application %s.", subscriber.MatrixID, application.Name)
+
+	err = h.DP.InviteSubscriber(application, subscriber.MatrixID)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	err = h.DB.CreateSubscriber(subscriber)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, subscriber)
+}
+
+// RemoveSubscriber godoc
+// @Summary Remove Subscriber
+// @Description Remove a subscriber from the channel of an application
+// @ID delete-application-id-subscribers-subscriberid
+// @Tags Application
+// @Accept json,mpfd
+// @Produce json
+// @Param id path int true "ID of the application"
+// @Param subscriberid path int true "ID of the subscriber"
+// @Success 200 ""
+// @Failure 500,404,403 ""
+// @Security BasicAuth
+// @Router /application/{id}/subscribers/{subscriberid} [delete]
+func (h *ApplicationHandler) RemoveSubscriber(ctx *gin.Context) {
+	application, err := getApplication(ctx, h.DB)
+	if err != nil || application == nil {
+		return
+	}
+
+	if !isCurrentUser(ctx, application.UserID) {
+		return
+	}
+
+	id, err := getSubscriberID(ctx)
+	if err != nil {
+		return
+	}
+
+	subscriber, err := h.DB.GetSubscriber(id)
+	if err != nil || subscriber == nil || subscriber.ApplicationID != application.ID {
+		ctx.AbortWithError(http.StatusNotFound, errors.New("subscriber not found"))
+		return
+	}
+
+	log.L.Printf("Removing subscriber %s from application %s.", subscriber.MatrixID, application.Name)
+
+	// The subscriber might have left the channel already.
+	if err := h.DP.RemoveSubscriber(application, subscriber.MatrixID); err != nil {
+		log.L.Printf("Cannot remove subscriber %s from the channel: %s", subscriber.MatrixID, err)
+	}
+
+	err = h.DB.DeleteSubscriber(subscriber)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
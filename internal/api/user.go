@@ -58,7 +58,28 @@ func (h *UserHandler) deleteApplications(ctx *gin.Context, u *model.User) error
 	return nil
 }
 
-func (h *UserHandler) updateChannels(ctx *gin.Context, u *model.User, matrixID string) error {
+// Removes a user from the channels of the applications they subscribed to
+func (h *UserHandler) removeSubscriptions(u *model.User) {
+	subscriptions, err := h.DB.GetSubscriptions(u.ID)
+	if err != nil {
+		log.L.Printf("Cannot fetch subscriptions of user %s: %s", u.Name, err)
+		return
+	}
+
+	for _, s := range subscriptions {
+		application, err := h.DB.GetApplicationByID(s.ApplicationID)
+		if err != nil || application == nil {
+			continue
+		}
+
+		if err := h.DP.RemoveSubscriber(application, s.MatrixID); err != nil {
+			log.L.Printf("Cannot remove user %s from the channel of application %s: %s", u.Name, application.Name, err)
+		}
+	}
+}
+
+// Re-creates the channels of all applications of a user, inviting the new Matrix ID and moving the applications that use the identity of the user to the new one
+func (h *UserHandler) updateChannels(ctx *gin.Context, u *model.User, matrixID, identity string) error {
 	if ctx == nil || u == nil {
 		return errors.New("nil parameters provided")
 	}
@@ -82,6 +103,10 @@ func (h *UserHandler) updateChannels(ctx *gin.Context, u *model.User, matrixID s
 	for _, application := range applications {
 		application := application // See https://stackoverflow.com/a/68247837
 
+		if application.MatrixIdentity == u.MatrixIdentity {
+			application.MatrixIdentity = identity
+		}
+
 		err := h.AH.registerApplication(ctx, &application, u)
 		if err != nil {
 			return err
@@ -108,16 +133,65 @@ func (h *UserHandler) updateUserFields(ctx *gin.Context, u *model.User, updateUs
 	if updateUser.IsAdmin != nil {
 		u.IsAdmin = *updateUser.IsAdmin
 	}
+	if updateUser.Timezone != nil {
+		u.Timezone = *updateUser.Timezone
+	}
+	if updateUser.QuietHours != nil {
+		u.QuietHours = *updateUser.QuietHours
+	}
+	if updateUser.QuietMode != nil {
+		u.QuietMode = *updateUser.QuietMode
+	}
+	if updateUser.MatrixIdentity != nil {
+		u.MatrixIdentity = *updateUser.MatrixIdentity
+	}
 	return nil
 }
 
+// Checks the quiet hours a user would have after the update, before anything is changed
+func validateQuietHours(ctx *gin.Context, u *model.User, updateUser model.UpdateUser) error {
+	updated := model.User{Timezone: u.Timezone, QuietHours: u.QuietHours, QuietMode: u.QuietMode}
+	if updateUser.Timezone != nil {
+		updated.Timezone = *updateUser.Timezone
+	}
+	if updateUser.QuietHours != nil {
+		updated.QuietHours = *updateUser.QuietHours
+	}
+	if updateUser.QuietMode != nil {
+		updated.QuietMode = *updateUser.QuietMode
+	}
+
+	err := updated.ValidateQuietHours()
+	SuccessOrAbort(ctx, http.StatusBadRequest, err)
+
+	return err
+}
+
 func (h *UserHandler) updateUser(ctx *gin.Context, u *model.User, updateUser model.UpdateUser) error {
 	if u == nil {
 		return errors.New("nil parameters provided")
 	}
 
-	if updateUser.MatrixID != nil && u.MatrixID != *updateUser.MatrixID {
-		if err := h.updateChannels(ctx, u, *updateUser.MatrixID); err != nil {
+	if err := validateQuietHours(ctx, u, updateUser); err != nil {
+		return err
+	}
+
+	matrixID := u.MatrixID
+	if updateUser.MatrixID != nil {
+		matrixID = *updateUser.MatrixID
+	}
+
+	identity := u.MatrixIdentity
+	if updateUser.MatrixIdentity != nil {
+		identity = *updateUser.MatrixIdentity
+	}
+
+	if err := h.AH.validateMatrixIdentity(ctx, identity); err != nil {
+		return err
+	}
+
+	if matrixID != u.MatrixID || identity != u.MatrixIdentity {
+		if err := h.updateChannels(ctx, u, matrixID, identity); err != nil {
 			return err
 		}
 	}
@@ -147,6 +221,10 @@ func (h *UserHandler) updateUser(ctx *gin.Context, u *model.User, updateUser mod
 // @Param name query string true "Name of the user"
 // @Param is_admin query bool false "Whether to set the user as admin or not"
 // @Param matrix_id query string true "Matrix ID of the user in the format @user:domain.tld"
+// @Param timezone query string false "IANA timezone of the user, like Europe/Berlin"
+// @Param quiet_hours query string false "Quiet hours of the user, like mon-fri 22:00-07:00; sat-sun"
+// @Param quiet_mode query string false "Whether notifications during quiet hours are held for a digest or sent as notices (digest, notice)"
+// @Param matrix_identity query string false "Matrix identity that sends the notifications of the user, empty for the default account"
 // @Param password query string true "The users password"
 // @Success 200 {object} model.ExternalUser
 // @Failure 500,404,403 ""
@@ -164,6 +242,14 @@ func (h *UserHandler) CreateUser(ctx *gin.Context) {
 		return
 	}
 
+	if err := validateQuietHours(ctx, &model.User{}, model.UpdateUser{Timezone: &createUser.Timezone, QuietHours: &createUser.QuietHours, QuietMode: &createUser.QuietMode}); err != nil {
+		return
+	}
+
+	if err := h.AH.validateMatrixIdentity(ctx, createUser.MatrixIdentity); err != nil {
+		return
+	}
+
 	log.L.Printf("Creating user %s.", createUser.Name)
 
 	user, err := h.DB.CreateUser(createUser)
@@ -262,6 +348,8 @@ func (h *UserHandler) DeleteUser(ctx *gin.Context) {
 		return
 	}
 
+	h.removeSubscriptions(user)
+
 	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, h.DB.DeleteUser(user)); !success {
 		return
 	}
@@ -282,6 +370,10 @@ func (h *UserHandler) DeleteUser(ctx *gin.Context) {
 // @Param name query string true "Name of the user"
 // @Param is_admin query bool false "Whether to set the user as admin or not"
 // @Param matrix_id query string true "Matrix ID of the user in the format @user:domain.tld"
+// @Param timezone query string false "IANA timezone of the user, like Europe/Berlin"
+// @Param quiet_hours query string false "Quiet hours of the user, like mon-fri 22:00-07:00; sat-sun"
+// @Param quiet_mode query string false "Whether notifications during quiet hours are held for a digest or sent as notices (digest, notice)"
+// @Param matrix_identity query string false "Matrix identity that sends the notifications of the user, empty for the default account"
 // @Param password query string true "The users password"
 // @Success 200 ""
 // @Failure 500,404,400 ""
@@ -238,3 +238,40 @@ func getAdmin(ctx *TestContext) *model.User {
 	}
 	return nil
 }
+
+func TestApi_UpdateUserQuietHours(t *testing.T) {
+	ctx := GetTestContext(t)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	admin, err := ctx.Database.CreateUser(model.CreateUser{
+		ExternalUser:    model.ExternalUser{Name: "quiet-admin", IsAdmin: true, MatrixID: "@quiet:example.com"},
+		UserCredentials: model.UserCredentials{Password: "pushbits"},
+	})
+	require.NoError(err)
+
+	testCases := []tests.Request{
+		{Name: "Valid quiet hours", Method: "PUT", Endpoint: "/user/1?timezone=Europe/Berlin&quiet_hours=mon-fri%2022:00-07:00%3B%20sat-sun&quiet_mode=digest", ShouldStatus: 200},
+		{Name: "Invalid timezone", Method: "PUT", Endpoint: "/user/1?timezone=Europe/Atlantis", ShouldStatus: 400},
+		{Name: "Invalid schedule", Method: "PUT", Endpoint: "/user/1?quiet_hours=weekdays", ShouldStatus: 400},
+		{Name: "Invalid mode", Method: "PUT", Endpoint: "/user/1?quiet_mode=silent", ShouldStatus: 400},
+	}
+
+	for _, req := range testCases {
+		w, c, err := req.GetRequest()
+		require.NoError(err)
+
+		c.Set("id", admin.ID)
+		c.Set("user", admin)
+		ctx.UserHandler.UpdateUser(c)
+
+		assert.Equalf(req.ShouldStatus, w.Code, "Request %s", req.Name)
+	}
+
+	user, err := ctx.Database.GetUserByID(admin.ID)
+	require.NoError(err)
+	assert.Equal("Europe/Berlin", user.Timezone)
+	assert.Equal("mon-fri 22:00-07:00; sat-sun", user.QuietHours)
+	assert.Equal(model.QuietModeDigest, user.QuietMode)
+}
@@ -2,21 +2,41 @@ package api
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/pushbits/server/internal/authentication"
+	"github.com/pushbits/server/internal/model"
 	"github.com/pushbits/server/internal/pberrors"
 
+	"github.com/gin-contrib/location"
 	"github.com/gin-gonic/gin"
 )
 
 // SuccessOrAbort is a convenience function to write a HTTP status code based on a given error.
 func SuccessOrAbort(ctx *gin.Context, code int, err error) bool {
+	var retryAfter *pberrors.RetryAfterError
+	if errors.As(err, &retryAfter) {
+		// Rate limits are passed on, so that the client knows when to try again.
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.RetryAfter.Seconds()))))
+		ctx.AbortWithError(http.StatusTooManyRequests, err)
+		return false
+	}
+
 	if err != nil {
 		// If we know the error force error code
 		switch err {
 		case pberrors.ErrMessageNotFound:
 			ctx.AbortWithError(http.StatusNotFound, err)
+		case pberrors.ErrUnknownBackend, pberrors.ErrInvalidTarget, pberrors.ErrInvalidCallbackURL, pberrors.ErrUnknownMatrixIdentity,
+			pberrors.ErrInvalidSubscriber, pberrors.ErrSubscriberExists, pberrors.ErrSubscribersNotSupported,
+			pberrors.ErrInvalidRoom, pberrors.ErrRoomNotFound, pberrors.ErrRoomInUse, pberrors.ErrInvalidImage, pberrors.ErrImagesNotSupported,
+			pberrors.ErrInvalidTemplate:
+			ctx.AbortWithError(http.StatusBadRequest, err)
+		case pberrors.ErrRoomForbidden:
+			ctx.AbortWithError(http.StatusForbidden, err)
 		default:
 			ctx.AbortWithError(code, err)
 		}
@@ -38,3 +58,40 @@ func isCurrentUser(ctx *gin.Context, id uint) bool {
 
 	return true
 }
+
+// Returns the page of the message history of the given applications that was requested via limit and since
+func getPagedMessages(ctx *gin.Context, db MessageDatabase, applicationIDs []uint) (*model.PagedMessages, error) {
+	var query model.MessagePagingQuery
+	if err := ctx.BindQuery(&query); err != nil {
+		return nil, err
+	}
+
+	// Request one more message than needed to find out if there is a next page.
+	messages, err := db.GetStoredNotifications(applicationIDs, query.Since, query.Limit+1)
+	if success := SuccessOrAbort(ctx, http.StatusInternalServerError, err); !success {
+		return nil, err
+	}
+
+	paged := &model.PagedMessages{
+		Paging: model.Paging{
+			Since: query.Since,
+			Limit: query.Limit,
+		},
+		Messages: messages,
+	}
+
+	if len(messages) > query.Limit {
+		paged.Messages = messages[:query.Limit]
+
+		next := ctx.Request.URL.Path
+		if base := location.Get(ctx); base != nil {
+			next = base.String() + next
+		}
+
+		paged.Paging.Next = fmt.Sprintf("%s?limit=%d&since=%d", next, query.Limit, paged.Messages[query.Limit-1].ID)
+	}
+
+	paged.Paging.Size = len(paged.Messages)
+
+	return paged, nil
+}
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/pushbits/server/internal/pberrors"
 	"github.com/pushbits/server/tests"
 )
 
@@ -37,6 +39,15 @@ func TestApi_SuccessOrAbort(t *testing.T) {
 
 		assert.Equalf(forcedErr == nil, aborted, "(Test case %s) Expected %v but have %v", testCase.Name, forcedErr == nil, aborted)
 	}
+
+	// Rate limits are answered with the time to wait, whatever status was asked for.
+	testCase := tests.Request{Name: "Rate Limited - 429", Endpoint: "/"}
+	w, c, err := testCase.GetRequest()
+	require.NoError(err)
+
+	assert.False(SuccessOrAbort(c, 500, fmt.Errorf("cannot send: %w", &pberrors.RetryAfterError{RetryAfter: 1500 * time.Millisecond, Err: pberrors.ErrRateLimited})))
+	assert.Equal(429, w.Code)
+	assert.Equal("2", w.Header().Get("Retry-After"))
 }
 
 func TestApi_IsCurrentUser(t *testing.T) {
@@ -0,0 +1,103 @@
+package appservice
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+)
+
+var settings = configuration.AppService{Enabled: true, ID: "pushbits", URL: "http://localhost:8080", ASToken: "as", HSToken: "hs", UserPrefix: "pushbits_"}
+
+type memoryDatabase struct{}
+
+func (*memoryDatabase) GetApplicationByID(id uint) (*model.Application, error) {
+	if id != 3 {
+		return nil, errors.New("not found")
+	}
+
+	return &model.Application{ID: 3, Name: "backup"}, nil
+}
+
+type recordingDispatcher struct {
+	joined []string
+}
+
+func (d *recordingDispatcher) JoinAsPuppet(a *model.Application, roomID string) error {
+	d.joined = append(d.joined, a.Name+" "+roomID)
+	return nil
+}
+
+func TestAppService_Registration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	_, err := CreateRegistration(configuration.Matrix{Username: "bot", AppService: configuration.AppService{}})
+	assert.Error(err, "Registration without URL should fail")
+
+	registration, err := CreateRegistration(configuration.Matrix{Username: "@bot:example.com", AppService: settings})
+	require.NoError(err)
+
+	path := filepath.Join(t.TempDir(), "registration.yaml")
+	require.NoError(registration.Save(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(err)
+
+	var saved map[string]interface{}
+	require.NoError(yaml.Unmarshal(data, &saved))
+	assert.Equal("bot", saved["sender_localpart"])
+	assert.Equal("hs", saved["hs_token"])
+	assert.Contains(string(data), `regex: '@pushbits_[0-9]+:.*'`)
+}
+
+func TestAppService_Listener(t *testing.T) {
+	assert := assert.New(t)
+
+	gin.SetMode(gin.TestMode)
+
+	dp := &recordingDispatcher{}
+	l := Create(&memoryDatabase{}, dp, settings)
+
+	r := gin.New()
+	group := r.Group("/_matrix/app/v1", l.RequireHomeserverToken())
+	group.PUT("/transactions/:txnid", l.PutTransaction)
+	group.GET("/users/:userid", l.GetUser)
+
+	request := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	assert.Equal(http.StatusUnauthorized, request("GET", "/_matrix/app/v1/users/@pushbits_3:example.com", "", ""))
+	assert.Equal(http.StatusForbidden, request("GET", "/_matrix/app/v1/users/@pushbits_3:example.com", "as", ""))
+	assert.Equal(http.StatusOK, request("GET", "/_matrix/app/v1/users/@pushbits_3:example.com", "hs", ""))
+	assert.Equal(http.StatusOK, request("GET", "/_matrix/app/v1/users/@pushbits_3:example.com?access_token=hs", "", ""))
+	assert.Equal(http.StatusNotFound, request("GET", "/_matrix/app/v1/users/@pushbits_4:example.com", "hs", ""))
+
+	transaction := `{"events": [
+		{"type": "m.room.member", "room_id": "!ops:example.com", "state_key": "@pushbits_3:example.com", "content": {"membership": "invite"}},
+		{"type": "m.room.member", "room_id": "!ops:example.com", "state_key": "@user:example.com", "content": {"membership": "invite"}},
+		{"type": "m.room.message", "room_id": "!ops:example.com", "content": {"body": "hello"}}
+	]}`
+	assert.Equal(http.StatusOK, request("PUT", "/_matrix/app/v1/transactions/1", "hs", transaction))
+	assert.Equal([]string{"backup !ops:example.com"}, dp.joined, "Only the virtual users of applications should accept invites")
+}
@@ -0,0 +1,127 @@
+package appservice
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+}
+
+// The Dispatcher interface for acting as the virtual users of applications.
+type Dispatcher interface {
+	JoinAsPuppet(a *model.Application, roomID string) error
+}
+
+// Listener holds information for processing the requests of the homeserver to the application service.
+type Listener struct {
+	db       Database
+	dp       Dispatcher
+	settings configuration.AppService
+}
+
+// Create instanciates the listener for the transaction API.
+func Create(db Database, dp Dispatcher, settings configuration.AppService) *Listener {
+	return &Listener{
+		db:       db,
+		dp:       dp,
+		settings: settings,
+	}
+}
+
+// The events of a transaction, only with the fields that are needed for accepting invites
+type transaction struct {
+	Events []struct {
+		Type     string  `json:"type"`
+		RoomID   string  `json:"room_id"`
+		StateKey *string `json:"state_key"`
+		Content  struct {
+			Membership string `json:"membership"`
+		} `json:"content"`
+	} `json:"events"`
+}
+
+func abortWithMatrixError(ctx *gin.Context, code int, errcode, message string) {
+	ctx.AbortWithStatusJSON(code, gin.H{"errcode": errcode, "error": message})
+}
+
+// RequireHomeserverToken checks that requests carry the HS token, either as bearer token or as query parameter.
+func (l *Listener) RequireHomeserverToken() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			token = ctx.Query("access_token")
+		}
+
+		if token == "" {
+			abortWithMatrixError(ctx, http.StatusUnauthorized, "M_UNAUTHORIZED", "missing token")
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(l.settings.HSToken)) != 1 {
+			abortWithMatrixError(ctx, http.StatusForbidden, "M_FORBIDDEN", "invalid token")
+			return
+		}
+	}
+}
+
+// Returns the application whose virtual user has the given Matrix ID
+func (l *Listener) puppetApplication(userID string) *model.Application {
+	id, ok := l.settings.PuppetApplicationID(userID)
+	if !ok {
+		return nil
+	}
+
+	application, err := l.db.GetApplicationByID(id)
+	if err != nil {
+		return nil
+	}
+
+	return application
+}
+
+// PutTransaction processes the events the homeserver pushes to the application service.
+// Virtual users accept invites to rooms, all other events are received by syncing.
+func (l *Listener) PutTransaction(ctx *gin.Context) {
+	var txn transaction
+	if err := ctx.ShouldBindJSON(&txn); err != nil {
+		abortWithMatrixError(ctx, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+
+	for _, evt := range txn.Events {
+		if evt.Type != "m.room.member" || evt.StateKey == nil || evt.Content.Membership != "invite" {
+			continue
+		}
+
+		application := l.puppetApplication(*evt.StateKey)
+		if application == nil {
+			continue
+		}
+
+		if err := l.dp.JoinAsPuppet(application, evt.RoomID); err != nil {
+			log.L.Printf("Cannot accept the invite of %s to room %s: %s", *evt.StateKey, evt.RoomID, err)
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
+
+// GetUser tells the homeserver whether a Matrix ID in the namespace of the application service belongs to an application.
+func (l *Listener) GetUser(ctx *gin.Context) {
+	if l.puppetApplication(ctx.Param("userid")) == nil {
+		abortWithMatrixError(ctx, http.StatusNotFound, "M_NOT_FOUND", "no application with this virtual user")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{})
+}
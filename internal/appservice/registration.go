@@ -0,0 +1,73 @@
+// Package appservice provides the registration and the transaction API of PushBits as a Matrix application service.
+package appservice
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/pushbits/server/internal/configuration"
+)
+
+// Registration is the registration file of the application service, which is added to the configuration of the homeserver.
+// See https://spec.matrix.org/latest/application-service-api/#registration
+type Registration struct {
+	ID              string     `yaml:"id"`
+	URL             string     `yaml:"url"`
+	ASToken         string     `yaml:"as_token"`
+	HSToken         string     `yaml:"hs_token"`
+	SenderLocalpart string     `yaml:"sender_localpart"`
+	RateLimited     bool       `yaml:"rate_limited"`
+	Namespaces      Namespaces `yaml:"namespaces"`
+}
+
+// Namespaces holds the Matrix IDs, room aliases, and rooms the application service is interested in.
+type Namespaces struct {
+	Users   []Namespace `yaml:"users"`
+	Aliases []Namespace `yaml:"aliases"`
+	Rooms   []Namespace `yaml:"rooms"`
+}
+
+// Namespace is a regular expression for Matrix IDs, room aliases, or rooms.
+type Namespace struct {
+	Exclusive bool   `yaml:"exclusive"`
+	Regex     string `yaml:"regex"`
+}
+
+// CreateRegistration creates the registration for the application service settings, with the Matrix account of PushBits as sender.
+// The virtual users of applications are claimed exclusively.
+func CreateRegistration(settings configuration.Matrix) (*Registration, error) {
+	as := settings.AppService
+	if as.URL == "" {
+		return nil, errors.New("the URL of the application service is required for the registration")
+	}
+
+	localpart, _, _ := strings.Cut(strings.TrimPrefix(settings.Username, "@"), ":")
+
+	return &Registration{
+		ID:              as.ID,
+		URL:             as.URL,
+		ASToken:         as.ASToken,
+		HSToken:         as.HSToken,
+		SenderLocalpart: localpart,
+		RateLimited:     false,
+		Namespaces: Namespaces{
+			Users:   []Namespace{{Exclusive: true, Regex: "@" + regexp.QuoteMeta(as.UserPrefix) + "[0-9]+:.*"}},
+			Aliases: []Namespace{},
+			Rooms:   []Namespace{},
+		},
+	}, nil
+}
+
+// Save writes the registration to a file, which only the owner can read as it contains the tokens.
+func (r *Registration) Save(path string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o600)
+}
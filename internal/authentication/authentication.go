@@ -18,6 +18,8 @@ const (
 // The Database interface for encapsulating database access.
 type Database interface {
 	GetApplicationByToken(token string) (*model.Application, error)
+	GetClientByToken(token string) (*model.Client, error)
+	GetUserByID(ID uint) (*model.User, error)
 	GetUserByName(name string) (*model.User, error)
 }
 
@@ -105,3 +107,26 @@ func (a *Authenticator) RequireApplicationToken() gin.HandlerFunc {
 		ctx.Set("app", app)
 	}
 }
+
+// RequireClientToken returns a Gin middleware which requires a client token to be supplied with the request.
+// The client and the user it belongs to are registered, the latter like with user credentials.
+func (a *Authenticator) RequireClientToken() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := a.tokenFromQueryOrHeader(ctx)
+
+		client, err := a.DB.GetClientByToken(token)
+		if err != nil {
+			ctx.AbortWithError(http.StatusForbidden, err)
+			return
+		}
+
+		user, err := a.DB.GetUserByID(client.UserID)
+		if err != nil || user == nil {
+			ctx.AbortWithError(http.StatusForbidden, errors.New("user of the client does not exist"))
+			return
+		}
+
+		ctx.Set("client", client)
+		ctx.Set("user", user)
+	}
+}
@@ -20,6 +20,17 @@ func GetApplication(ctx *gin.Context) *model.Application {
 	return app
 }
 
+// GetClient returns the client which was previously registered by the authentication middleware.
+func GetClient(ctx *gin.Context) *model.Client {
+	client, ok := ctx.MustGet("client").(*model.Client)
+	if client == nil || !ok {
+		ctx.AbortWithError(http.StatusInternalServerError, errors.New("an error occurred while retrieving client from context"))
+		return nil
+	}
+
+	return client
+}
+
 // GetUser returns the user which was previously registered by the authentication middleware.
 func GetUser(ctx *gin.Context) *model.User {
 	user, ok := ctx.MustGet("user").(*model.User)
@@ -10,6 +10,8 @@ var (
 	regularTokenLength     = 64 // This length includes the prefix (one character).
 	compatTokenLength      = 15 // This length includes the prefix (one character).
 	applicationTokenPrefix = "A"
+	clientTokenPrefix      = "C"
+	callbackSecretLength   = 48
 )
 
 func randIntn(n int) int {
@@ -57,3 +59,13 @@ func GenerateApplicationToken(compat bool) string {
 
 	return applicationTokenPrefix + generateRandomString(tokenLength)
 }
+
+// GenerateClientToken generates a token for a client.
+func GenerateClientToken() string {
+	return clientTokenPrefix + generateRandomString(regularTokenLength-len(clientTokenPrefix))
+}
+
+// GenerateCallbackSecret generates a secret for signing the callbacks of an application.
+func GenerateCallbackSecret() string {
+	return generateRandomString(callbackSecretLength)
+}
@@ -47,3 +47,22 @@ func TestAuthentication_GenerateApplicationToken(t *testing.T) {
 		isGoodToken(assert, require, token, true)
 	}
 }
+
+func TestAuthentication_GenerateCallbackSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	secret := GenerateCallbackSecret()
+	assert.Len(secret, callbackSecretLength, "Unexpected callback secret length")
+	assert.NotEqual(secret, GenerateCallbackSecret(), "Callback secrets should differ")
+}
+
+func TestAuthentication_GenerateClientToken(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 64; i++ {
+		token := GenerateClientToken()
+
+		assert.Len(token, regularTokenLength, "Unexpected client token length")
+		assert.Equal(clientTokenPrefix, token[0:len(clientTokenPrefix)], "Invalid token prefix")
+	}
+}
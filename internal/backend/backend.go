@@ -0,0 +1,319 @@
+// Package backend provides the transports notifications can be delivered with and a registry to select them per application.
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Backend interface for delivering notifications with a specific transport.
+type Backend interface {
+	RegisterApplication(a *model.Application, u *model.User) (string, error)
+	DeregisterApplication(a *model.Application, u *model.User) error
+	UpdateApplication(a *model.Application, behavior *configuration.RepairBehavior) error
+	IsOrphan(a *model.Application, u *model.User) (bool, error)
+	RepairApplication(a *model.Application, u *model.User) error
+	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+	UpdateNotification(a *model.Application, n *model.Notification, channelID string) error
+	DeleteNotification(a *model.Application, n *model.DeleteNotification) error
+	Close()
+}
+
+// The Policy interface for holding back or adapting notifications before they are sent.
+type Policy interface {
+	// Apply returns true if the notification is held back and must not be sent now.
+	Apply(a *model.Application, n *model.Notification, now time.Time) (bool, error)
+	// Holds checks whether Apply would hold the notification back, without holding it.
+	Holds(a *model.Application, n *model.Notification, now time.Time) bool
+}
+
+// The MarkingPolicy interface for policies that adapt notifications which cannot be held back, like edits of sent notifications.
+type MarkingPolicy interface {
+	Mark(a *model.Application, n *model.Notification, now time.Time)
+}
+
+// The Limiter interface for limiting how many messages the accounts of backends send.
+type Limiter interface {
+	// AllowAccount returns false and the time to wait if the account of the application must not send another message now.
+	AllowAccount(a *model.Application) (bool, time.Duration)
+}
+
+// The SubscriberBackend interface for backends that can deliver the notifications of an application to subscribers.
+type SubscriberBackend interface {
+	InviteSubscriber(a *model.Application, matrixID string) error
+	RemoveSubscriber(a *model.Application, matrixID string) error
+}
+
+// The AvatarBackend interface for backends that can show the image of an application.
+type AvatarBackend interface {
+	UploadAvatar(a *model.Application, data []byte, contentType string) (string, error)
+}
+
+// Registry holds the enabled backends and relays calls to the backend an application is bound to.
+type Registry struct {
+	backends map[string]Backend
+	policies []Policy
+	limiter  Limiter
+}
+
+// CreateRegistry instanciates an empty backend registry.
+func CreateRegistry() *Registry {
+	return &Registry{
+		backends: make(map[string]Backend),
+	}
+}
+
+// Register enables a backend under the given name.
+func (r *Registry) Register(name string, b Backend) {
+	log.L.Printf("Enabling backend %s.", name)
+
+	r.backends[name] = b
+}
+
+// Get returns the backend with the given name.
+func (r *Registry) Get(name string) (Backend, error) {
+	if name == "" {
+		name = model.BackendMatrix
+	}
+
+	b, ok := r.backends[name]
+	if !ok {
+		return nil, pberrors.ErrUnknownBackend
+	}
+
+	return b, nil
+}
+
+// AddPolicy adds a policy that is applied to notifications before they are sent, after the policies added before.
+func (r *Registry) AddPolicy(p Policy) {
+	r.policies = append(r.policies, p)
+}
+
+// SetLimiter sets the rate limit that every message sent, replaced or deleted with a backend is checked against.
+func (r *Registry) SetLimiter(l Limiter) {
+	r.limiter = l
+}
+
+// Close closes all backends.
+func (r *Registry) Close() {
+	for _, b := range r.backends {
+		b.Close()
+	}
+}
+
+// RegisterApplication creates a channel for an application with its backend.
+func (r *Registry) RegisterApplication(a *model.Application, u *model.User) (string, error) {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return "", err
+	}
+
+	return b.RegisterApplication(a, u)
+}
+
+// DeregisterApplication deletes the channel of an application with its backend.
+func (r *Registry) DeregisterApplication(a *model.Application, u *model.User) error {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return err
+	}
+
+	return b.DeregisterApplication(a, u)
+}
+
+// UpdateApplication updates the channel of an application with its backend.
+func (r *Registry) UpdateApplication(a *model.Application, behavior *configuration.RepairBehavior) error {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return err
+	}
+
+	return b.UpdateApplication(a, behavior)
+}
+
+// IsOrphan checks with its backend if the user is still connected to the channel of an application.
+func (r *Registry) IsOrphan(a *model.Application, u *model.User) (bool, error) {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return false, err
+	}
+
+	return b.IsOrphan(a, u)
+}
+
+// RepairApplication reconnects the user to the channel of an application with its backend.
+func (r *Registry) RepairApplication(a *model.Application, u *model.User) error {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return err
+	}
+
+	return b.RepairApplication(a, u)
+}
+
+// InviteSubscriber adds a subscriber to the channel of an application, if its backend supports subscribers.
+func (r *Registry) InviteSubscriber(a *model.Application, matrixID string) error {
+	b, err := r.subscriberBackend(a)
+	if err != nil {
+		return err
+	}
+
+	return b.InviteSubscriber(a, matrixID)
+}
+
+// RemoveSubscriber removes a subscriber from the channel of an application, if its backend supports subscribers.
+func (r *Registry) RemoveSubscriber(a *model.Application, matrixID string) error {
+	b, err := r.subscriberBackend(a)
+	if err != nil {
+		return err
+	}
+
+	return b.RemoveSubscriber(a, matrixID)
+}
+
+// UploadAvatar stores the image of an application with its backend, if the backend supports images.
+func (r *Registry) UploadAvatar(a *model.Application, data []byte, contentType string) (string, error) {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return "", err
+	}
+
+	ab, ok := b.(AvatarBackend)
+	if !ok {
+		return "", pberrors.ErrImagesNotSupported
+	}
+
+	return ab.UploadAvatar(a, data, contentType)
+}
+
+func (r *Registry) subscriberBackend(a *model.Application) (SubscriberBackend, error) {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	sb, ok := b.(SubscriberBackend)
+	if !ok {
+		return nil, pberrors.ErrSubscribersNotSupported
+	}
+
+	return sb, nil
+}
+
+// SendNotification sends a notification with the backend of the application, unless the delivery state of the application suppresses it
+// or a policy holds it back.
+func (r *Registry) SendNotification(a *model.Application, n *model.Notification) (string, error) {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	if a.Suppresses(n, now) {
+		log.L.Printf("Suppressing notification for application %s as per its delivery settings.", a.Name)
+		return "", pberrors.ErrNotificationSuppressed
+	}
+
+	for _, policy := range r.policies {
+		held, err := policy.Apply(a, n, now)
+		if err != nil {
+			return "", err
+		}
+
+		if held {
+			return "", pberrors.ErrNotificationHeld
+		}
+	}
+
+	if err := r.allow(a); err != nil {
+		return "", err
+	}
+
+	return b.SendNotification(a, n)
+}
+
+// Admits checks whether a notification would be sent right away, that is neither suppressed by the delivery state
+// of its application nor held back by a policy.
+func (r *Registry) Admits(a *model.Application, n *model.Notification) bool {
+	now := time.Now()
+
+	if a.Suppresses(n, now) {
+		return false
+	}
+
+	for _, policy := range r.policies {
+		if policy.Holds(a, n, now) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// UpdateNotification replaces a notification with the backend of the application, after the policies that can adapt it marked it.
+func (r *Registry) UpdateNotification(a *model.Application, n *model.Notification, channelID string) error {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, policy := range r.policies {
+		if mp, ok := policy.(MarkingPolicy); ok {
+			mp.Mark(a, n, now)
+		}
+	}
+
+	if err := r.allow(a); err != nil {
+		return err
+	}
+
+	return b.UpdateNotification(a, n, channelID)
+}
+
+// DeleteNotification deletes a notification with the backend of the application.
+func (r *Registry) DeleteNotification(a *model.Application, n *model.DeleteNotification) error {
+	b, err := r.Get(a.Backend)
+	if err != nil {
+		return err
+	}
+
+	if err := r.allow(a); err != nil {
+		return err
+	}
+
+	return b.DeleteNotification(a, n)
+}
+
+// Returns an error that tells when to retry if the account of the application exceeded its rate limit
+func (r *Registry) allow(a *model.Application) error {
+	if r.limiter == nil {
+		return nil
+	}
+
+	allowed, retryAfter := r.limiter.AllowAccount(a)
+	if !allowed {
+		log.L.Printf("Delaying message of application %s as its account exceeded the rate limit.", a.Name)
+		return &pberrors.RetryAfterError{RetryAfter: retryAfter, Err: pberrors.ErrRateLimited}
+	}
+
+	return nil
+}
+
+// Generates an identifier for notifications of backends that do not assign one themselves
+func generateID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+func TestRegistry_UnknownBackend(t *testing.T) {
+	r := CreateRegistry()
+	r.Register(model.BackendLog, CreateLogSink())
+
+	a := &model.Application{ID: 1, Name: "test", Backend: model.BackendSMTP}
+
+	_, err := r.SendNotification(a, &model.Notification{Message: "hello"})
+	assert.Equal(t, pberrors.ErrUnknownBackend, err)
+}
+
+func TestRegistry_DefaultsToMatrix(t *testing.T) {
+	r := CreateRegistry()
+	r.Register(model.BackendMatrix, CreateLogSink())
+
+	_, err := r.Get("")
+	assert.NoError(t, err)
+}
+
+func TestRegistry_RelaysToBackend(t *testing.T) {
+	r := CreateRegistry()
+	r.Register(model.BackendLog, CreateLogSink())
+
+	a := &model.Application{ID: 7, Name: "test", Backend: model.BackendLog}
+
+	channelID, err := r.RegisterApplication(a, &model.User{Name: "user"})
+	require.NoError(t, err)
+	assert.Equal(t, "log-7", channelID)
+
+	id, err := r.SendNotification(a, &model.Notification{Message: "hello"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	assert.NoError(t, r.DeleteNotification(a, &model.DeleteNotification{ID: id}))
+}
+
+func TestRegistry_SuppressesMutedApplications(t *testing.T) {
+	r := CreateRegistry()
+	r.Register(model.BackendLog, CreateLogSink())
+
+	a := &model.Application{Name: "test", Backend: model.BackendLog, Muted: true}
+
+	_, err := r.SendNotification(a, &model.Notification{Message: "hello"})
+	assert.Equal(t, pberrors.ErrNotificationSuppressed, err)
+
+	a.Muted = false
+	a.MinPriority = 5
+
+	_, err = r.SendNotification(a, &model.Notification{Message: "hello", Priority: 2})
+	assert.Equal(t, pberrors.ErrNotificationSuppressed, err)
+
+	_, err = r.SendNotification(a, &model.Notification{Message: "hello", Priority: 5})
+	assert.NoError(t, err)
+}
+
+type emptyLimiter struct {
+	checked int
+}
+
+func (l *emptyLimiter) AllowAccount(_ *model.Application) (bool, time.Duration) {
+	l.checked++
+	return false, time.Second
+}
+
+func TestRegistry_LimitsAccounts(t *testing.T) {
+	r := CreateRegistry()
+	r.Register(model.BackendLog, CreateLogSink())
+
+	limiter := &emptyLimiter{}
+	r.SetLimiter(limiter)
+
+	a := &model.Application{Name: "test", Backend: model.BackendLog}
+
+	_, err := r.SendNotification(a, &model.Notification{Message: "hello"})
+	var retryAfter *pberrors.RetryAfterError
+	require.ErrorAs(t, err, &retryAfter)
+	assert.Equal(t, time.Second, retryAfter.RetryAfter)
+	assert.ErrorIs(t, err, pberrors.ErrRateLimited)
+
+	assert.ErrorIs(t, r.UpdateNotification(a, &model.Notification{ID: "1", Message: "hello"}, ""), pberrors.ErrRateLimited)
+	assert.ErrorIs(t, r.DeleteNotification(a, &model.DeleteNotification{ID: "1"}), pberrors.ErrRateLimited)
+
+	// Suppressed notifications are not sent, so they do not count.
+	a.Muted = true
+	_, err = r.SendNotification(a, &model.Notification{Message: "hello"})
+	assert.Equal(t, pberrors.ErrNotificationSuppressed, err)
+	assert.Equal(t, 3, limiter.checked)
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+// LogSink is a backend that writes notifications to the log instead of delivering them.
+type LogSink struct{}
+
+// CreateLogSink instanciates a backend writing to the log.
+func CreateLogSink() *LogSink {
+	return &LogSink{}
+}
+
+// RegisterApplication logs the registration of an application.
+func (*LogSink) RegisterApplication(a *model.Application, u *model.User) (string, error) {
+	log.L.Printf("[log sink] Registered application %s (ID %d) of user %s.", a.Name, a.ID, u.Name)
+
+	return fmt.Sprintf("log-%d", a.ID), nil
+}
+
+// DeregisterApplication logs the deregistration of an application.
+func (*LogSink) DeregisterApplication(a *model.Application, _ *model.User) error {
+	log.L.Printf("[log sink] Deregistered application %s (ID %d).", a.Name, a.ID)
+
+	return nil
+}
+
+// UpdateApplication does nothing, as there is no channel to update.
+func (*LogSink) UpdateApplication(_ *model.Application, _ *configuration.RepairBehavior) error {
+	return nil
+}
+
+// IsOrphan always returns false, as there is no channel the user could leave.
+func (*LogSink) IsOrphan(_ *model.Application, _ *model.User) (bool, error) {
+	return false, nil
+}
+
+// RepairApplication does nothing, as there is no channel to repair.
+func (*LogSink) RepairApplication(_ *model.Application, _ *model.User) error {
+	return nil
+}
+
+// SendNotification logs a notification.
+func (*LogSink) SendNotification(a *model.Application, n *model.Notification) (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+
+	log.L.Printf("[log sink] Notification %s for application %s (priority %d): %s: %s", id, a.Name, n.Priority, n.Title, n.Message)
+
+	return id, nil
+}
+
+// UpdateNotification logs the new content of a notification.
+func (*LogSink) UpdateNotification(a *model.Application, n *model.Notification, _ string) error {
+	log.L.Printf("[log sink] Updated notification %s for application %s (priority %d): %s: %s", n.ID, a.Name, n.Priority, n.Title, n.Message)
+
+	return nil
+}
+
+// DeleteNotification logs the deletion of a notification.
+func (*LogSink) DeleteNotification(a *model.Application, n *model.DeleteNotification) error {
+	log.L.Printf("[log sink] Deleted notification %s for application %s.", n.ID, a.Name)
+
+	return nil
+}
+
+// Close does nothing, as the log sink holds no resources.
+func (*LogSink) Close() {}
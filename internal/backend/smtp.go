@@ -0,0 +1,158 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// SMTP is a backend that delivers notifications via email.
+type SMTP struct {
+	settings configuration.SMTP
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// CreateSMTP instanciates a backend delivering emails via the configured server.
+func CreateSMTP(settings configuration.SMTP) *SMTP {
+	return &SMTP{
+		settings: settings,
+		sendMail: smtp.SendMail,
+	}
+}
+
+func recipient(a *model.Application) (*mail.Address, error) {
+	address, err := mail.ParseAddress(a.Target)
+	if err != nil {
+		return nil, pberrors.ErrInvalidTarget
+	}
+
+	return address, nil
+}
+
+// Builds a message ID in the domain of the sender address
+func (s *SMTP) generateMessageID() (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+
+	domain := "pushbits"
+	if at := strings.LastIndex(s.settings.From, "@"); at >= 0 {
+		domain = strings.Trim(s.settings.From[at+1:], "> ")
+	}
+
+	return fmt.Sprintf("%s@%s", id, domain), nil
+}
+
+func (s *SMTP) send(a *model.Application, messageID, inReplyTo, subject, body string) error {
+	to, err := recipient(a)
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(s.settings.From)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s>\r\n", messageID)
+	if inReplyTo != "" {
+		fmt.Fprintf(&msg, "In-Reply-To: <%s>\r\n", inReplyTo)
+		fmt.Fprintf(&msg, "References: <%s>\r\n", inReplyTo)
+	}
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.settings.Username != "" {
+		auth = smtp.PlainAuth("", s.settings.Username, s.settings.Password, s.settings.Host)
+	}
+
+	addr := net.JoinHostPort(s.settings.Host, strconv.Itoa(s.settings.Port))
+
+	return s.sendMail(addr, auth, from.Address, []string{to.Address}, msg.Bytes())
+}
+
+// RegisterApplication checks that the target of an application is a valid recipient address.
+func (*SMTP) RegisterApplication(a *model.Application, _ *model.User) (string, error) {
+	to, err := recipient(a)
+	if err != nil {
+		return "", err
+	}
+
+	log.L.Printf("Application %s is now relayed to %s via email.", a.Name, to.Address)
+
+	return to.Address, nil
+}
+
+// DeregisterApplication does nothing, as the recipient does not need to be informed.
+func (*SMTP) DeregisterApplication(_ *model.Application, _ *model.User) error {
+	return nil
+}
+
+// UpdateApplication does nothing, as the name of an application is part of every email.
+func (*SMTP) UpdateApplication(_ *model.Application, _ *configuration.RepairBehavior) error {
+	return nil
+}
+
+// IsOrphan always returns false, as a recipient cannot leave a channel.
+func (*SMTP) IsOrphan(_ *model.Application, _ *model.User) (bool, error) {
+	return false, nil
+}
+
+// RepairApplication does nothing, as there is no channel to repair.
+func (*SMTP) RepairApplication(_ *model.Application, _ *model.User) error {
+	return nil
+}
+
+// SendNotification sends a notification as email and returns its message ID.
+func (s *SMTP) SendNotification(a *model.Application, n *model.Notification) (string, error) {
+	messageID, err := s.generateMessageID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.send(a, messageID, "", n.Title, n.Message); err != nil {
+		return "", err
+	}
+
+	return messageID, nil
+}
+
+// UpdateNotification sends the new content of a notification as a reply to the original email.
+func (s *SMTP) UpdateNotification(a *model.Application, n *model.Notification, _ string) error {
+	messageID, err := s.generateMessageID()
+	if err != nil {
+		return err
+	}
+
+	return s.send(a, messageID, n.ID, "Updated: "+n.Title, n.Message)
+}
+
+// DeleteNotification does nothing, as emails cannot be retracted.
+func (*SMTP) DeleteNotification(_ *model.Application, n *model.DeleteNotification) error {
+	log.L.Debugf("Cannot retract email %s, only removing it from the history.", n.ID)
+
+	return nil
+}
+
+// Close does nothing, as a new connection is opened for every email.
+func (*SMTP) Close() {}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+func TestSMTP_InvalidTarget(t *testing.T) {
+	s := CreateSMTP(configuration.SMTP{Host: "localhost", Port: 25, From: "pushbits@example.com"})
+
+	_, err := s.RegisterApplication(&model.Application{Name: "test", Target: "not an address"}, &model.User{})
+	assert.Equal(t, pberrors.ErrInvalidTarget, err)
+}
+
+func TestSMTP_SendNotification(t *testing.T) {
+	var sentTo []string
+	var sent string
+
+	s := CreateSMTP(configuration.SMTP{Host: "localhost", Port: 25, From: "PushBits <pushbits@example.com>"})
+	s.sendMail = func(addr string, _ smtp.Auth, from string, to []string, msg []byte) error {
+		assert.Equal(t, "localhost:25", addr)
+		assert.Equal(t, "pushbits@example.com", from)
+		sentTo = to
+		sent = string(msg)
+		return nil
+	}
+
+	a := &model.Application{Name: "test", Target: "user@example.com"}
+
+	id, err := s.SendNotification(a, &model.Notification{Title: "Disk full", Message: "line 1\nline 2"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(id, "@example.com"))
+	assert.Equal(t, []string{"user@example.com"}, sentTo)
+	assert.Contains(t, sent, "Subject: Disk full\r\n")
+	assert.Contains(t, sent, "Message-ID: <"+id+">\r\n")
+	assert.Contains(t, sent, "line 1\r\nline 2")
+
+	require.NoError(t, s.UpdateNotification(a, &model.Notification{ID: id, Title: "Disk full", Message: "resolved"}, ""))
+	assert.Contains(t, sent, "In-Reply-To: <"+id+">\r\n")
+}
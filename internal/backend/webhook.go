@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// Events posted to webhook endpoints.
+const (
+	WebhookEventRegister   = "register"
+	WebhookEventDeregister = "deregister"
+	WebhookEventMessage    = "message"
+	WebhookEventUpdate     = "update"
+	WebhookEventDelete     = "delete"
+)
+
+// WebhookApplication describes the application an event posted to a webhook endpoint belongs to.
+type WebhookApplication struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebhookMessage describes the notification an event posted to a webhook endpoint is about.
+type WebhookMessage struct {
+	ID       string                 `json:"id"`
+	Title    string                 `json:"title,omitempty"`
+	Message  string                 `json:"message,omitempty"`
+	Priority int                    `json:"priority"`
+	Extras   map[string]interface{} `json:"extras,omitempty"`
+	Date     time.Time              `json:"date"`
+}
+
+// WebhookPayload is the body posted to webhook endpoints.
+type WebhookPayload struct {
+	Event       string             `json:"event"`
+	Application WebhookApplication `json:"application"`
+	Message     *WebhookMessage    `json:"message,omitempty"`
+}
+
+// Webhook is a backend that posts notifications as JSON to an HTTP endpoint.
+type Webhook struct {
+	client   *http.Client
+	settings configuration.Webhook
+}
+
+// CreateWebhook instanciates a backend posting to HTTP endpoints.
+func CreateWebhook(settings configuration.Webhook) *Webhook {
+	return &Webhook{
+		client:   &http.Client{Timeout: settings.Timeout},
+		settings: settings,
+	}
+}
+
+// Returns the endpoint for an application, which is either its target or the configured one
+func (w *Webhook) endpoint(a *model.Application) (string, error) {
+	endpoint := w.settings.URL
+	if a.Target != "" {
+		if !w.settings.AllowCustomURL {
+			return "", pberrors.ErrInvalidTarget
+		}
+
+		endpoint = a.Target
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", pberrors.ErrInvalidTarget
+	}
+
+	return endpoint, nil
+}
+
+func (w *Webhook) post(event string, a *model.Application, m *WebhookMessage) error {
+	endpoint, err := w.endpoint(a)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(WebhookPayload{
+		Event: event,
+		Application: WebhookApplication{
+			ID:   a.ID,
+			Name: a.Name,
+		},
+		Message: m,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook endpoint responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// RegisterApplication announces an application to its endpoint.
+func (w *Webhook) RegisterApplication(a *model.Application, _ *model.User) (string, error) {
+	endpoint, err := w.endpoint(a)
+	if err != nil {
+		return "", err
+	}
+
+	if err := w.post(WebhookEventRegister, a, nil); err != nil {
+		return "", err
+	}
+
+	log.L.Printf("Application %s is now relayed to webhook %s.", a.Name, endpoint)
+
+	return endpoint, nil
+}
+
+// DeregisterApplication announces the deletion of an application to its endpoint.
+func (w *Webhook) DeregisterApplication(a *model.Application, _ *model.User) error {
+	return w.post(WebhookEventDeregister, a, nil)
+}
+
+// UpdateApplication does nothing, as the name of an application is sent with every event.
+func (*Webhook) UpdateApplication(_ *model.Application, _ *configuration.RepairBehavior) error {
+	return nil
+}
+
+// IsOrphan always returns false, as an endpoint cannot leave a channel.
+func (*Webhook) IsOrphan(_ *model.Application, _ *model.User) (bool, error) {
+	return false, nil
+}
+
+// RepairApplication does nothing, as there is no channel to repair.
+func (*Webhook) RepairApplication(_ *model.Application, _ *model.User) error {
+	return nil
+}
+
+// SendNotification posts a notification to the endpoint of an application.
+func (w *Webhook) SendNotification(a *model.Application, n *model.Notification) (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+
+	err = w.post(WebhookEventMessage, a, &WebhookMessage{
+		ID:       id,
+		Title:    n.Title,
+		Message:  n.Message,
+		Priority: n.Priority,
+		Extras:   n.Extras,
+		Date:     n.Date,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// UpdateNotification posts the new content of a notification to the endpoint of an application.
+func (w *Webhook) UpdateNotification(a *model.Application, n *model.Notification, _ string) error {
+	return w.post(WebhookEventUpdate, a, &WebhookMessage{
+		ID:       n.ID,
+		Title:    n.Title,
+		Message:  n.Message,
+		Priority: n.Priority,
+		Extras:   n.Extras,
+		Date:     n.Date,
+	})
+}
+
+// DeleteNotification asks the endpoint of an application to delete a notification.
+func (w *Webhook) DeleteNotification(a *model.Application, n *model.DeleteNotification) error {
+	return w.post(WebhookEventDelete, a, &WebhookMessage{
+		ID:   n.ID,
+		Date: n.Date,
+	})
+}
+
+// Close releases idle connections to the endpoints.
+func (w *Webhook) Close() {
+	w.client.CloseIdleConnections()
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+func TestWebhook_SendNotification(t *testing.T) {
+	payloads := make(chan WebhookPayload, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payloads <- p
+	}))
+	defer server.Close()
+
+	w := CreateWebhook(configuration.Webhook{URL: server.URL, Timeout: time.Second})
+	a := &model.Application{ID: 3, Name: "test", Backend: model.BackendWebhook}
+
+	channelID, err := w.RegisterApplication(a, &model.User{})
+	require.NoError(t, err)
+	assert.Equal(t, server.URL, channelID)
+	assert.Equal(t, WebhookEventRegister, (<-payloads).Event)
+
+	id, err := w.SendNotification(a, &model.Notification{Title: "title", Message: "hello", Priority: 5})
+	require.NoError(t, err)
+
+	p := <-payloads
+	assert.Equal(t, WebhookEventMessage, p.Event)
+	assert.Equal(t, uint(3), p.Application.ID)
+	require.NotNil(t, p.Message)
+	assert.Equal(t, id, p.Message.ID)
+	assert.Equal(t, "hello", p.Message.Message)
+	assert.Equal(t, 5, p.Message.Priority)
+}
+
+func TestWebhook_ErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	w := CreateWebhook(configuration.Webhook{URL: server.URL, Timeout: time.Second})
+
+	_, err := w.SendNotification(&model.Application{Name: "test"}, &model.Notification{Message: "hello"})
+	assert.Error(t, err)
+}
+
+func TestWebhook_CustomURL(t *testing.T) {
+	a := &model.Application{Name: "test", Target: "https://example.com/hook"}
+
+	w := CreateWebhook(configuration.Webhook{URL: "https://example.org/hook"})
+	_, err := w.endpoint(a)
+	assert.Equal(t, pberrors.ErrInvalidTarget, err)
+
+	w = CreateWebhook(configuration.Webhook{AllowCustomURL: true})
+	endpoint, err := w.endpoint(a)
+	require.NoError(t, err)
+	assert.Equal(t, a.Target, endpoint)
+
+	a.Target = "file:///etc/passwd"
+	_, err = w.endpoint(a)
+	assert.Equal(t, pberrors.ErrInvalidTarget, err)
+}
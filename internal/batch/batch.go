@@ -0,0 +1,215 @@
+// Package batch provides the digest mode of applications, which collects their notifications and sends them as one message per interval.
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+	CreateHeldNotification(h *model.HeldNotification) error
+	GetHeldApplicationIDs(kind string) ([]uint, error)
+	GetHeldNotifications(applicationID uint, kind string) ([]model.HeldNotification, error)
+	DeleteHeldNotifications(applicationID uint, kind string, lastID uint) error
+}
+
+// The Dispatcher interface for sending digests.
+type Dispatcher interface {
+	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+}
+
+// Batcher holds information for batching the notifications of applications and for delivering their digests.
+type Batcher struct {
+	db         Database
+	dp         Dispatcher
+	settings   configuration.Batching
+	formatting configuration.Formatting
+	now        func() time.Time
+	stop       chan struct{}
+	done       chan struct{}
+	started    atomic.Bool
+	stopOnce   sync.Once
+}
+
+// Create instanciates the batching policy.
+func Create(db Database, dp Dispatcher, settings configuration.Batching, formatting configuration.Formatting) *Batcher {
+	return &Batcher{
+		db:         db,
+		dp:         dp,
+		settings:   settings,
+		formatting: formatting,
+		now:        time.Now,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Holds checks whether a notification is held back for the next digest of its application.
+func (b *Batcher) Holds(a *model.Application, n *model.Notification, _ time.Time) bool {
+	return a.Batches(n)
+}
+
+// Apply holds a notification back for the next digest if its application has a digest interval and the notification does not bypass it.
+func (b *Batcher) Apply(a *model.Application, n *model.Notification, now time.Time) (bool, error) {
+	if !b.Holds(a, n, now) {
+		return false, nil
+	}
+
+	if err := b.db.CreateHeldNotification(model.NewHeldNotification(a, n, model.HeldKindBatch)); err != nil {
+		return false, err
+	}
+
+	log.L.Debugf("Batching notification for application %s.", a.Name)
+
+	return true, nil
+}
+
+// Start launches the background delivery of digests, beginning with those that became due while PushBits was not running.
+func (b *Batcher) Start() {
+	b.started.Store(true)
+	go b.run()
+}
+
+// Close stops the delivery of digests.
+func (b *Batcher) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+		if b.started.Load() {
+			<-b.done
+		}
+	})
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		b.deliverDigests()
+
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends a digest for every application whose oldest batched notification waited for the whole digest interval
+func (b *Batcher) deliverDigests() {
+	ids, err := b.db.GetHeldApplicationIDs(model.HeldKindBatch)
+	if err != nil {
+		log.L.Printf("Cannot fetch applications with batched notifications: %s", err)
+		return
+	}
+
+	for _, id := range ids {
+		application, err := b.db.GetApplicationByID(id)
+		if err != nil || application == nil {
+			continue
+		}
+
+		if err := b.sendDigest(application); err != nil {
+			log.L.Printf("Cannot send digest for application %s: %s", application.Name, err)
+		}
+	}
+}
+
+func (b *Batcher) sendDigest(application *model.Application) error {
+	held, err := b.db.GetHeldNotifications(application.ID, model.HeldKindBatch)
+	if err != nil || len(held) == 0 {
+		return err
+	}
+
+	// Notifications that were batched before the digest interval was disabled are sent right away.
+	interval := time.Duration(application.DigestInterval) * time.Second
+	if interval > 0 && b.now().Before(held[0].Date.Add(interval)) {
+		return nil
+	}
+
+	notification := model.Notification{
+		Title:   fmt.Sprintf("Digest of %d notification(s)", len(held)),
+		Message: b.digestMessage(held),
+		Extras: map[string]interface{}{
+			"client::display": map[string]interface{}{"contentType": "text/html"},
+		},
+		Digest: true,
+	}
+	notification.Sanitize(application)
+
+	for _, n := range held {
+		if n.Priority > notification.Priority {
+			notification.Priority = n.Priority
+		}
+	}
+
+	// A digest that is suppressed by the delivery state of the application is dropped like any other notification,
+	// while one that is held for the quiet hours of the user is delivered with the quiet hours digest.
+	// Digests only go to Matrix: the notifications they summarize were added to the message history and streamed when they were held.
+	if _, err := b.dp.SendNotification(application, &notification); err != nil && !errors.Is(err, pberrors.ErrNotificationSuppressed) {
+		return err
+	}
+
+	log.L.Printf("Sent digest of %d batched notification(s) for application %s.", len(held), application.Name)
+
+	return b.db.DeleteHeldNotifications(application.ID, model.HeldKindBatch, held[len(held)-1].ID)
+}
+
+// A group of batched notifications with the same title
+type group struct {
+	title    string
+	count    int
+	priority int
+	message  string
+}
+
+// Lists the batched notifications grouped by title, in the order the titles first appeared, with their count and latest message
+func (b *Batcher) digestMessage(held []model.HeldNotification) string {
+	groups := make([]*group, 0)
+	byTitle := make(map[string]*group)
+
+	for _, n := range held {
+		g, ok := byTitle[n.Title]
+		if !ok {
+			g = &group{title: n.Title, priority: n.Priority}
+			byTitle[n.Title] = g
+			groups = append(groups, g)
+		}
+
+		g.count++
+		g.message = strings.ReplaceAll(strings.TrimSpace(n.Message), "\n", " ")
+		if n.Priority > g.priority {
+			g.priority = n.Priority
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<ul>")
+
+	for _, g := range groups {
+		title := "<b>" + html.EscapeString(g.title) + "</b>"
+		if color := b.formatting.PriorityBand(g.priority).Color; color != "" {
+			title = "<font data-mx-color='" + color + "'>" + title + "</font>"
+		}
+
+		fmt.Fprintf(&sb, "<li>%s (%d×): %s</li>", title, g.count, html.EscapeString(g.message))
+	}
+
+	sb.WriteString("</ul>")
+
+	return sb.String()
+}
@@ -0,0 +1,67 @@
+package batch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+func TestBatch_Digest(t *testing.T) {
+	assert := assert.New(t)
+
+	application := &model.Application{ID: 1, Name: "backup", DigestInterval: 900, DigestBypassPriority: 10}
+	db := mockups.GetMemoryDatabase(application)
+	dp := &mockups.RecordingDispatcher{}
+	b := Create(db, dp, configuration.Batching{PollInterval: time.Minute}, configuration.Formatting{})
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, n := range []model.Notification{
+		{Title: "Backup", Message: "started", Priority: 2},
+		{Title: "Disk", Message: "almost <full>", Priority: 5},
+		{Title: "Backup", Message: "done", Priority: 1},
+	} {
+		n.Date = start.Add(time.Duration(i) * time.Minute)
+		held, err := b.Apply(application, &n, n.Date)
+		assert.NoError(err)
+		assert.True(held, "Notification below the bypass priority should be batched")
+	}
+
+	urgent := model.Notification{Title: "Disk", Message: "full", Priority: 10}
+	held, err := b.Apply(application, &urgent, start)
+	assert.NoError(err)
+	assert.False(held, "Notification with the bypass priority should be sent immediately")
+
+	b.now = func() time.Time { return start.Add(14 * time.Minute) }
+	b.deliverDigests()
+	assert.Empty(dp.Sent, "Digest should not be sent before the interval passed")
+
+	b.now = func() time.Time { return start.Add(15 * time.Minute) }
+	b.deliverDigests()
+	if assert.Len(dp.Sent, 1) {
+		digest := dp.Sent[0]
+		assert.Equal("Digest of 3 notification(s)", digest.Title)
+		assert.Equal("<ul><li><b>Backup</b> (2×): done</li><li><font data-mx-color='#edd711'><b>Disk</b></font> (1×): almost &lt;full&gt;</li></ul>", digest.Message)
+		assert.Equal(5, digest.Priority)
+		assert.True(digest.Digest)
+	}
+	assert.Empty(db.Held)
+}
+
+func TestBatch_Disabled(t *testing.T) {
+	application := &model.Application{ID: 1, Name: "backup"}
+	b := Create(mockups.GetMemoryDatabase(application), &mockups.RecordingDispatcher{}, configuration.Batching{PollInterval: time.Minute}, configuration.Formatting{})
+
+	held, err := b.Apply(application, &model.Notification{Message: "done"}, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, held, "Applications without digest interval should not batch")
+
+	application.DigestInterval = 60
+	held, err = b.Apply(application, &model.Notification{Message: "digest", Digest: true}, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, held, "Digests should not be batched again")
+}
@@ -0,0 +1,118 @@
+// Package callback provides functionality for posting interactions of users with notifications to applications.
+package callback
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+// Headers sent along with every callback.
+const (
+	HeaderTimestamp = "X-PushBits-Timestamp"
+	HeaderSignature = "X-PushBits-Signature"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByMatrixID(matrixID string) (*model.Application, error)
+	GetStoredNotificationByEventID(application *model.Application, eventID string) (*model.StoredNotification, error)
+}
+
+// Forwarder holds information for posting interactions to the callback URLs of applications.
+type Forwarder struct {
+	db     Database
+	client *http.Client
+}
+
+// Create instanciates a forwarder.
+func Create(db Database, settings configuration.Callbacks) *Forwarder {
+	return &Forwarder{
+		db:     db,
+		client: &http.Client{Timeout: settings.Timeout},
+	}
+}
+
+// Sign computes the signature of a callback body for the given timestamp, as sent in the signature header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handle posts an interaction to the application it belongs to in the background.
+func (f *Forwarder) Handle(i *model.Interaction) {
+	go func() {
+		if err := f.forward(i); err != nil {
+			log.L.Printf("Cannot forward %s %s: %s", i.Type, i.EventID, err)
+		}
+	}()
+}
+
+func (f *Forwarder) forward(i *model.Interaction) error {
+	application, err := f.db.GetApplicationByMatrixID(i.RoomID)
+	if err != nil || application == nil {
+		log.L.Debugf("Ignoring %s in room %s, which does not belong to an application.", i.Type, i.RoomID)
+		return nil
+	}
+
+	if application.CallbackURL == "" {
+		return nil
+	}
+
+	notification, err := f.db.GetStoredNotificationByEventID(application, i.TargetEventID)
+	if err != nil || notification == nil {
+		log.L.Debugf("Ignoring %s to event %s, which is not a known notification.", i.Type, i.TargetEventID)
+		return nil
+	}
+
+	body, err := json.Marshal(model.CallbackPayload{
+		Type:          i.Type,
+		ApplicationID: application.ID,
+		Message:       *notification,
+		Sender:        i.Sender,
+		Content:       i.Content,
+		EventID:       i.EventID,
+		Date:          i.Date,
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, application.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(application.CallbackSecret, timestamp, body))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback URL responded with status %d", resp.StatusCode)
+	}
+
+	log.L.Printf("Forwarded %s to notification %d of application %s.", i.Type, notification.ID, application.Name)
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+)
+
+type memoryDatabase struct {
+	application  *model.Application
+	notification *model.StoredNotification
+}
+
+func (db *memoryDatabase) GetApplicationByMatrixID(matrixID string) (*model.Application, error) {
+	if db.application.MatrixID != matrixID {
+		return nil, errors.New("not found")
+	}
+
+	return db.application, nil
+}
+
+func (db *memoryDatabase) GetStoredNotificationByEventID(_ *model.Application, eventID string) (*model.StoredNotification, error) {
+	if db.notification.EventID != eventID {
+		return nil, errors.New("not found")
+	}
+
+	return db.notification, nil
+}
+
+func TestForwarder_SignedCallback(t *testing.T) {
+	type request struct {
+		timestamp string
+		signature string
+		body      []byte
+	}
+	requests := make(chan request, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), body}
+	}))
+	defer server.Close()
+
+	db := &memoryDatabase{
+		application:  &model.Application{ID: 1, Name: "deploy", MatrixID: "!room:example.com", CallbackURL: server.URL, CallbackSecret: "secret"},
+		notification: &model.StoredNotification{ID: 4, ApplicationID: 1, Message: "Approval needed", EventID: "$notification"},
+	}
+	f := Create(db, configuration.Callbacks{Timeout: time.Second})
+
+	err := f.forward(&model.Interaction{
+		Type:          model.InteractionReaction,
+		RoomID:        "!room:example.com",
+		EventID:       "$reaction",
+		TargetEventID: "$notification",
+		Sender:        "@user:example.com",
+		Content:       "✅",
+	})
+	require.NoError(t, err)
+
+	r := <-requests
+	assert.Equal(t, Sign("secret", r.timestamp, r.body), r.signature)
+
+	var payload model.CallbackPayload
+	require.NoError(t, json.Unmarshal(r.body, &payload))
+	assert.Equal(t, model.InteractionReaction, payload.Type)
+	assert.Equal(t, uint(4), payload.Message.ID)
+	assert.Equal(t, "✅", payload.Content)
+	assert.Equal(t, "@user:example.com", payload.Sender)
+}
+
+func TestForwarder_IgnoresUnknownNotifications(t *testing.T) {
+	db := &memoryDatabase{
+		application:  &model.Application{ID: 1, MatrixID: "!room:example.com", CallbackURL: "http://127.0.0.1:1", CallbackSecret: "secret"},
+		notification: &model.StoredNotification{EventID: "$notification"},
+	}
+	f := Create(db, configuration.Callbacks{Timeout: time.Second})
+
+	// The callback URL is not reachable, so this only succeeds if no request is made.
+	assert.NoError(t, f.forward(&model.Interaction{Type: model.InteractionReply, RoomID: "!room:example.com", TargetEventID: "$other"}))
+	assert.NoError(t, f.forward(&model.Interaction{Type: model.InteractionReply, RoomID: "!other:example.com", TargetEventID: "$notification"}))
+}
@@ -0,0 +1,226 @@
+// Package command provides the commands users can send to the channel of an application to change its delivery state.
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+const helpText = `Available commands:
+!mute [duration]    Stop delivering notifications, for example for 2h or 1d, or until !unmute
+!unmute             Deliver notifications again
+!minpriority <n>    Only deliver notifications with a priority of at least n
+!status             Show the delivery state of this application
+!help               Show this help`
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByMatrixID(matrixID string) (*model.Application, error)
+	UpdateApplicationFields(application *model.Application, fields ...string) error
+	GetLastDeliveredNotification(application *model.Application) (*model.StoredNotification, error)
+	GetUserByID(ID uint) (*model.User, error)
+}
+
+// The Dispatcher interface for responding to commands.
+type Dispatcher interface {
+	SendNotice(a *model.Application, text string) error
+}
+
+// Handler holds information for processing commands.
+type Handler struct {
+	db  Database
+	dp  Dispatcher
+	now func() time.Time
+}
+
+// Create instanciates a command handler.
+func Create(db Database, dp Dispatcher) *Handler {
+	return &Handler{
+		db:  db,
+		dp:  dp,
+		now: time.Now,
+	}
+}
+
+// Handle executes a command sent to the channel of an application and responds with the outcome.
+func (h *Handler) Handle(i *model.Interaction) {
+	application, err := h.db.GetApplicationByMatrixID(i.RoomID)
+	if err != nil || application == nil {
+		log.L.Debugf("Ignoring command in room %s, which does not belong to an application.", i.RoomID)
+		return
+	}
+
+	user, err := h.db.GetUserByID(application.UserID)
+	if err != nil || user == nil || user.MatrixID != i.Sender {
+		log.L.Printf("Ignoring command of %s for application %s, only its owner may send commands.", i.Sender, application.Name)
+		return
+	}
+
+	response, err := h.execute(application, i.Content)
+	if err != nil {
+		response = fmt.Sprintf("Error: %s\n\n%s", err, helpText)
+	}
+
+	if err := h.dp.SendNotice(application, response); err != nil {
+		log.L.Printf("Cannot respond to command for application %s: %s", application.Name, err)
+	}
+}
+
+func (h *Handler) execute(a *model.Application, text string) (string, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	name, args := strings.ToLower(fields[0]), fields[1:]
+
+	log.L.Printf("Executing command %s for application %s.", name, a.Name)
+
+	switch name {
+	case "!mute":
+		return h.mute(a, args)
+	case "!unmute":
+		return h.unmute(a)
+	case "!minpriority":
+		return h.minPriority(a, args)
+	case "!status":
+		return h.status(a)
+	case "!help":
+		return helpText, nil
+	default:
+		return "", fmt.Errorf("unknown command %s", name)
+	}
+}
+
+func (h *Handler) mute(a *model.Application, args []string) (string, error) {
+	if len(args) > 1 {
+		return "", errors.New("!mute takes at most one duration")
+	}
+
+	var until *time.Time
+	response := "Muted until !unmute."
+
+	if len(args) == 1 {
+		duration, err := parseDuration(args[0])
+		if err != nil {
+			return "", err
+		}
+
+		end := h.now().Add(duration)
+		until = &end
+		response = fmt.Sprintf("Muted until %s.", end.Format(time.RFC1123))
+	}
+
+	a.Muted = true
+	a.MutedUntil = until
+
+	if err := h.db.UpdateApplicationFields(a, "Muted", "MutedUntil"); err != nil {
+		return "", err
+	}
+
+	return response, nil
+}
+
+func (h *Handler) unmute(a *model.Application) (string, error) {
+	a.Muted = false
+	a.MutedUntil = nil
+
+	if err := h.db.UpdateApplicationFields(a, "Muted", "MutedUntil"); err != nil {
+		return "", err
+	}
+
+	return "Unmuted.", nil
+}
+
+func (h *Handler) minPriority(a *model.Application, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("!minpriority takes exactly one priority")
+	}
+
+	priority, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid priority %s", args[0])
+	}
+
+	a.MinPriority = priority
+
+	if err := h.db.UpdateApplicationFields(a, "MinPriority"); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Only notifications with a priority of at least %d are delivered.", priority), nil
+}
+
+func (h *Handler) status(a *model.Application) (string, error) {
+	now := h.now()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Application %s (ID %d)\n", a.Name, a.ID)
+
+	switch {
+	case !a.IsMuted(now):
+		b.WriteString("Muted: no\n")
+	case a.MutedUntil == nil:
+		b.WriteString("Muted: until !unmute\n")
+	default:
+		fmt.Fprintf(&b, "Muted: until %s\n", a.MutedUntil.Format(time.RFC1123))
+	}
+
+	fmt.Fprintf(&b, "Minimum priority: %d\n", a.MinPriority)
+
+	last, err := h.db.GetLastDeliveredNotification(a)
+	if err != nil {
+		return "", err
+	}
+
+	if last == nil {
+		b.WriteString("Last delivery: never\n")
+	} else {
+		fmt.Fprintf(&b, "Last delivery: %s (%s ago)\n", last.Date.Format(time.RFC1123), formatAge(now.Sub(last.Date)))
+	}
+
+	if a.TokenCreatedAt.IsZero() {
+		b.WriteString("Token age: unknown")
+	} else {
+		fmt.Fprintf(&b, "Token age: %s", formatAge(now.Sub(a.TokenCreatedAt)))
+	}
+
+	return b.String(), nil
+}
+
+// Parses a duration like time.ParseDuration, additionally accepting days as in "1d"
+func parseDuration(s string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(s)
+	}
+
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+
+	return duration, nil
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d/(24*time.Hour)))
+	case d >= time.Hour:
+		return fmt.Sprintf("%d hours", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%d minutes", int(d/time.Minute))
+	}
+}
@@ -0,0 +1,98 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+func setup() (*Handler, *mockups.MemoryDatabase, *mockups.RecordingDispatcher) {
+	db := mockups.GetMemoryDatabase(&model.Application{ID: 1, Name: "app", MatrixID: "!room:example.com", UserID: 1})
+	db.Users[1] = &model.User{ID: 1, MatrixID: "@owner:example.com"}
+	dp := &mockups.RecordingDispatcher{}
+
+	h := Create(db, dp)
+	h.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+	return h, db, dp
+}
+
+func command(sender, text string) *model.Interaction {
+	return &model.Interaction{Type: model.InteractionCommand, RoomID: "!room:example.com", Sender: sender, Content: text}
+}
+
+func TestCommand_Mute(t *testing.T) {
+	h, db, dp := setup()
+
+	h.Handle(command("@owner:example.com", "!mute 2h"))
+
+	require.Len(t, dp.Notices, 1)
+	require.NotNil(t, db.Applications[1].MutedUntil)
+	assert.Equal(t, h.now().Add(2*time.Hour), *db.Applications[1].MutedUntil)
+	assert.True(t, db.Applications[1].IsMuted(h.now()))
+	assert.False(t, db.Applications[1].IsMuted(h.now().Add(3*time.Hour)))
+
+	h.Handle(command("@owner:example.com", "!unmute"))
+	assert.False(t, db.Applications[1].IsMuted(h.now()))
+	assert.Equal(t, [][]string{{"Muted", "MutedUntil"}, {"Muted", "MutedUntil"}}, db.Updates, "Commands should only update the fields they change")
+}
+
+func TestCommand_MuteIndefinitely(t *testing.T) {
+	h, db, _ := setup()
+
+	h.Handle(command("@owner:example.com", "!mute"))
+
+	assert.Nil(t, db.Applications[1].MutedUntil)
+	assert.True(t, db.Applications[1].IsMuted(h.now().Add(24*365*time.Hour)))
+}
+
+func TestCommand_MinPriority(t *testing.T) {
+	h, db, _ := setup()
+
+	h.Handle(command("@owner:example.com", "!minpriority 5"))
+
+	assert.Equal(t, 5, db.Applications[1].MinPriority)
+	assert.Equal(t, [][]string{{"MinPriority"}}, db.Updates)
+	assert.True(t, db.Applications[1].Suppresses(&model.Notification{Priority: 4}, h.now()))
+	assert.False(t, db.Applications[1].Suppresses(&model.Notification{Priority: 5}, h.now()))
+}
+
+func TestCommand_Status(t *testing.T) {
+	h, db, dp := setup()
+	db.Applications[1].TokenCreatedAt = h.now().Add(-72 * time.Hour)
+	db.Stored = []*model.StoredNotification{{ApplicationID: 1, EventID: "$sent", Date: h.now().Add(-3 * time.Hour)}, {ApplicationID: 1, Date: h.now().Add(-time.Hour)}}
+
+	h.Handle(command("@owner:example.com", "!status"))
+
+	require.Len(t, dp.Notices, 1)
+	assert.Contains(t, dp.Notices[0], "Muted: no")
+	assert.Contains(t, dp.Notices[0], "(3 hours ago)")
+	assert.Contains(t, dp.Notices[0], "Token age: 3 days")
+}
+
+func TestCommand_Invalid(t *testing.T) {
+	h, db, dp := setup()
+
+	h.Handle(command("@owner:example.com", "!mute soon"))
+	h.Handle(command("@owner:example.com", "!unknown"))
+
+	require.Len(t, dp.Notices, 2)
+	assert.Contains(t, dp.Notices[0], "Error: invalid duration soon")
+	assert.Contains(t, dp.Notices[1], "Error: unknown command !unknown")
+	assert.False(t, db.Applications[1].Muted)
+	assert.Empty(t, db.Updates)
+}
+
+func TestCommand_OnlyOwner(t *testing.T) {
+	h, db, dp := setup()
+
+	h.Handle(command("@intruder:example.com", "!mute"))
+
+	assert.Empty(t, dp.Notices)
+	assert.False(t, db.Applications[1].Muted)
+}
@@ -2,6 +2,10 @@
 package configuration
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jinzhu/configor"
 
 	"github.com/pushbits/server/internal/log"
@@ -25,28 +29,258 @@ type CryptoConfig struct {
 	Argon2 Argon2Config
 }
 
+// Message types and mentions notifications of a priority band can be sent with.
+const (
+	MsgTypeText   = "text"
+	MsgTypeNotice = "notice"
+	MentionNone   = ""
+	MentionOwner  = "owner"
+	MentionRoom   = "room"
+)
+
+// PriorityBand defines how notifications with a priority of at least Min are sent, up to the Min of the next band.
+// The lowest band also applies to all priorities below it.
+type PriorityBand struct {
+	Min     int
+	Color   string
+	MsgType string
+	Mention string
+}
+
+// DefaultPriorityBands returns the bands that are used if none are configured. They only set the colors of titles.
+func DefaultPriorityBands() []PriorityBand {
+	return []PriorityBand{
+		{Min: -1, Color: "#828282", MsgType: MsgTypeText},
+		{Min: 0, Color: "", MsgType: MsgTypeText},
+		{Min: 4, Color: "#edd711", MsgType: MsgTypeText},
+		{Min: 11, Color: "#ed6d11", MsgType: MsgTypeText},
+		{Min: 21, Color: "#ed1f11", MsgType: MsgTypeText},
+	}
+}
+
 // Formatting holds additional parameters used for formatting messages
 type Formatting struct {
-	ColoredTitle bool `default:"false"`
+	ColoredTitle  bool `default:"false"`
+	PriorityBands []PriorityBand
+}
+
+// PriorityBand finds the band with the highest minimum that the priority reaches, or the lowest band.
+func (f *Formatting) PriorityBand(prio int) PriorityBand {
+	bands := f.PriorityBands
+	if len(bands) == 0 {
+		bands = DefaultPriorityBands()
+	}
+
+	band := bands[0]
+	for _, b := range bands[1:] {
+		if prio >= b.Min {
+			band = b
+		}
+	}
+
+	return band
+}
+
+// Encryption holds settings for end-to-end encrypted application channels
+type Encryption struct {
+	Enabled            bool   `default:"false"`
+	PickleKey          string `default:""`
+	RecoveryPassphrase string `default:""`
 }
 
 // Matrix holds credentials for a matrix account
 type Matrix struct {
-	Homeserver string `default:"https://matrix.org"`
-	Username   string `required:"true"`
-	Password   string `required:"true"`
+	Homeserver       string `default:"https://matrix.org"`
+	Username         string `required:"true"`
+	Password         string `default:""`
+	AccessToken      string `default:""`
+	LogoutOnShutdown bool   `default:"false"`
+	Encryption       Encryption
+	AppService       AppService
+	Identities       []MatrixIdentity
+}
+
+// AppService holds settings for sending the notifications of each application as its own virtual user of a Matrix application service.
+type AppService struct {
+	Enabled bool   `default:"false"`
+	ID      string `default:"pushbits"`
+	// The URL the homeserver reaches PushBits at to deliver transactions.
+	URL        string `default:""`
+	ASToken    string `default:""`
+	HSToken    string `default:""`
+	UserPrefix string `default:"pushbits_"`
+}
+
+// PuppetLocalpart returns the localpart of the virtual user of an application.
+func (a *AppService) PuppetLocalpart(applicationID uint) string {
+	return a.UserPrefix + strconv.FormatUint(uint64(applicationID), 10)
+}
+
+// PuppetApplicationID returns the ID of the application a Matrix ID belongs to, if it is one of the virtual users.
+func (a *AppService) PuppetApplicationID(userID string) (uint, bool) {
+	localpart, _, ok := strings.Cut(strings.TrimPrefix(userID, "@"), ":")
+	if !ok || !strings.HasPrefix(userID, "@"+a.UserPrefix) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(localpart, a.UserPrefix), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+// MatrixIdentity holds an additional Matrix account, which users and applications can be assigned to by its name.
+type MatrixIdentity struct {
+	Name        string
+	Homeserver  string
+	Username    string
+	Password    string
+	AccessToken string
+}
+
+// IdentityNames returns the names of all Matrix identities, starting with the empty name of the default account.
+func (m *Matrix) IdentityNames() []string {
+	names := []string{""}
+	for _, identity := range m.Identities {
+		names = append(names, identity.Name)
+	}
+
+	return names
+}
+
+// ForIdentity returns the settings of the default account with the account of the given identity instead.
+func (m *Matrix) ForIdentity(identity MatrixIdentity) Matrix {
+	settings := *m
+	settings.Homeserver = identity.Homeserver
+	settings.Username = identity.Username
+	settings.Password = identity.Password
+	settings.AccessToken = identity.AccessToken
+	settings.AppService = AppService{}
+	settings.Identities = nil
+
+	return settings
+}
+
+// HistoryScan holds settings for finding messages in the room history that were sent before event mappings were recorded.
+type HistoryScan struct {
+	MaxPages int `default:"10"`
+	PageSize int `default:"10"`
 }
 
 // Alertmanager holds information on how to parse alertmanager calls
 type Alertmanager struct {
 	AnnotationTitle   string `default:"title"`
 	AnnotationMessage string `default:"message"`
+	TrackAlerts       bool   `default:"true"`
 }
 
 // RepairBehavior holds information on how repair applications.
 type RepairBehavior struct {
-	ResetRoomName  bool `default:"true"`
-	ResetRoomTopic bool `default:"true"`
+	ResetRoomName   bool `default:"true"`
+	ResetRoomTopic  bool `default:"true"`
+	ResetRoomAvatar bool `default:"true"`
+}
+
+// Queue holds settings for the persistent delivery queue.
+type Queue struct {
+	Enabled      bool          `default:"false"`
+	Workers      int           `default:"2"`
+	MaxAttempts  int           `default:"10"`
+	PollInterval time.Duration `default:"5s"`
+	MinBackoff   time.Duration `default:"5s"`
+	MaxBackoff   time.Duration `default:"1h"`
+}
+
+// Scheduler holds settings for the delivery of notifications that are held back until a later time.
+type Scheduler struct {
+	PollInterval  time.Duration `default:"10s"`
+	MaxAttempts   int           `default:"5"`
+	RetryInterval time.Duration `default:"1m"`
+}
+
+// Expiry holds settings for deleting notifications that were sent with an expiry time.
+type Expiry struct {
+	SweepInterval time.Duration `default:"30s"`
+	Mode          string        `default:"strikethrough"`
+}
+
+// Batching holds settings for sending the notifications of applications with a digest interval as combined messages.
+type Batching struct {
+	PollInterval time.Duration `default:"1m"`
+}
+
+// QuietHours holds settings for the quiet hours of users.
+type QuietHours struct {
+	Enabled        bool          `default:"false"`
+	Priority       int           `default:"10"`
+	DigestInterval time.Duration `default:"1m"`
+}
+
+// Callbacks holds settings for forwarding replies and reactions to the callback URLs of applications
+type Callbacks struct {
+	Enabled bool          `default:"false"`
+	Timeout time.Duration `default:"10s"`
+}
+
+// RateLimit holds settings for the token buckets that limit how many notifications applications can send
+type RateLimit struct {
+	Enabled              bool          `default:"false"`
+	ApplicationPerMinute float64       `default:"60"`
+	ApplicationBurst     int           `default:"30"`
+	AccountPerMinute     float64       `default:"300"`
+	AccountBurst         int           `default:"100"`
+	Coalesce             bool          `default:"false"`
+	SummaryInterval      time.Duration `default:"1m"`
+}
+
+// Dedup holds settings for collapsing repeated notifications into the previous message
+type Dedup struct {
+	Window    time.Duration `default:"10m"`
+	Identical bool          `default:"false"`
+}
+
+// Stream holds settings for the WebSocket connections that push notifications to Gotify clients
+type Stream struct {
+	PingInterval time.Duration `default:"45s"`
+	WriteTimeout time.Duration `default:"10s"`
+	BufferSize   int           `default:"16"`
+}
+
+// Commands holds settings for the commands users can send to application channels
+type Commands struct {
+	Enabled bool `default:"false"`
+}
+
+// SMTP holds settings for delivering notifications via email
+type SMTP struct {
+	Enabled  bool   `default:"false"`
+	Host     string `default:""`
+	Port     int    `default:"587"`
+	Username string `default:""`
+	Password string `default:""`
+	From     string `default:""`
+}
+
+// Webhook holds settings for delivering notifications to an HTTP endpoint
+type Webhook struct {
+	Enabled        bool          `default:"false"`
+	URL            string        `default:""`
+	AllowCustomURL bool          `default:"false"`
+	Timeout        time.Duration `default:"10s"`
+}
+
+// LogSink holds settings for writing notifications to the log
+type LogSink struct {
+	Enabled bool `default:"false"`
+}
+
+// Backends holds settings for the transports applications can be bound to besides Matrix.
+type Backends struct {
+	SMTP    SMTP
+	Webhook Webhook
+	Log     LogSink
 }
 
 // Configuration holds values that can be configured by the user.
@@ -74,8 +308,20 @@ type Configuration struct {
 	}
 	Crypto         CryptoConfig
 	Formatting     Formatting
+	HistoryScan    HistoryScan
 	Alertmanager   Alertmanager
 	RepairBehavior RepairBehavior
+	Queue          Queue
+	Scheduler      Scheduler
+	Expiry         Expiry
+	Batching       Batching
+	QuietHours     QuietHours
+	Backends       Backends
+	Callbacks      Callbacks
+	Commands       Commands
+	RateLimit      RateLimit
+	Dedup          Dedup
+	Stream         Stream
 }
 
 func configFiles() []string {
@@ -96,8 +342,199 @@ func validateHTTPConfiguration(c *Configuration) error {
 	return nil
 }
 
+func validateQueueConfiguration(c *Configuration) error {
+	if !c.Queue.Enabled {
+		return nil
+	}
+
+	if c.Queue.Workers < 1 || c.Queue.MaxAttempts < 1 {
+		return pberrors.ErrConfigQueueInvalid
+	}
+
+	return nil
+}
+
+func validateSchedulerConfiguration(c *Configuration) error {
+	s := c.Scheduler
+	if s.MaxAttempts < 1 || s.PollInterval <= 0 || s.RetryInterval <= 0 {
+		return pberrors.ErrConfigSchedulerInvalid
+	}
+
+	return nil
+}
+
+func validateExpiryConfiguration(c *Configuration) error {
+	e := c.Expiry
+	if e.SweepInterval <= 0 || (e.Mode != "" && e.Mode != "strikethrough" && e.Mode != "redact") {
+		return pberrors.ErrConfigExpiryInvalid
+	}
+
+	return nil
+}
+
+func validateBatchingConfiguration(c *Configuration) error {
+	if c.Batching.PollInterval <= 0 {
+		return pberrors.ErrConfigBatchingInvalid
+	}
+
+	return nil
+}
+
+func validateQuietHoursConfiguration(c *Configuration) error {
+	if c.QuietHours.Enabled && c.QuietHours.DigestInterval <= 0 {
+		return pberrors.ErrConfigQuietHoursInvalid
+	}
+
+	return nil
+}
+
+func validateFormattingConfiguration(c *Configuration) error {
+	bands := c.Formatting.PriorityBands
+	for i, band := range bands {
+		if i > 0 && band.Min <= bands[i-1].Min {
+			return pberrors.ErrConfigPriorityBandsInvalid
+		}
+
+		if band.MsgType != "" && band.MsgType != MsgTypeText && band.MsgType != MsgTypeNotice {
+			return pberrors.ErrConfigPriorityBandsInvalid
+		}
+
+		if band.Mention != MentionNone && band.Mention != MentionOwner && band.Mention != MentionRoom {
+			return pberrors.ErrConfigPriorityBandsInvalid
+		}
+	}
+
+	return nil
+}
+
+func validateRateLimitConfiguration(c *Configuration) error {
+	r := c.RateLimit
+	if r.Enabled && (r.ApplicationBurst < 1 || r.AccountBurst < 1 || r.SummaryInterval <= 0) {
+		return pberrors.ErrConfigRateLimitInvalid
+	}
+
+	return nil
+}
+
+func validateStreamConfiguration(c *Configuration) error {
+	s := c.Stream
+	if s.PingInterval <= 0 || s.WriteTimeout <= 0 || s.BufferSize < 1 {
+		return pberrors.ErrConfigStreamInvalid
+	}
+
+	return nil
+}
+
+func validateEncryptionConfiguration(c *Configuration) error {
+	if !c.Matrix.Encryption.Enabled {
+		return nil
+	}
+
+	if c.Matrix.Encryption.PickleKey == "" {
+		return pberrors.ErrConfigPickleKeyMissing
+	}
+
+	if c.Database.Dialect == "mysql" {
+		return pberrors.ErrConfigEncryptionDialect
+	}
+
+	return nil
+}
+
+func validateBackendsConfiguration(c *Configuration) error {
+	smtp := c.Backends.SMTP
+	if smtp.Enabled && (smtp.Host == "" || smtp.From == "") {
+		return pberrors.ErrConfigSMTPIncomplete
+	}
+
+	return nil
+}
+
+func validateAppServiceConfiguration(c *Configuration) error {
+	a := c.Matrix.AppService
+	if !a.Enabled {
+		return nil
+	}
+
+	// Virtual users have no devices, so they cannot send to encrypted rooms.
+	if a.ID == "" || a.ASToken == "" || a.HSToken == "" || a.UserPrefix == "" || c.Matrix.Encryption.Enabled {
+		return pberrors.ErrConfigAppServiceInvalid
+	}
+
+	return nil
+}
+
+func validateMatrixConfiguration(c *Configuration) error {
+	if c.Matrix.Password == "" && c.Matrix.AccessToken == "" && !c.Matrix.AppService.Enabled {
+		return pberrors.ErrConfigMatrixCredentialsMissing
+	}
+
+	names := make(map[string]bool)
+	for _, identity := range c.Matrix.Identities {
+		if identity.Name == "" || names[identity.Name] || identity.Homeserver == "" || identity.Username == "" {
+			return pberrors.ErrConfigMatrixIdentitiesInvalid
+		}
+
+		if identity.Password == "" && identity.AccessToken == "" {
+			return pberrors.ErrConfigMatrixCredentialsMissing
+		}
+
+		names[identity.Name] = true
+	}
+
+	return nil
+}
+
 func validateConfiguration(c *Configuration) error {
-	return validateHTTPConfiguration(c)
+	if err := validateMatrixConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateAppServiceConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateHTTPConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateFormattingConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateQueueConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateBackendsConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateRateLimitConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateQuietHoursConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateEncryptionConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateSchedulerConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateExpiryConfiguration(c); err != nil {
+		return err
+	}
+
+	if err := validateBatchingConfiguration(c); err != nil {
+		return err
+	}
+
+	return validateStreamConfiguration(c)
 }
 
 // Get returns the configuration extracted from env variables or config file.
@@ -117,5 +554,9 @@ func Get() *Configuration {
 		log.L.Fatal(err)
 	}
 
+	if len(config.Formatting.PriorityBands) == 0 {
+		config.Formatting.PriorityBands = DefaultPriorityBands()
+	}
+
 	return config
 }
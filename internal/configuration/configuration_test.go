@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jinzhu/configor"
 	"github.com/stretchr/testify/assert"
@@ -248,3 +249,145 @@ func TestConfigurationValidation_ConfigTLSFilesInconsistent(t *testing.T) {
 	should := pberrors.ErrConfigTLSFilesInconsistent
 	assert.Equal(is, should, "validateConfiguration() should return ConfigTLSFilesInconsistent")
 }
+
+func TestConfigurationValidation_ConfigPickleKeyMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.Password = "default-password"
+	c.Matrix.Encryption.Enabled = true
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigPickleKeyMissing
+	assert.Equal(is, should, "validateConfiguration() should return ConfigPickleKeyMissing")
+}
+
+func TestConfigurationValidation_ConfigSchedulerInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.Password = "default-password"
+	c.Scheduler.PollInterval = time.Second
+	c.Scheduler.RetryInterval = time.Second
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigSchedulerInvalid
+	assert.Equal(is, should, "validateConfiguration() should return ConfigSchedulerInvalid")
+}
+
+func TestConfigurationValidation_ConfigExpiryInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.Password = "default-password"
+	c.Scheduler.PollInterval = time.Second
+	c.Scheduler.RetryInterval = time.Second
+	c.Scheduler.MaxAttempts = 1
+	c.Expiry.SweepInterval = time.Second
+	c.Expiry.Mode = "shred"
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigExpiryInvalid
+	assert.Equal(is, should, "validateConfiguration() should return ConfigExpiryInvalid")
+}
+
+func TestConfigurationValidation_ConfigPriorityBandsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.Password = "default-password"
+	c.Formatting.PriorityBands = []PriorityBand{
+		{Min: 0, MsgType: MsgTypeNotice},
+		{Min: 10, MsgType: MsgTypeText, Mention: MentionOwner},
+		{Min: 5, MsgType: MsgTypeText, Mention: MentionRoom},
+	}
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigPriorityBandsInvalid
+	assert.Equal(is, should, "validateConfiguration() should return ConfigPriorityBandsInvalid")
+}
+
+func TestConfigurationValidation_ConfigMatrixCredentialsMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigMatrixCredentialsMissing
+	assert.Equal(is, should, "validateConfiguration() should return ConfigMatrixCredentialsMissing")
+}
+
+func TestConfigurationValidation_ConfigMatrixIdentitiesInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.Password = "default-password"
+	c.Matrix.Identities = []MatrixIdentity{
+		{Name: "internal", Homeserver: "https://matrix.example.com", Username: "pushbits", Password: "secret"},
+		{Name: "internal", Homeserver: "https://matrix.example.org", Username: "pushbits", AccessToken: "token"},
+	}
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigMatrixIdentitiesInvalid
+	assert.Equal(is, should, "validateConfiguration() should return ConfigMatrixIdentitiesInvalid")
+	assert.Equal([]string{"", "internal", "internal"}, c.Matrix.IdentityNames())
+}
+
+func TestConfigurationValidation_ConfigAppServiceInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.AppService = AppService{Enabled: true, ID: "pushbits", ASToken: "as", HSToken: "hs", UserPrefix: "pushbits_"}
+	c.Matrix.Encryption = Encryption{Enabled: true, PickleKey: "secret"}
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigAppServiceInvalid
+	assert.Equal(is, should, "validateConfiguration() should return ConfigAppServiceInvalid")
+
+	localpart := c.Matrix.AppService.PuppetLocalpart(42)
+	assert.Equal("pushbits_42", localpart)
+
+	id, ok := c.Matrix.AppService.PuppetApplicationID("@" + localpart + ":example.com")
+	assert.True(ok)
+	assert.Equal(uint(42), id)
+
+	for _, userID := range []string{"@pushbits_backup:example.com", "@user:example.com", "pushbits_42"} {
+		_, ok := c.Matrix.AppService.PuppetApplicationID(userID)
+		assert.Falsef(ok, "%s should not be a virtual user", userID)
+	}
+}
+
+func TestConfigurationValidation_ConfigStreamInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Configuration{}
+	c.Admin.MatrixID = "000000"
+	c.Matrix.Username = "default-username"
+	c.Matrix.Password = "default-password"
+	c.Scheduler.PollInterval = time.Second
+	c.Scheduler.RetryInterval = time.Second
+	c.Scheduler.MaxAttempts = 1
+	c.Expiry.SweepInterval = time.Second
+	c.Expiry.Mode = "strikethrough"
+	c.Batching.PollInterval = time.Second
+	c.Stream.PingInterval = 45 * time.Second
+	c.Stream.WriteTimeout = 10 * time.Second
+
+	is := validateConfiguration(&c)
+	should := pberrors.ErrConfigStreamInvalid
+	assert.Equal(is, should, "validateConfiguration() should return ConfigStreamInvalid")
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/pushbits/server/internal/assert"
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// GetTrackedAlert returns the tracked alert of an application with the given fingerprint or nil.
+func (d *Database) GetTrackedAlert(application *model.Application, fingerprint string) (*model.TrackedAlert, error) {
+	var alert model.TrackedAlert
+
+	err := d.gormdb.Where("application_id = ? AND fingerprint = ?", application.ID, fingerprint).First(&alert).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(alert.Fingerprint == fingerprint)
+
+	return &alert, err
+}
+
+// SaveTrackedAlert creates or updates a tracked alert.
+func (d *Database) SaveTrackedAlert(alert *model.TrackedAlert) error {
+	return d.gormdb.Save(alert).Error
+}
@@ -14,16 +14,36 @@ func (d *Database) CreateApplication(application *model.Application) error {
 	return d.gormdb.Create(application).Error
 }
 
-// DeleteApplication deletes an application.
+// DeleteApplication deletes an application together with its message history.
 func (d *Database) DeleteApplication(application *model.Application) error {
+	if err := d.deleteApplicationData([]uint{application.ID}); err != nil {
+		return err
+	}
+
 	return d.gormdb.Delete(application).Error
 }
 
+// Removes everything that belongs to the applications with the given IDs, which can also be a subquery
+func (d *Database) deleteApplicationData(applicationIDs interface{}) error {
+	for _, value := range []interface{}{&model.StoredNotification{}, &model.QueuedNotification{}, &model.TrackedAlert{}, &model.ScheduledNotification{}, &model.HeldNotification{}, &model.Subscriber{}} {
+		if err := d.gormdb.Where("application_id IN (?)", applicationIDs).Delete(value).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // UpdateApplication updates an application.
 func (d *Database) UpdateApplication(application *model.Application) error {
 	return d.gormdb.Save(application).Error
 }
 
+// UpdateApplicationFields updates only the given fields of an application, leaving changes others made to the rest untouched.
+func (d *Database) UpdateApplicationFields(application *model.Application, fields ...string) error {
+	return d.gormdb.Model(application).Select(fields).Updates(application).Error
+}
+
 // GetApplicationByID returns the application with the given ID or nil.
 func (d *Database) GetApplicationByID(id uint) (*model.Application, error) {
 	var application model.Application
@@ -53,3 +73,27 @@ func (d *Database) GetApplicationByToken(token string) (*model.Application, erro
 
 	return &application, err
 }
+
+// CountApplicationsByMatrixID returns how many applications other than the given one are relayed to the given Matrix room.
+func (d *Database) CountApplicationsByMatrixID(matrixID string, excludeID uint) (int64, error) {
+	var count int64
+
+	err := d.gormdb.Model(&model.Application{}).Where("matrix_id = ? AND backend = ? AND id <> ?", matrixID, model.BackendMatrix, excludeID).Count(&count).Error
+
+	return count, err
+}
+
+// GetApplicationByMatrixID returns the application that is relayed to the given Matrix room or nil.
+func (d *Database) GetApplicationByMatrixID(matrixID string) (*model.Application, error) {
+	var application model.Application
+
+	err := d.gormdb.Where("matrix_id = ? AND backend = ?", matrixID, model.BackendMatrix).Order("id").First(&application).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(application.MatrixID == matrixID)
+
+	return &application, err
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/pushbits/server/internal/assert"
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// CreateClient creates a client.
+func (d *Database) CreateClient(client *model.Client) error {
+	return d.gormdb.Create(client).Error
+}
+
+// DeleteClient deletes a client.
+func (d *Database) DeleteClient(client *model.Client) error {
+	return d.gormdb.Delete(client).Error
+}
+
+// GetClientByID returns the client with the given ID or nil.
+func (d *Database) GetClientByID(id uint) (*model.Client, error) {
+	var client model.Client
+
+	err := d.gormdb.First(&client, id).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(client.ID == id)
+
+	return &client, err
+}
+
+// GetClientByToken returns the client with the given token or nil.
+func (d *Database) GetClientByToken(token string) (*model.Client, error) {
+	var client model.Client
+
+	err := d.gormdb.Where("token = ?", token).First(&client).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(client.Token == token)
+
+	return &client, err
+}
+
+// GetClients returns the clients of a user.
+func (d *Database) GetClients(user *model.User) ([]model.Client, error) {
+	var clients []model.Client
+
+	err := d.gormdb.Where("user_id = ?", user.ID).Order("id").Find(&clients).Error
+
+	return clients, err
+}
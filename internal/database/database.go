@@ -6,12 +6,14 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/pushbits/server/internal/authentication/credentials"
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/log"
 	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
@@ -23,6 +25,7 @@ import (
 type Database struct {
 	gormdb             *gorm.DB
 	sqldb              *sql.DB
+	dialect            string
 	credentialsManager *credentials.Manager
 }
 
@@ -74,12 +77,17 @@ func Create(cm *credentials.Manager, dialect, connection string) (*Database, err
 		sql.SetConnMaxLifetime(9 * time.Minute)
 	}
 
-	err = db.AutoMigrate(&model.User{}, &model.Application{})
+	err = db.AutoMigrate(&model.User{}, &model.Application{}, &model.QueuedNotification{}, &model.StoredNotification{}, &model.TrackedAlert{}, &model.ScheduledNotification{}, &model.HeldNotification{}, &model.MatrixSession{}, &model.Subscriber{}, &model.Client{})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Database{gormdb: db, sqldb: sql, credentialsManager: cm}, nil
+	return &Database{gormdb: db, sqldb: sql, dialect: dialect, credentialsManager: cm}, nil
+}
+
+// RawSQL returns the underlying SQL connection and its dialect, for components that manage their own tables.
+func (d *Database) RawSQL() (*sql.DB, string) {
+	return d.sqldb, d.dialect
 }
 
 // Close closes the database connection.
@@ -114,7 +122,13 @@ func (d *Database) Populate(name, password, matrixID string) error {
 	return nil
 }
 
-// RepairChannels resets channels that have been modified by a user.
+// An application together with the user it belongs to
+type channel struct {
+	application model.Application
+	user        *model.User
+}
+
+// RepairChannels resets channels that have been modified by a user, one Matrix identity after the other.
 func (d *Database) RepairChannels(dp Dispatcher, behavior *configuration.RepairBehavior) error {
 	log.L.Print("Repairing application channels.")
 
@@ -123,33 +137,65 @@ func (d *Database) RepairChannels(dp Dispatcher, behavior *configuration.RepairB
 		return err
 	}
 
-	for _, user := range users {
-		user := user // See https://stackoverflow.com/a/68247837
+	identities := make([]string, 0)
+	channels := make(map[string][]channel)
 
-		applications, err := d.GetApplications(&user)
+	for i := range users {
+		applications, err := d.GetApplications(&users[i])
 		if err != nil {
 			return err
 		}
 
 		for _, application := range applications {
-			application := application // See https://stackoverflow.com/a/68247837
-
-			if err := dp.UpdateApplication(&application, behavior); err != nil {
-				return err
+			if _, ok := channels[application.MatrixIdentity]; !ok {
+				identities = append(identities, application.MatrixIdentity)
 			}
 
-			orphan, err := dp.IsOrphan(&application, &user)
-			if err != nil {
-				return err
-			}
+			channels[application.MatrixIdentity] = append(channels[application.MatrixIdentity], channel{application: application, user: &users[i]})
+		}
+	}
+
+	sort.Strings(identities)
+
+	for _, identity := range identities {
+		if identity != "" {
+			log.L.Printf("Repairing application channels of Matrix identity %s.", identity)
+		}
+
+		if err := repairIdentityChannels(dp, identity, channels[identity], behavior); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func repairIdentityChannels(dp Dispatcher, identity string, channels []channel, behavior *configuration.RepairBehavior) error {
+	for _, c := range channels {
+		application := c.application
+
+		err := dp.UpdateApplication(&application, behavior)
+		if errors.Is(err, pberrors.ErrUnknownMatrixIdentity) {
+			log.L.Printf("Skipping application %s (ID %d), its Matrix identity %s is not configured.", application.Name, application.ID, identity)
+			continue
+		} else if errors.Is(err, pberrors.ErrUnknownBackend) {
+			log.L.Printf("Skipping application %s (ID %d), its backend %s is not enabled.", application.Name, application.ID, application.Backend)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		orphan, err := dp.IsOrphan(&application, c.user)
+		if err != nil {
+			return err
+		}
 
-			if orphan {
-				log.L.Printf("Found orphan channel for application %s (ID %d)", application.Name, application.ID)
+		if orphan {
+			log.L.Printf("Found orphan channel for application %s (ID %d)", application.Name, application.ID)
 
-				if err = dp.RepairApplication(&application, &user); err != nil {
-					log.L.Printf("Unable to repair application %s (ID %d).", application.Name, application.ID)
-					log.L.Println(err)
-				}
+			if err = dp.RepairApplication(&application, c.user); err != nil {
+				log.L.Printf("Unable to repair application %s (ID %d).", application.Name, application.ID)
+				log.L.Println(err)
 			}
 		}
 	}
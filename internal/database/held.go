@@ -0,0 +1,33 @@
+package database
+
+import (
+	"github.com/pushbits/server/internal/model"
+)
+
+// CreateHeldNotification holds a notification back for the next digest.
+func (d *Database) CreateHeldNotification(h *model.HeldNotification) error {
+	return d.gormdb.Create(h).Error
+}
+
+// GetHeldApplicationIDs returns the IDs of all applications with held notifications of the given kind.
+func (d *Database) GetHeldApplicationIDs(kind string) ([]uint, error) {
+	var ids []uint
+
+	err := d.gormdb.Model(&model.HeldNotification{}).Where("kind = ?", kind).Distinct().Pluck("application_id", &ids).Error
+
+	return ids, err
+}
+
+// GetHeldNotifications returns the held notifications of the given kind of an application, oldest first.
+func (d *Database) GetHeldNotifications(applicationID uint, kind string) ([]model.HeldNotification, error) {
+	var held []model.HeldNotification
+
+	err := d.gormdb.Where("application_id = ? AND kind = ?", applicationID, kind).Order("id").Find(&held).Error
+
+	return held, err
+}
+
+// DeleteHeldNotifications removes the held notifications of the given kind of an application up to the given ID.
+func (d *Database) DeleteHeldNotifications(applicationID uint, kind string, lastID uint) error {
+	return d.gormdb.Where("application_id = ? AND kind = ? AND id <= ?", applicationID, kind, lastID).Delete(&model.HeldNotification{}).Error
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pushbits/server/internal/assert"
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// CreateStoredNotification adds a sent notification to the message history.
+func (d *Database) CreateStoredNotification(n *model.StoredNotification) error {
+	return d.gormdb.Create(n).Error
+}
+
+// GetStoredNotifications returns up to limit notifications of the given applications with an ID lower than since, newest first.
+// A since of zero starts at the newest notification.
+func (d *Database) GetStoredNotifications(applicationIDs []uint, since uint, limit int) ([]model.StoredNotification, error) {
+	notifications := make([]model.StoredNotification, 0)
+
+	if len(applicationIDs) == 0 {
+		return notifications, nil
+	}
+
+	query := d.gormdb.Where("application_id IN ?", applicationIDs)
+	if since > 0 {
+		query = query.Where("id < ?", since)
+	}
+
+	err := query.Order("id desc").Limit(limit).Find(&notifications).Error
+
+	return notifications, err
+}
+
+// GetLastDeliveredNotification returns the latest notification of an application that was sent to Matrix, or nil if there is none.
+// Notifications that were suppressed or held back are in the message history without an event.
+func (d *Database) GetLastDeliveredNotification(application *model.Application) (*model.StoredNotification, error) {
+	notifications := make([]model.StoredNotification, 0, 1)
+
+	err := d.gormdb.Where("application_id = ? AND event_id <> ''", application.ID).Order("id desc").Limit(1).Find(&notifications).Error
+	if err != nil || len(notifications) == 0 {
+		return nil, err
+	}
+
+	return &notifications[0], nil
+}
+
+// DeleteStoredNotifications removes all notifications of an application from the message history.
+func (d *Database) DeleteStoredNotifications(application *model.Application) error {
+	return d.gormdb.Where("application_id = ?", application.ID).Delete(&model.StoredNotification{}).Error
+}
+
+// GetStoredNotificationByEventID returns the notification of an application that was sent as the given Matrix event or nil.
+func (d *Database) GetStoredNotificationByEventID(application *model.Application, eventID string) (*model.StoredNotification, error) {
+	var notification model.StoredNotification
+
+	err := d.gormdb.Where("application_id = ? AND event_id = ?", application.ID, eventID).First(&notification).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(notification.EventID == eventID)
+
+	return &notification, err
+}
+
+// UpdateStoredNotification updates a notification in the message history.
+func (d *Database) UpdateStoredNotification(n *model.StoredNotification) error {
+	return d.gormdb.Save(n).Error
+}
+
+// DeleteStoredNotification removes a single notification from the message history.
+func (d *Database) DeleteStoredNotification(n *model.StoredNotification) error {
+	return d.gormdb.Delete(n).Error
+}
+
+// GetCollapsibleStoredNotification returns the latest sent notification of an application with the given collapse key
+// that was sent or collapsed after the given time, or nil.
+func (d *Database) GetCollapsibleStoredNotification(application *model.Application, collapseKey string, since time.Time) (*model.StoredNotification, error) {
+	var notification model.StoredNotification
+
+	err := d.gormdb.Where("application_id = ? AND collapse_key = ? AND date >= ? AND event_id <> ''", application.ID, collapseKey, since).Order("id desc").First(&notification).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(notification.CollapseKey == collapseKey)
+
+	return &notification, err
+}
+
+// GetExpiredStoredNotifications returns up to limit notifications whose expiry time has passed, oldest expiry first.
+func (d *Database) GetExpiredStoredNotifications(now time.Time, limit int) ([]model.StoredNotification, error) {
+	var notifications []model.StoredNotification
+
+	err := d.gormdb.Where("expires_at IS NOT NULL AND expires_at <= ?", now).Order("expires_at").Limit(limit).Find(&notifications).Error
+
+	return notifications, err
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pushbits/server/internal/assert"
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// CreateQueuedNotification adds a notification to the delivery queue.
+func (d *Database) CreateQueuedNotification(q *model.QueuedNotification) error {
+	return d.gormdb.Create(q).Error
+}
+
+// UpdateQueuedNotification updates the delivery state of a queued notification.
+func (d *Database) UpdateQueuedNotification(q *model.QueuedNotification) error {
+	return d.gormdb.Save(q).Error
+}
+
+// GetQueuedNotification returns the queued notification with the given ID or nil.
+func (d *Database) GetQueuedNotification(id uint) (*model.QueuedNotification, error) {
+	var q model.QueuedNotification
+
+	err := d.gormdb.First(&q, id).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(q.ID == id)
+
+	return &q, err
+}
+
+// GetQueuedNotifications returns the queued notifications of an application, optionally filtered by status.
+func (d *Database) GetQueuedNotifications(application *model.Application, status model.QueueStatus) ([]model.QueuedNotification, error) {
+	var queued []model.QueuedNotification
+
+	query := d.gormdb.Where("application_id = ?", application.ID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	err := query.Order("id desc").Find(&queued).Error
+
+	return queued, err
+}
+
+// GetDueQueuedNotifications returns up to limit pending notifications whose next attempt is due.
+func (d *Database) GetDueQueuedNotifications(now time.Time, limit int) ([]model.QueuedNotification, error) {
+	var queued []model.QueuedNotification
+
+	err := d.gormdb.Where("status = ? AND next_attempt <= ?", model.QueueStatusPending, now).Order("next_attempt").Limit(limit).Find(&queued).Error
+
+	return queued, err
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pushbits/server/internal/assert"
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// CreateScheduledNotification adds a notification to the schedule.
+func (d *Database) CreateScheduledNotification(s *model.ScheduledNotification) error {
+	return d.gormdb.Create(s).Error
+}
+
+// UpdateScheduledNotification updates the delivery state of a scheduled notification.
+func (d *Database) UpdateScheduledNotification(s *model.ScheduledNotification) error {
+	return d.gormdb.Save(s).Error
+}
+
+// DeleteScheduledNotification removes a notification from the schedule.
+func (d *Database) DeleteScheduledNotification(s *model.ScheduledNotification) error {
+	return d.gormdb.Delete(s).Error
+}
+
+// GetScheduledNotification returns the scheduled notification with the given ID or nil.
+func (d *Database) GetScheduledNotification(id uint) (*model.ScheduledNotification, error) {
+	var s model.ScheduledNotification
+
+	err := d.gormdb.First(&s, id).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(s.ID == id)
+
+	return &s, err
+}
+
+// GetScheduledNotifications returns the scheduled notifications of an application, optionally filtered by status.
+func (d *Database) GetScheduledNotifications(application *model.Application, status model.ScheduleStatus) ([]model.ScheduledNotification, error) {
+	var scheduled []model.ScheduledNotification
+
+	query := d.gormdb.Where("application_id = ?", application.ID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	err := query.Order("deliver_at").Find(&scheduled).Error
+
+	return scheduled, err
+}
+
+// GetDueScheduledNotifications returns up to limit pending notifications whose next attempt is due.
+func (d *Database) GetDueScheduledNotifications(now time.Time, limit int) ([]model.ScheduledNotification, error) {
+	var scheduled []model.ScheduledNotification
+
+	err := d.gormdb.Where("status = ? AND next_attempt <= ?", model.ScheduleStatusPending, now).Order("next_attempt").Limit(limit).Find(&scheduled).Error
+
+	return scheduled, err
+}
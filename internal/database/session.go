@@ -0,0 +1,32 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// GetMatrixSession returns the persisted Matrix session of the given user name on a homeserver or nil.
+func (d *Database) GetMatrixSession(homeserver, username string) (*model.MatrixSession, error) {
+	var s model.MatrixSession
+
+	err := d.gormdb.Where("homeserver = ? AND username = ?", homeserver, username).First(&s).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	return &s, err
+}
+
+// SaveMatrixSession creates or updates a persisted Matrix session.
+func (d *Database) SaveMatrixSession(s *model.MatrixSession) error {
+	return d.gormdb.Save(s).Error
+}
+
+// DeleteMatrixSession removes a persisted Matrix session after it was logged out.
+func (d *Database) DeleteMatrixSession(s *model.MatrixSession) error {
+	return d.gormdb.Delete(s).Error
+}
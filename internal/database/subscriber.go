@@ -0,0 +1,53 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/pushbits/server/internal/assert"
+	"github.com/pushbits/server/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// CreateSubscriber adds a subscriber to an application.
+func (d *Database) CreateSubscriber(s *model.Subscriber) error {
+	return d.gormdb.Create(s).Error
+}
+
+// DeleteSubscriber removes a subscriber from an application.
+func (d *Database) DeleteSubscriber(s *model.Subscriber) error {
+	return d.gormdb.Delete(s).Error
+}
+
+// GetSubscriber returns the subscriber with the given ID or nil.
+func (d *Database) GetSubscriber(id uint) (*model.Subscriber, error) {
+	var s model.Subscriber
+
+	err := d.gormdb.First(&s, id).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	assert.Assert(s.ID == id)
+
+	return &s, err
+}
+
+// GetSubscribers returns the subscribers of an application.
+func (d *Database) GetSubscribers(applicationID uint) ([]model.Subscriber, error) {
+	var subscribers []model.Subscriber
+
+	err := d.gormdb.Where("application_id = ?", applicationID).Order("id").Find(&subscribers).Error
+
+	return subscribers, err
+}
+
+// GetSubscriptions returns the subscriptions of a user to applications of other users.
+func (d *Database) GetSubscriptions(userID uint) ([]model.Subscriber, error) {
+	var subscribers []model.Subscriber
+
+	err := d.gormdb.Where("user_id = ?", userID).Order("id").Find(&subscribers).Error
+
+	return subscribers, err
+}
@@ -21,10 +21,23 @@ func (d *Database) CreateUser(createUser model.CreateUser) (*model.User, error)
 
 // DeleteUser deletes a user.
 func (d *Database) DeleteUser(user *model.User) error {
+	applicationIDs := d.gormdb.Model(&model.Application{}).Select("id").Where("user_id = ?", user.ID)
+	if err := d.deleteApplicationData(applicationIDs); err != nil {
+		return err
+	}
+
 	if err := d.gormdb.Where("user_id = ?", user.ID).Delete(model.Application{}).Error; err != nil {
 		return err
 	}
 
+	if err := d.gormdb.Where("user_id = ?", user.ID).Delete(model.Subscriber{}).Error; err != nil {
+		return err
+	}
+
+	if err := d.gormdb.Where("user_id = ?", user.ID).Delete(model.Client{}).Error; err != nil {
+		return err
+	}
+
 	return d.gormdb.Delete(user).Error
 }
 
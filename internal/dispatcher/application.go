@@ -2,11 +2,13 @@ package dispatcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/log"
 	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -17,17 +19,58 @@ func buildRoomTopic(id uint) string {
 	return fmt.Sprintf("Application %d", id)
 }
 
-// RegisterApplication creates a channel for an application.
-func (d *Dispatcher) RegisterApplication(id uint, name, user string) (string, error) {
+// RegisterApplication creates a channel for an application and invites its user and subscribers,
+// or joins the existing room the application is bound to. In application service mode, the virtual user of the application joins as well.
+func (d *Dispatcher) RegisterApplication(a *model.Application, u *model.User) (string, error) {
+	var roomID string
+	var err error
+
+	if a.IsBoundToRoom() {
+		roomID, err = d.joinRoom(a)
+	} else {
+		roomID, err = d.createRoom(a, u)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if d.settings.AppService.Enabled {
+		channel := *a
+		channel.MatrixID = roomID
+
+		if _, err := d.setUpPuppet(&channel); err != nil {
+			log.L.Printf("Cannot set up the virtual user of application %s: %s", a.Name, err)
+		}
+	}
+
+	return roomID, nil
+}
+
+// Creates a private room for an application and invites its user and subscribers
+func (d *Dispatcher) createRoom(a *model.Application, u *model.User) (string, error) {
+	id, name, user := a.ID, a.Name, u.MatrixID
+
 	log.L.Printf("Registering application %s, notifications will be relayed to user %s.\n", name, user)
 
+	recipients, err := d.recipients(a, u)
+	if err != nil {
+		return "", err
+	}
+
+	invite := make([]mId.UserID, 0)
+	for _, recipient := range recipients {
+		invite = append(invite, mId.UserID(recipient))
+	}
+
 	resp, err := d.mautrixClient.CreateRoom(context.Background(), &mautrix.ReqCreateRoom{
-		Visibility: "private",
-		Invite:     []mId.UserID{mId.UserID(user)},
-		IsDirect:   true,
-		Name:       name,
-		Preset:     "private_chat",
-		Topic:      buildRoomTopic(id),
+		Visibility:   "private",
+		Invite:       invite,
+		IsDirect:     len(invite) == 1,
+		Name:         name,
+		Preset:       "private_chat",
+		Topic:        buildRoomTopic(id),
+		InitialState: d.encryptionInitialState(),
 	})
 	if err != nil {
 		log.L.Print(err)
@@ -39,10 +82,28 @@ func (d *Dispatcher) RegisterApplication(id uint, name, user string) (string, er
 	return resp.RoomID.String(), err
 }
 
-// DeregisterApplication deletes a channel for an application.
+// DeregisterApplication deletes a channel for an application, or only leaves the existing room the application is bound to.
 func (d *Dispatcher) DeregisterApplication(a *model.Application, u *model.User) error {
 	log.L.Printf("Deregistering application %s (ID %d) with Matrix ID %s.\n", a.Name, a.ID, a.MatrixID)
 
+	d.removePuppet(a)
+
+	// Other applications relayed to the same room keep it, so nobody is kicked and the room is not left.
+	others, err := d.db.CountApplicationsByMatrixID(a.MatrixID, a.ID)
+	if err != nil {
+		log.L.Print(err)
+		return err
+	}
+
+	if others > 0 {
+		log.L.Printf("Staying in room %s, which %d other application(s) still use.", a.MatrixID, others)
+		return nil
+	}
+
+	if a.IsBoundToRoom() {
+		return d.leaveRoom(a.MatrixID)
+	}
+
 	// The user might have left the channel, but we can still try to remove them.
 
 	if _, err := d.mautrixClient.KickUser(context.Background(), mId.RoomID(a.MatrixID), &mautrix.ReqKickUser{
@@ -53,12 +114,26 @@ func (d *Dispatcher) DeregisterApplication(a *model.Application, u *model.User)
 		return err
 	}
 
-	if _, err := d.mautrixClient.LeaveRoom(context.Background(), mId.RoomID(a.MatrixID)); err != nil {
+	if subscribers, err := d.db.GetSubscribers(a.ID); err != nil {
+		log.L.Printf("Cannot fetch subscribers of application %s: %s", a.Name, err)
+	} else {
+		for _, s := range subscribers {
+			if err := d.RemoveSubscriber(a, s.MatrixID); err != nil {
+				log.L.Printf("Cannot remove subscriber %s: %s", s.MatrixID, err)
+			}
+		}
+	}
+
+	return d.leaveRoom(a.MatrixID)
+}
+
+func (d *Dispatcher) leaveRoom(roomID string) error {
+	if _, err := d.mautrixClient.LeaveRoom(context.Background(), mId.RoomID(roomID)); err != nil {
 		log.L.Print(err)
 		return err
 	}
 
-	if _, err := d.mautrixClient.ForgetRoom(context.Background(), mId.RoomID(a.MatrixID)); err != nil {
+	if _, err := d.mautrixClient.ForgetRoom(context.Background(), mId.RoomID(roomID)); err != nil {
 		log.L.Print(err)
 		return err
 	}
@@ -66,6 +141,43 @@ func (d *Dispatcher) DeregisterApplication(a *model.Application, u *model.User)
 	return nil
 }
 
+// Joins the existing room an application is bound to and checks that notifications can be posted there
+func (d *Dispatcher) joinRoom(a *model.Application) (string, error) {
+	log.L.Printf("Binding application %s to room %s.", a.Name, a.Room)
+
+	resp, err := d.mautrixClient.JoinRoom(context.Background(), a.Room, nil)
+	if errors.Is(err, mautrix.MNotFound) {
+		log.L.Print(err)
+		return "", pberrors.ErrRoomNotFound
+	} else if errors.Is(err, mautrix.MForbidden) {
+		log.L.Print(err)
+		return "", pberrors.ErrRoomForbidden
+	} else if err != nil {
+		log.L.Print(err)
+		return "", err
+	}
+
+	var levels event.PowerLevelsEventContent
+	if err := d.mautrixClient.StateEvent(context.Background(), resp.RoomID, event.StatePowerLevels, "", &levels); err != nil {
+		log.L.Print(err)
+		return "", err
+	}
+
+	if levels.GetUserLevel(d.mautrixClient.UserID) < levels.GetEventLevel(event.EventMessage) {
+		log.L.Printf("Cannot post messages to room %s, leaving it again.", a.Room)
+
+		if err := d.leaveRoom(resp.RoomID.String()); err != nil {
+			log.L.Print(err)
+		}
+
+		return "", pberrors.ErrRoomForbidden
+	}
+
+	log.L.Printf("Application %s is now relayed to room with ID %s.\n", a.Name, resp.RoomID.String())
+
+	return resp.RoomID.String(), nil
+}
+
 func (d *Dispatcher) sendRoomEvent(roomID, eventType string, content interface{}) error {
 	if _, err := d.mautrixClient.SendStateEvent(context.Background(), mId.RoomID(roomID), event.NewEventType(eventType), "", content); err != nil {
 		log.L.Print(err)
@@ -79,6 +191,18 @@ func (d *Dispatcher) sendRoomEvent(roomID, eventType string, content interface{}
 func (d *Dispatcher) UpdateApplication(a *model.Application, behavior *configuration.RepairBehavior) error {
 	log.L.Printf("Updating application %s (ID %d) with Matrix ID %s.\n", a.Name, a.ID, a.MatrixID)
 
+	// The virtual user is renamed and gets the image along with the application.
+	if d.settings.AppService.Enabled {
+		if _, err := d.setUpPuppet(a); err != nil {
+			log.L.Printf("Cannot set up the virtual user of application %s: %s", a.Name, err)
+		}
+	}
+
+	// The name, topic, and encryption of an existing room are left to its members.
+	if a.IsBoundToRoom() {
+		return nil
+	}
+
 	if behavior.ResetRoomName {
 		content := map[string]interface{}{
 			"name": a.Name,
@@ -103,33 +227,125 @@ func (d *Dispatcher) UpdateApplication(a *model.Application, behavior *configura
 		log.L.Debugf("Not reseting room topic as per configuration.\n")
 	}
 
-	return nil
+	if !behavior.ResetRoomAvatar {
+		log.L.Debugf("Not reseting room avatar as per configuration.\n")
+	} else if a.Avatar != "" {
+		content := map[string]interface{}{
+			"url": a.Avatar,
+		}
+
+		if err := d.sendRoomEvent(a.MatrixID, "m.room.avatar", content); err != nil {
+			return err
+		}
+	}
+
+	return d.ensureEncryption(a.MatrixID)
 }
 
-// IsOrphan checks if the user is still connected to the channel.
+// UploadAvatar stores the image of an application in the media repository of the homeserver and returns its mxc URI.
+func (d *Dispatcher) UploadAvatar(a *model.Application, data []byte, contentType string) (string, error) {
+	log.L.Printf("Uploading image of application %s.", a.Name)
+
+	resp, err := d.mautrixClient.UploadBytes(context.Background(), data, contentType)
+	if err != nil {
+		log.L.Print(err)
+		return "", err
+	}
+
+	return resp.ContentURI.String(), nil
+}
+
+// IsOrphan checks if the user or one of the subscribers is not connected to the channel anymore.
+// The user is not expected in existing rooms an application is bound to.
 func (d *Dispatcher) IsOrphan(a *model.Application, u *model.User) (bool, error) {
-	resp, err := d.mautrixClient.JoinedMembers(context.Background(), mId.RoomID(a.MatrixID))
+	missing, err := d.missingRecipients(a, u)
 	if err != nil {
 		return false, err
 	}
 
-	found := false
+	return len(missing) > 0, nil
+}
+
+// RepairApplication re-invites the user and the subscribers that are not connected to the channel anymore.
+func (d *Dispatcher) RepairApplication(a *model.Application, u *model.User) error {
+	missing, err := d.missingRecipients(a, u)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
 
-	for userID := range resp.Joined {
-		found = found || (userID.String() == u.MatrixID)
+	for _, recipient := range missing {
+		log.L.Printf("Inviting %s to the channel of application %s again.", recipient, a.Name)
+
+		if err := d.invite(a, recipient); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return !found, nil
+	return errors.Join(errs...)
 }
 
-// RepairApplication re-invites the user to the channel.
-func (d *Dispatcher) RepairApplication(a *model.Application, u *model.User) error {
+// InviteSubscriber invites a subscriber to the channel of an application.
+func (d *Dispatcher) InviteSubscriber(a *model.Application, matrixID string) error {
+	log.L.Printf("Inviting subscriber %s to the channel of application %s.", matrixID, a.Name)
+
+	return d.invite(a, matrixID)
+}
+
+// RemoveSubscriber removes a subscriber from the channel of an application.
+func (d *Dispatcher) RemoveSubscriber(a *model.Application, matrixID string) error {
+	log.L.Printf("Removing subscriber %s from the channel of application %s.", matrixID, a.Name)
+
+	_, err := d.mautrixClient.KickUser(context.Background(), mId.RoomID(a.MatrixID), &mautrix.ReqKickUser{
+		Reason: "You were unsubscribed from this application",
+		UserID: mId.UserID(matrixID),
+	})
+
+	return err
+}
+
+func (d *Dispatcher) invite(a *model.Application, matrixID string) error {
 	_, err := d.mautrixClient.InviteUser(context.Background(), mId.RoomID(a.MatrixID), &mautrix.ReqInviteUser{
-		UserID: mId.UserID(u.MatrixID),
+		UserID: mId.UserID(matrixID),
 	})
+
+	return err
+}
+
+// Returns the Matrix IDs of the user and the subscribers of an application, the user is not invited to existing rooms
+func (d *Dispatcher) recipients(a *model.Application, u *model.User) ([]string, error) {
+	subscribers, err := d.db.GetSubscribers(a.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if a.IsBoundToRoom() {
+		u = nil
+	}
+
+	return model.Recipients(u, subscribers), nil
+}
+
+// Returns the user and the subscribers of an application that are not joined to its channel
+func (d *Dispatcher) missingRecipients(a *model.Application, u *model.User) ([]string, error) {
+	recipients, err := d.recipients(a, u)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.mautrixClient.JoinedMembers(context.Background(), mId.RoomID(a.MatrixID))
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]string, 0)
+
+	for _, recipient := range recipients {
+		if _, ok := resp.Joined[mId.UserID(recipient)]; !ok {
+			missing = append(missing, recipient)
+		}
+	}
+
+	return missing, nil
 }
@@ -0,0 +1,199 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// A homeserver with existing rooms, in which the bot may post depending on the default power level for events
+type roomsHomeserver struct {
+	fakeHomeserver
+	eventsDefault map[string]int
+	left          []string
+	kicks         int
+}
+
+func (h *roomsHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+
+	switch {
+	case strings.HasPrefix(path, "/join/"):
+		room := strings.TrimPrefix(path, "/join/")
+
+		switch room {
+		case "#missing:example.com":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Room alias not found"}`))
+		case "#private:example.com":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "You are not invited to this room"}`))
+		default:
+			_, _ = w.Write([]byte(`{"room_id": "!` + strings.TrimPrefix(room, "#") + `"}`))
+		}
+	case strings.HasSuffix(path, "/state/m.room.power_levels/"):
+		room := strings.TrimSuffix(strings.TrimPrefix(path, "/rooms/!"), "/state/m.room.power_levels/")
+		_, _ = fmt.Fprintf(w, `{"users_default": 0, "events_default": %d}`, h.eventsDefault[room])
+	case strings.HasSuffix(path, "/leave"):
+		h.left = append(h.left, strings.TrimSuffix(strings.TrimPrefix(path, "/rooms/"), "/leave"))
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/forget"):
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/kick"):
+		h.kicks++
+		_, _ = w.Write([]byte(`{}`))
+	default:
+		h.fakeHomeserver.ServeHTTP(w, r)
+	}
+}
+
+func TestDispatcher_BindToRoom(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &roomsHomeserver{fakeHomeserver: fakeHomeserver{validToken: "configured"}, eventsDefault: map[string]int{"announcements:example.com": 50}}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	db := &memoryDatabase{rooms: map[string]int64{}}
+	d, err := Create(configuration.Matrix{Homeserver: server.URL, Username: "bot", AccessToken: "configured"}, db, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+
+	user := &model.User{MatrixID: "@user:example.com"}
+
+	roomID, err := d.RegisterApplication(&model.Application{Name: "ops", Room: "#ops:example.com"}, user)
+	require.NoError(err)
+	assert.Equal("!ops:example.com", roomID)
+
+	_, err = d.RegisterApplication(&model.Application{Name: "missing", Room: "#missing:example.com"}, user)
+	assert.ErrorIs(err, pberrors.ErrRoomNotFound)
+
+	_, err = d.RegisterApplication(&model.Application{Name: "private", Room: "#private:example.com"}, user)
+	assert.ErrorIs(err, pberrors.ErrRoomForbidden)
+
+	_, err = d.RegisterApplication(&model.Application{Name: "announcements", Room: "#announcements:example.com"}, user)
+	assert.ErrorIs(err, pberrors.ErrRoomForbidden, "Rooms the bot cannot post to should be rejected")
+	assert.Equal([]string{"!announcements:example.com"}, homeserver.left, "Rooms the bot cannot post to should be left again")
+
+	db.rooms[roomID] = 1
+	err = d.DeregisterApplication(&model.Application{Name: "ops", Room: "#ops:example.com", MatrixID: roomID}, user)
+	require.NoError(err)
+	assert.NotContains(homeserver.left, "!ops:example.com", "Rooms other applications are relayed to should not be left")
+
+	db.rooms[roomID] = 0
+	err = d.DeregisterApplication(&model.Application{Name: "ops", Room: "#ops:example.com", MatrixID: roomID}, user)
+	require.NoError(err)
+	assert.Equal(0, homeserver.kicks, "Nobody should be kicked from an existing room")
+	assert.Contains(homeserver.left, "!ops:example.com")
+}
+
+// A homeserver that records as which user messages are sent with the token of the application service
+type puppetHomeserver struct {
+	fakeHomeserver
+	displayNames map[string]string
+	avatars      map[string]string
+	roomAvatars  []string
+	senders      []string
+}
+
+func (h *puppetHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+	userID := r.URL.Query().Get("user_id")
+
+	switch {
+	case path == "/register":
+		_, _ = w.Write([]byte(`{"user_id": "@pushbits_3:example.com"}`))
+	case strings.HasSuffix(path, "/displayname"):
+		var req struct {
+			DisplayName string `json:"displayname"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		h.displayNames[userID] = req.DisplayName
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/avatar_url"):
+		var req struct {
+			AvatarURL string `json:"avatar_url"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		h.avatars[userID] = req.AvatarURL
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/state/m.room.avatar/"):
+		var req struct {
+			URL string `json:"url"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		h.roomAvatars = append(h.roomAvatars, req.URL)
+		_, _ = w.Write([]byte(`{"event_id": "$avatar"}`))
+	case strings.HasSuffix(path, "/invite"):
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/join"):
+		_, _ = w.Write([]byte(`{"room_id": "!room:example.com"}`))
+	case strings.Contains(path, "/send/m.room.message/"):
+		h.senders = append(h.senders, userID)
+		_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+	default:
+		h.fakeHomeserver.ServeHTTP(w, r)
+	}
+}
+
+func TestDispatcher_AppServicePuppet(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &puppetHomeserver{fakeHomeserver: fakeHomeserver{validToken: "as"}, displayNames: make(map[string]string), avatars: make(map[string]string)}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	settings := configuration.Matrix{Homeserver: server.URL, Username: "bot", AppService: configuration.AppService{Enabled: true, ASToken: "as", UserPrefix: "pushbits_"}}
+
+	d, err := Create(settings, &memoryDatabase{}, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err, "AS token should be used without password or access token")
+
+	application := &model.Application{ID: 3, Name: "backup", MatrixID: "!room:example.com"}
+
+	for i := 0; i < 2; i++ {
+		_, err = d.SendNotification(application, &model.Notification{Title: "Backup", Message: "done"})
+		require.NoError(err)
+	}
+
+	assert.Equal([]string{"@pushbits_3:example.com", "@pushbits_3:example.com"}, homeserver.senders, "Notifications should be sent as the virtual user")
+	assert.Equal("backup", homeserver.displayNames["@pushbits_3:example.com"])
+	assert.True(d.isPuppet("@pushbits_3:example.com"))
+	assert.False(d.isPuppet("@pushbits_3:example.org"))
+}
+
+func TestDispatcher_RepairAvatar(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &puppetHomeserver{fakeHomeserver: fakeHomeserver{validToken: "as"}, displayNames: make(map[string]string), avatars: make(map[string]string)}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	settings := configuration.Matrix{Homeserver: server.URL, Username: "bot", AppService: configuration.AppService{Enabled: true, ASToken: "as", UserPrefix: "pushbits_"}}
+
+	d, err := Create(settings, &memoryDatabase{}, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+
+	application := &model.Application{ID: 3, Name: "backup", MatrixID: "!room:example.com", Avatar: "mxc://example.com/backup"}
+
+	require.NoError(d.UpdateApplication(application, &configuration.RepairBehavior{ResetRoomAvatar: false}))
+	assert.Empty(homeserver.roomAvatars, "Room avatar should not be reset against the configuration")
+
+	require.NoError(d.UpdateApplication(application, &configuration.RepairBehavior{ResetRoomAvatar: true}))
+	assert.Equal([]string{"mxc://example.com/backup"}, homeserver.roomAvatars)
+	assert.Equal("mxc://example.com/backup", homeserver.avatars["@pushbits_3:example.com"], "Virtual user should get the image of the application")
+}
@@ -3,45 +3,195 @@ package dispatcher
 
 import (
 	"context"
+	"errors"
+	"sync"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
 )
 
+// The Database interface for persisting the Matrix session across restarts and for looking up subscribers.
+type Database interface {
+	GetMatrixSession(homeserver, username string) (*model.MatrixSession, error)
+	SaveMatrixSession(s *model.MatrixSession) error
+	DeleteMatrixSession(s *model.MatrixSession) error
+	GetSubscribers(applicationID uint) ([]model.Subscriber, error)
+	CountApplicationsByMatrixID(matrixID string, excludeID uint) (int64, error)
+	GetUserByID(id uint) (*model.User, error)
+}
+
+// The device ID used when logging in for the first time
+const defaultDeviceID = id.DeviceID("PushBits")
+
 // Dispatcher holds information for sending notifications to clients.
 type Dispatcher struct {
 	mautrixClient *mautrix.Client
+	identity      string
+	db            Database
+	session       *model.MatrixSession
+	settings      configuration.Matrix
 	formatting    configuration.Formatting
+	historyScan   configuration.HistoryScan
+	encrypted     bool
+	stopSync      context.CancelFunc
+	// The virtual users of applications in application service mode, by application ID.
+	puppets sync.Map
 }
 
 // Create instanciates a dispatcher connection.
-func Create(homeserver, username, password string, formatting configuration.Formatting) (*Dispatcher, error) {
+// It uses the configured access token or the session persisted in the database, and only logs in with the password if neither is valid.
+func Create(settings configuration.Matrix, db Database, formatting configuration.Formatting, historyScan configuration.HistoryScan) (*Dispatcher, error) {
 	log.L.Println("Setting up dispatcher.")
 
-	matrixClient, err := mautrix.NewClient(homeserver, "", "")
+	matrixClient, err := mautrix.NewClient(settings.Homeserver, "", "")
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = matrixClient.Login(context.Background(), &mautrix.ReqLogin{
+	d := &Dispatcher{db: db, settings: settings, formatting: formatting, historyScan: historyScan, mautrixClient: matrixClient}
+
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Establishes a session with the homeserver, preferring the configured access token over the persisted session over a new login.
+// In application service mode, the AS token is used if no access token is configured.
+func (d *Dispatcher) connect() error {
+	accessToken := d.settings.AccessToken
+	if accessToken == "" && d.settings.AppService.Enabled {
+		accessToken = d.settings.AppService.ASToken
+	}
+
+	if accessToken != "" {
+		err := d.useAccessToken(accessToken)
+		if err == nil {
+			log.L.Printf("Using the configured access token for %s.", d.mautrixClient.UserID)
+			return nil
+		}
+
+		if !errors.Is(err, mautrix.MUnknownToken) || d.settings.Password == "" {
+			return err
+		}
+
+		log.L.Println("The configured access token is invalid, logging in with the password instead.")
+	}
+
+	// Without a persisted session, a new one is created by logging in.
+	session, err := d.db.GetMatrixSession(d.settings.Homeserver, d.settings.Username)
+	if err != nil {
+		log.L.Debugf("No persisted session found: %s", err)
+		session = nil
+	}
+
+	deviceID := defaultDeviceID
+
+	if session != nil {
+		err := d.useAccessToken(session.AccessToken)
+		if err == nil {
+			log.L.Printf("Reusing the session of device %s.", d.mautrixClient.DeviceID)
+			d.session = session
+			return nil
+		}
+
+		if !errors.Is(err, mautrix.MUnknownToken) {
+			return err
+		}
+
+		log.L.Println("The persisted session is invalid, logging in again.")
+		deviceID = id.DeviceID(session.DeviceID)
+	}
+
+	if session == nil {
+		session = &model.MatrixSession{Homeserver: d.settings.Homeserver, Username: d.settings.Username}
+	}
+
+	return d.login(session, deviceID)
+}
+
+// Validates an access token with whoami and uses it for all further requests
+func (d *Dispatcher) useAccessToken(token string) error {
+	d.mautrixClient.AccessToken = token
+
+	resp, err := d.mautrixClient.Whoami(context.Background())
+	if err != nil {
+		d.mautrixClient.AccessToken = ""
+		return err
+	}
+
+	d.mautrixClient.UserID = resp.UserID
+	d.mautrixClient.DeviceID = resp.DeviceID
+
+	return nil
+}
+
+// Logs in with the password, keeping the device of an earlier session, and persists the new session
+func (d *Dispatcher) login(session *model.MatrixSession, deviceID id.DeviceID) error {
+	resp, err := d.mautrixClient.Login(context.Background(), &mautrix.ReqLogin{
 		Type:             mautrix.AuthTypePassword,
-		Identifier:       mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: username},
-		Password:         password,
-		DeviceID:         id.DeviceID("PushBits"),
+		Identifier:       mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: d.settings.Username},
+		Password:         d.settings.Password,
+		DeviceID:         deviceID,
 		StoreCredentials: true,
 	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	log.L.Printf("Logged in as %s with device %s.", resp.UserID, resp.DeviceID)
+
+	session.UserID = resp.UserID.String()
+	session.DeviceID = resp.DeviceID.String()
+	session.AccessToken = resp.AccessToken
+
+	if err := d.db.SaveMatrixSession(session); err != nil {
+		return err
+	}
+
+	d.session = session
+
+	return nil
+}
+
+// Starts syncing with the homeserver in the background, unless it is already running
+func (d *Dispatcher) startSync() {
+	if d.stopSync != nil {
+		return
 	}
 
-	return &Dispatcher{formatting: formatting, mautrixClient: matrixClient}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stopSync = cancel
+
+	go func() {
+		if err := d.mautrixClient.SyncWithContext(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.L.Errorf("Syncing with the homeserver stopped: %s", err)
+		}
+	}()
 }
 
 // Close closes the dispatcher connection.
 func (d *Dispatcher) Close() {
+	if d.stopSync != nil {
+		d.stopSync()
+	}
+
+	if !d.settings.LogoutOnShutdown {
+		log.L.Printf("Keeping the session for the next start.")
+		return
+	}
+
+	// Logging out deletes the device together with its keys, which are needed to keep using encrypted rooms.
+	if d.encrypted {
+		log.L.Printf("Keeping the session of the encrypted device.")
+		return
+	}
+
 	log.L.Printf("Logging out.")
 
 	_, err := d.mautrixClient.Logout(context.Background())
@@ -51,5 +201,11 @@ func (d *Dispatcher) Close() {
 
 	d.mautrixClient.ClearCredentials()
 
+	if d.session != nil {
+		if err := d.db.DeleteMatrixSession(d.session); err != nil {
+			log.L.Printf("Error while removing the persisted session: %s", err)
+		}
+	}
+
 	log.L.Printf("Successfully logged out.")
 }
@@ -0,0 +1,211 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+type memoryDatabase struct {
+	session *model.MatrixSession
+	rooms   map[string]int64
+	users   map[uint]*model.User
+}
+
+func (d *memoryDatabase) GetMatrixSession(_, _ string) (*model.MatrixSession, error) {
+	if d.session == nil {
+		return nil, errors.New("not found")
+	}
+
+	session := *d.session
+	return &session, nil
+}
+
+func (d *memoryDatabase) SaveMatrixSession(s *model.MatrixSession) error {
+	session := *s
+	d.session = &session
+	return nil
+}
+
+func (d *memoryDatabase) DeleteMatrixSession(_ *model.MatrixSession) error {
+	d.session = nil
+	return nil
+}
+
+func (d *memoryDatabase) GetSubscribers(_ uint) ([]model.Subscriber, error) {
+	return nil, nil
+}
+
+func (d *memoryDatabase) CountApplicationsByMatrixID(matrixID string, _ uint) (int64, error) {
+	return d.rooms[matrixID], nil
+}
+
+func (d *memoryDatabase) GetUserByID(id uint) (*model.User, error) {
+	user, ok := d.users[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	return user, nil
+}
+
+// A homeserver that accepts a single access token and hands out a new one on every login
+type fakeHomeserver struct {
+	validToken string
+	logins     int
+	deviceIDs  []string
+}
+
+func (h *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/_matrix/client/v3/account/whoami":
+		if r.Header.Get("Authorization") != "Bearer "+h.validToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"user_id": "@bot:example.com", "device_id": "PushBits"}`))
+	case "/_matrix/client/v3/login":
+		var req struct {
+			DeviceID string `json:"device_id"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		h.logins++
+		h.deviceIDs = append(h.deviceIDs, req.DeviceID)
+		h.validToken = fmt.Sprintf("token%d", h.logins)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"user_id": "@bot:example.com", "device_id": req.DeviceID, "access_token": h.validToken})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDispatcher_PersistedSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &fakeHomeserver{}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	db := &memoryDatabase{}
+	settings := configuration.Matrix{Homeserver: server.URL, Username: "bot", Password: "secret"}
+
+	_, err := Create(settings, db, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+	assert.Equal(1, homeserver.logins)
+	require.NotNil(db.session, "Session should be persisted after logging in")
+	assert.Equal("token1", db.session.AccessToken)
+
+	d, err := Create(settings, db, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+	assert.Equal(1, homeserver.logins, "Valid persisted session should be reused without logging in")
+	assert.Equal("@bot:example.com", d.mautrixClient.UserID.String())
+
+	homeserver.validToken = "revoked"
+	db.session.DeviceID = "ABCDEF"
+
+	_, err = Create(settings, db, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+	assert.Equal(2, homeserver.logins, "Invalid persisted session should lead to a new login")
+	assert.Equal([]string{"PushBits", "ABCDEF"}, homeserver.deviceIDs, "Device of the persisted session should be kept")
+	assert.Equal("token2", db.session.AccessToken)
+
+	d.Close()
+	assert.NotNil(db.session, "Session should be kept on shutdown by default")
+}
+
+func TestDispatcher_AccessToken(t *testing.T) {
+	homeserver := &fakeHomeserver{validToken: "configured"}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	db := &memoryDatabase{}
+
+	_, err := Create(configuration.Matrix{Homeserver: server.URL, Username: "bot", AccessToken: "configured"}, db, configuration.Formatting{}, configuration.HistoryScan{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, homeserver.logins)
+	assert.Nil(t, db.session, "Configured access token should not be persisted")
+
+	_, err = Create(configuration.Matrix{Homeserver: server.URL, Username: "bot", AccessToken: "wrong"}, db, configuration.Formatting{}, configuration.HistoryScan{})
+	assert.Error(t, err, "Invalid access token without password should fail")
+}
+
+func TestDispatcher_Identities(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defaultServer := httptest.NewServer(&fakeHomeserver{})
+	defer defaultServer.Close()
+
+	internalServer := httptest.NewServer(&fakeHomeserver{})
+	defer internalServer.Close()
+
+	settings := configuration.Matrix{
+		Homeserver: defaultServer.URL,
+		Username:   "bot",
+		Password:   "secret",
+		Identities: []configuration.MatrixIdentity{{Name: "internal", Homeserver: internalServer.URL, Username: "bot", Password: "secret"}},
+	}
+
+	db := &sessionsDatabase{sessions: make(map[string]*model.MatrixSession)}
+
+	ids, err := CreateIdentities(settings, db, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+	assert.Len(db.sessions, 2, "Sessions of both identities should be persisted separately")
+
+	d, err := ids.Get("internal")
+	require.NoError(err)
+	assert.Equal(internalServer.URL, d.mautrixClient.HomeserverURL.String())
+	assert.Equal("internal", d.identity)
+
+	_, err = ids.SendNotification(&model.Application{MatrixIdentity: "external"}, &model.Notification{})
+	assert.ErrorIs(err, pberrors.ErrUnknownMatrixIdentity)
+}
+
+type sessionsDatabase struct {
+	sessions map[string]*model.MatrixSession
+}
+
+func (d *sessionsDatabase) GetMatrixSession(homeserver, username string) (*model.MatrixSession, error) {
+	session, ok := d.sessions[homeserver+username]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	return session, nil
+}
+
+func (d *sessionsDatabase) SaveMatrixSession(s *model.MatrixSession) error {
+	d.sessions[s.Homeserver+s.Username] = s
+	return nil
+}
+
+func (d *sessionsDatabase) DeleteMatrixSession(s *model.MatrixSession) error {
+	delete(d.sessions, s.Homeserver+s.Username)
+	return nil
+}
+
+func (d *sessionsDatabase) GetSubscribers(_ uint) ([]model.Subscriber, error) {
+	return nil, nil
+}
+
+func (d *sessionsDatabase) CountApplicationsByMatrixID(_ string, _ uint) (int64, error) {
+	return 0, nil
+}
+
+func (d *sessionsDatabase) GetUserByID(_ uint) (*model.User, error) {
+	return nil, errors.New("not found")
+}
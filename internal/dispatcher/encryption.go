@@ -0,0 +1,70 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	mId "maunium.net/go/mautrix/id"
+
+	"github.com/pushbits/server/internal/log"
+)
+
+// Returns the initial state that makes a new room end-to-end encrypted, if encryption is enabled
+func (d *Dispatcher) encryptionInitialState() []*event.Event {
+	if !d.encrypted {
+		return nil
+	}
+
+	return []*event.Event{{
+		Type: event.StateEncryption,
+		Content: event.Content{
+			Parsed: &event.EncryptionEventContent{Algorithm: mId.AlgorithmMegolmV1},
+		},
+	}}
+}
+
+// Enables end-to-end encryption for a room that was created without it
+func (d *Dispatcher) ensureEncryption(roomID string) error {
+	if !d.encrypted {
+		return nil
+	}
+
+	var content event.EncryptionEventContent
+
+	err := d.mautrixClient.StateEvent(context.Background(), mId.RoomID(roomID), event.StateEncryption, "", &content)
+	if err == nil && content.Algorithm != "" {
+		return nil
+	} else if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+
+	log.L.Printf("Enabling encryption for room %s.", roomID)
+
+	return d.sendRoomEvent(roomID, event.StateEncryption.Type, &event.EncryptionEventContent{Algorithm: mId.AlgorithmMegolmV1})
+}
+
+// Decrypts an event that was fetched from an encrypted room
+func (d *Dispatcher) decryptMessage(message *event.Event) (*event.Event, error) {
+	if message.Type != event.EventEncrypted || d.mautrixClient.Crypto == nil {
+		return message, nil
+	}
+
+	if message.Content.Parsed == nil {
+		if err := message.Content.ParseRaw(message.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	decrypted, err := d.mautrixClient.Crypto.Decrypt(context.Background(), message)
+	if err != nil {
+		return nil, err
+	}
+
+	if decrypted.RoomID == "" {
+		decrypted.RoomID = message.RoomID
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,87 @@
+//go:build goolm
+
+package dispatcher
+
+import (
+	"context"
+	"database/sql"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/crypto/cryptohelper"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+)
+
+// EnableEncryption sets up end-to-end encryption, keeping the keys of the bot device in the given database.
+func (d *Dispatcher) EnableEncryption(settings configuration.Encryption, password string, store *sql.DB, dialect string) error {
+	log.L.Println("Setting up end-to-end encryption.")
+
+	db, err := dbutil.NewWithDB(store, dialect)
+	if err != nil {
+		return err
+	}
+
+	helper, err := cryptohelper.NewCryptoHelper(d.mautrixClient, []byte(settings.PickleKey), db)
+	if err != nil {
+		return err
+	}
+
+	// The keys of every identity are kept apart, the default account keeps using the keys stored before identities existed.
+	helper.DBAccountID = d.identity
+
+	ctx := context.Background()
+
+	if err := helper.Init(ctx); err != nil {
+		return err
+	}
+
+	d.mautrixClient.Crypto = helper
+
+	if err := setupCrossSigning(ctx, helper, password, settings.RecoveryPassphrase); err != nil {
+		return err
+	}
+
+	d.encrypted = true
+
+	// Room memberships and key requests are only learned by syncing.
+	d.startSync()
+
+	return nil
+}
+
+// Publishes cross-signing keys for the bot and signs its device, so that users can verify it
+func setupCrossSigning(ctx context.Context, helper *cryptohelper.CryptoHelper, password, passphrase string) error {
+	mach := helper.Machine()
+
+	if keys := mach.GetOwnCrossSigningPublicKeys(ctx); keys != nil {
+		log.L.Debugln("Cross-signing keys are already published.")
+		return nil
+	}
+
+	log.L.Println("Publishing cross-signing keys.")
+
+	// The device is signed on the server, but its keys are only uploaded with the first sync otherwise.
+	if err := mach.ShareKeys(ctx, -1); err != nil {
+		return err
+	}
+
+	recoveryKey, _, err := mach.GenerateAndUploadCrossSigningKeysWithPassword(ctx, password, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := mach.SignOwnDevice(ctx, mach.OwnIdentity()); err != nil {
+		return err
+	}
+
+	if err := mach.SignOwnMasterKey(ctx); err != nil {
+		return err
+	}
+
+	if passphrase == "" {
+		log.L.Warnf("Store the recovery key for the cross-signing keys of the bot, it is not shown again: %s", recoveryKey)
+	}
+
+	return nil
+}
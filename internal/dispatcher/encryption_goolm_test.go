@@ -0,0 +1,112 @@
+//go:build goolm
+
+package dispatcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/authentication/credentials"
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/database"
+)
+
+// A homeserver that logs the bot in and hands out the keys it uploads when they are queried
+type keysHomeserver struct {
+	fakeHomeserver
+	mutex        sync.Mutex
+	uploads      []string
+	deviceKeys   json.RawMessage
+	crossSigning map[string]json.RawMessage
+}
+
+func (h *keysHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/_matrix/client/v3/account/whoami", "/_matrix/client/v3/login":
+		h.fakeHomeserver.ServeHTTP(w, r)
+	case "/_matrix/client/v3/sync":
+		// Keeps the sync loop from spinning while the test runs.
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"next_batch": "s1"}`))
+	case "/_matrix/client/v3/keys/upload":
+		var req struct {
+			DeviceKeys json.RawMessage `json:"device_keys"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		h.mutex.Lock()
+		h.uploads = append(h.uploads, "keys/upload")
+		if req.DeviceKeys != nil {
+			h.deviceKeys = req.DeviceKeys
+		}
+		h.mutex.Unlock()
+
+		_, _ = w.Write([]byte(`{"one_time_key_counts": {"signed_curve25519": 50}}`))
+	case "/_matrix/client/v3/keys/device_signing/upload":
+		var req map[string]json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		h.mutex.Lock()
+		h.uploads = append(h.uploads, "keys/device_signing/upload")
+		h.crossSigning = req
+		h.mutex.Unlock()
+
+		_, _ = w.Write([]byte(`{}`))
+	case "/_matrix/client/v3/keys/query":
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		devices := map[string]json.RawMessage{}
+		if h.deviceKeys != nil {
+			devices["PushBits"] = h.deviceKeys
+		}
+
+		res := map[string]interface{}{"device_keys": map[string]interface{}{"@bot:example.com": devices}}
+		for key, name := range map[string]string{"master_key": "master_keys", "self_signing_key": "self_signing_keys", "user_signing_key": "user_signing_keys"} {
+			if h.crossSigning[key] != nil {
+				res[name] = map[string]json.RawMessage{"@bot:example.com": h.crossSigning[key]}
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(res)
+	default:
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
+
+func TestDispatcher_EnableEncryption(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &keysHomeserver{}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	settings := configuration.Matrix{Homeserver: server.URL, Username: "bot", Password: "secret"}
+
+	db, err := database.Create(credentials.CreateManager(false, configuration.CryptoConfig{}), "sqlite3", filepath.Join(t.TempDir(), "pushbits.db"))
+	require.NoError(err)
+	defer db.Close()
+
+	d, err := Create(settings, &memoryDatabase{}, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+	defer d.Close()
+
+	store, dialect := db.RawSQL()
+	require.NoError(d.EnableEncryption(configuration.Encryption{Enabled: true, PickleKey: "pickle"}, settings.Password, store, dialect))
+	assert.True(d.encrypted)
+
+	homeserver.mutex.Lock()
+	defer homeserver.mutex.Unlock()
+
+	assert.Contains(homeserver.uploads, "keys/upload", "Device keys should be uploaded")
+	assert.Contains(homeserver.uploads, "keys/device_signing/upload", "Cross-signing keys should be published")
+}
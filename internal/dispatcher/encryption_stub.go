@@ -0,0 +1,15 @@
+//go:build !goolm
+
+package dispatcher
+
+import (
+	"database/sql"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// EnableEncryption fails because PushBits was built without support for end-to-end encryption.
+func (d *Dispatcher) EnableEncryption(_ configuration.Encryption, _ string, _ *sql.DB, _ string) error {
+	return pberrors.ErrEncryptionUnsupported
+}
@@ -0,0 +1,218 @@
+package dispatcher
+
+import (
+	"database/sql"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// Identities holds a dispatcher for every configured Matrix identity and relays calls to the identity an application is assigned to.
+type Identities struct {
+	dispatchers map[string]*Dispatcher
+	names       []string
+}
+
+// CreateIdentities instanciates a dispatcher connection for the default account and every additional Matrix identity.
+func CreateIdentities(settings configuration.Matrix, db Database, formatting configuration.Formatting, historyScan configuration.HistoryScan) (*Identities, error) {
+	ids := &Identities{dispatchers: make(map[string]*Dispatcher)}
+
+	d, err := Create(settings, db, formatting, historyScan)
+	if err != nil {
+		return nil, err
+	}
+
+	ids.add("", d)
+
+	for _, identity := range settings.Identities {
+		log.L.Printf("Setting up Matrix identity %s.", identity.Name)
+
+		d, err := Create(settings.ForIdentity(identity), db, formatting, historyScan)
+		if err != nil {
+			ids.Close()
+			return nil, err
+		}
+
+		ids.add(identity.Name, d)
+	}
+
+	return ids, nil
+}
+
+func (ids *Identities) add(name string, d *Dispatcher) {
+	d.identity = name
+	ids.dispatchers[name] = d
+	ids.names = append(ids.names, name)
+}
+
+// Get returns the dispatcher of the Matrix identity with the given name, the empty name stands for the default account.
+func (ids *Identities) Get(name string) (*Dispatcher, error) {
+	d, ok := ids.dispatchers[name]
+	if !ok {
+		return nil, pberrors.ErrUnknownMatrixIdentity
+	}
+
+	return d, nil
+}
+
+// Close closes the dispatcher connections of all identities.
+func (ids *Identities) Close() {
+	for _, name := range ids.names {
+		ids.dispatchers[name].Close()
+	}
+}
+
+// EnableEncryption sets up end-to-end encryption for all identities, keeping their keys apart in the given database.
+func (ids *Identities) EnableEncryption(settings configuration.Encryption, store *sql.DB, dialect string) error {
+	for _, name := range ids.names {
+		d := ids.dispatchers[name]
+		if err := d.EnableEncryption(settings, d.settings.Password, store, dialect); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListenForInteractions passes interactions in the rooms of all identities to the handler.
+func (ids *Identities) ListenForInteractions(handler func(i *model.Interaction)) error {
+	for _, name := range ids.names {
+		if err := ids.dispatchers[name].ListenForInteractions(handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RegisterApplication creates a channel for an application with its identity.
+func (ids *Identities) RegisterApplication(a *model.Application, u *model.User) (string, error) {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return "", err
+	}
+
+	return d.RegisterApplication(a, u)
+}
+
+// DeregisterApplication deletes the channel of an application with its identity.
+func (ids *Identities) DeregisterApplication(a *model.Application, u *model.User) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.DeregisterApplication(a, u)
+}
+
+// UpdateApplication updates the channel of an application with its identity.
+func (ids *Identities) UpdateApplication(a *model.Application, behavior *configuration.RepairBehavior) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.UpdateApplication(a, behavior)
+}
+
+// IsOrphan checks with its identity if the user is still connected to the channel of an application.
+func (ids *Identities) IsOrphan(a *model.Application, u *model.User) (bool, error) {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return false, err
+	}
+
+	return d.IsOrphan(a, u)
+}
+
+// RepairApplication re-invites the user to the channel of an application with its identity.
+func (ids *Identities) RepairApplication(a *model.Application, u *model.User) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.RepairApplication(a, u)
+}
+
+// SendNotification sends a notification with the identity of the application.
+func (ids *Identities) SendNotification(a *model.Application, n *model.Notification) (string, error) {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return "", err
+	}
+
+	return d.SendNotification(a, n)
+}
+
+// UpdateNotification replaces a notification with the identity of the application.
+func (ids *Identities) UpdateNotification(a *model.Application, n *model.Notification, roomID string) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.UpdateNotification(a, n, roomID)
+}
+
+// DeleteNotification deletes a notification with the identity of the application.
+func (ids *Identities) DeleteNotification(a *model.Application, n *model.DeleteNotification) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.DeleteNotification(a, n)
+}
+
+// SendNotice sends a notice to the channel of an application with its identity.
+func (ids *Identities) SendNotice(a *model.Application, text string) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.SendNotice(a, text)
+}
+
+// InviteSubscriber invites a subscriber to the channel of an application with its identity.
+func (ids *Identities) InviteSubscriber(a *model.Application, matrixID string) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.InviteSubscriber(a, matrixID)
+}
+
+// RemoveSubscriber removes a subscriber from the channel of an application with its identity.
+func (ids *Identities) RemoveSubscriber(a *model.Application, matrixID string) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.RemoveSubscriber(a, matrixID)
+}
+
+// JoinAsPuppet lets the virtual user of an application join a room with its identity.
+func (ids *Identities) JoinAsPuppet(a *model.Application, roomID string) error {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return err
+	}
+
+	return d.JoinAsPuppet(a, roomID)
+}
+
+// UploadAvatar stores the image of an application with its identity.
+func (ids *Identities) UploadAvatar(a *model.Application, data []byte, contentType string) (string, error) {
+	d, err := ids.Get(a.MatrixIdentity)
+	if err != nil {
+		return "", err
+	}
+
+	return d.UploadAvatar(a, data, contentType)
+}
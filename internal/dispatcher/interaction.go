@@ -0,0 +1,122 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	mId "maunium.net/go/mautrix/id"
+
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+// ListenForInteractions syncs with the homeserver and passes replies and reactions to notifications as well as commands to the handler.
+// Interactions that happened before calling this function are ignored.
+func (d *Dispatcher) ListenForInteractions(handler func(i *model.Interaction)) error {
+	syncer, ok := d.mautrixClient.Syncer.(mautrix.ExtensibleSyncer)
+	if !ok {
+		return errors.New("syncer does not support event handlers")
+	}
+
+	log.L.Println("Listening for replies and reactions to notifications.")
+
+	since := time.Now()
+
+	syncer.OnEventType(event.EventMessage, func(_ context.Context, evt *event.Event) {
+		if i := d.messageInteraction(evt, since); i != nil {
+			handler(i)
+		}
+	})
+
+	syncer.OnEventType(event.EventReaction, func(_ context.Context, evt *event.Event) {
+		if i := d.reactionInteraction(evt, since); i != nil {
+			handler(i)
+		}
+	})
+
+	d.startSync()
+
+	return nil
+}
+
+// Checks if an event was sent by a user, not by PushBits or the virtual user of an application, after the given point in time
+func (d *Dispatcher) isNewForeignEvent(evt *event.Event, since time.Time) bool {
+	return evt.Sender != d.mautrixClient.UserID && !d.isPuppet(evt.Sender) && !time.UnixMilli(evt.Timestamp).Before(since)
+}
+
+// Turns a message into a reply to a notification or into a command, depending on whether it refers to another event
+func (d *Dispatcher) messageInteraction(evt *event.Event, since time.Time) *model.Interaction {
+	if !d.isNewForeignEvent(evt, since) {
+		return nil
+	}
+
+	content := evt.Content.AsMessage()
+	if content.RelatesTo.GetReplaceID() != "" {
+		return nil
+	}
+
+	target := content.RelatesTo.GetNonFallbackReplyTo()
+	if target == "" {
+		if !strings.HasPrefix(content.Body, "!") {
+			return nil
+		}
+
+		return &model.Interaction{
+			Type:    model.InteractionCommand,
+			RoomID:  evt.RoomID.String(),
+			EventID: evt.ID.String(),
+			Sender:  evt.Sender.String(),
+			Content: strings.TrimSpace(content.Body),
+			Date:    time.UnixMilli(evt.Timestamp),
+		}
+	}
+
+	content.RemoveReplyFallback()
+
+	return &model.Interaction{
+		Type:          model.InteractionReply,
+		RoomID:        evt.RoomID.String(),
+		EventID:       evt.ID.String(),
+		TargetEventID: target.String(),
+		Sender:        evt.Sender.String(),
+		Content:       content.Body,
+		Date:          time.UnixMilli(evt.Timestamp),
+	}
+}
+
+func (d *Dispatcher) reactionInteraction(evt *event.Event, since time.Time) *model.Interaction {
+	if !d.isNewForeignEvent(evt, since) {
+		return nil
+	}
+
+	content := evt.Content.AsReaction()
+
+	target := content.RelatesTo.GetAnnotationID()
+	if target == "" {
+		return nil
+	}
+
+	return &model.Interaction{
+		Type:          model.InteractionReaction,
+		RoomID:        evt.RoomID.String(),
+		EventID:       evt.ID.String(),
+		TargetEventID: target.String(),
+		Sender:        evt.Sender.String(),
+		Content:       content.RelatesTo.GetAnnotationKey(),
+		Date:          time.UnixMilli(evt.Timestamp),
+	}
+}
+
+// SendNotice sends a notice with the given text to the channel of an application, for example to respond to a command.
+func (d *Dispatcher) SendNotice(a *model.Application, text string) error {
+	_, err := d.mautrixClient.SendMessageEvent(context.Background(), mId.RoomID(a.MatrixID), event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	})
+
+	return err
+}
@@ -2,15 +2,19 @@ package dispatcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gomarkdown/markdown"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	mId "maunium.net/go/mautrix/id"
 
+	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/log"
 	"github.com/pushbits/server/internal/model"
 	"github.com/pushbits/server/internal/pberrors"
@@ -57,6 +61,7 @@ type MsgType string
 const (
 	MessageFormatHTML = MessageFormat("org.matrix.custom.html")
 	MsgTypeText       = MsgType("m.text")
+	MsgTypeNotice     = MsgType("m.notice")
 )
 
 // MessageEvent is the content of a matrix message event
@@ -67,6 +72,13 @@ type MessageEvent struct {
 	RelatesTo     *RelatesTo    `json:"m.relates_to,omitempty"`
 	Format        MessageFormat `json:"format"`
 	NewContent    *NewContent   `json:"m.new_content,omitempty"`
+	Mentions      *Mentions     `json:"m.mentions,omitempty"`
+}
+
+// Mentions holds the users and rooms a message event intentionally mentions, see https://spec.matrix.org/latest/client-server-api/#user-and-room-mentions
+type Mentions struct {
+	UserIDs []string `json:"user_ids,omitempty"`
+	Room    bool     `json:"room,omitempty"`
 }
 
 // RelatesTo holds information about relations to other message events
@@ -88,38 +100,108 @@ type NewContent struct {
 func (d *Dispatcher) SendNotification(a *model.Application, n *model.Notification) (eventID string, err error) {
 	log.L.Printf("Sending notification to room %s.", a.MatrixID)
 
-	plainMessage := strings.TrimSpace(n.Message)
-	plainTitle := strings.TrimSpace(n.Title)
-	message := d.getFormattedMessage(n)
-	title := d.getFormattedTitle(n) // Does not append <br /><br /> anymore
-
-	text := fmt.Sprintf("%s\n\n%s", plainTitle, plainMessage)
-	formattedText := fmt.Sprintf("%s<br /><br />%s", title, message) // Append <br /><br /> here
+	n = applyTemplates(a, n)
+	text, formattedText := d.getBodies(n)
 
 	messageEvent := &MessageEvent{
 		Body:          text,
 		FormattedBody: formattedText,
-		MsgType:       MsgTypeText,
+		MsgType:       d.msgType(n),
 		Format:        MessageFormatHTML,
 	}
 
-	evt, err := d.mautrixClient.SendMessageEvent(context.Background(), mId.RoomID(a.MatrixID), event.EventMessage, &messageEvent)
+	// Notifications silenced by quiet hours never mention anyone.
+	if !n.Silent {
+		d.addMention(messageEvent, a, d.formatting.PriorityBand(n.Priority).Mention)
+	}
+
+	evt, err := d.sender(a).SendMessageEvent(context.Background(), mId.RoomID(a.MatrixID), event.EventMessage, &messageEvent)
 	if err != nil {
 		log.L.Errorln(err)
-		return "", err
+		return "", rateLimitError(err)
 	}
 
 	return evt.EventID.String(), nil
 }
 
+// Returns the msgtype to send a notification with.
+// Clients do not notify about notices by default, so notifications of priority bands sent as notices and silenced ones are notices.
+func (d *Dispatcher) msgType(n *model.Notification) MsgType {
+	if n.Silent || d.formatting.PriorityBand(n.Priority).MsgType == configuration.MsgTypeNotice {
+		return MsgTypeNotice
+	}
+
+	return MsgTypeText
+}
+
+// Renders the notification with the templates of the application.
+// Digests summarize several notifications and are sent as they are, and a template that fails leaves the notification unchanged.
+func applyTemplates(a *model.Application, n *model.Notification) *model.Notification {
+	if !a.HasTemplates() || n.Digest {
+		return n
+	}
+
+	rendered, err := a.RenderTemplates(n)
+	if err != nil {
+		log.L.Printf("Cannot render templates of application %s: %s", a.Name, err)
+		return n
+	}
+
+	return rendered
+}
+
+// Converts a M_LIMIT_EXCEEDED response into an error that carries the delay requested by the homeserver
+func rateLimitError(err error) error {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || httpErr.RespError.ErrCode != mautrix.MLimitExceeded.ErrCode {
+		return err
+	}
+
+	var retryAfter time.Duration
+	if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+		retryAfter = time.Duration(ms) * time.Millisecond
+	}
+
+	return &pberrors.RetryAfterError{RetryAfter: retryAfter, Err: err}
+}
+
+// UpdateNotification replaces the content of a notification that was already sent.
+// If the room of the notification is not known, the room history of the application is searched for it.
+func (d *Dispatcher) UpdateNotification(a *model.Application, n *model.Notification, roomID string) error {
+	if roomID == "" {
+		message, err := d.getMessage(a, n.ID)
+		if err != nil {
+			log.L.Println(err)
+			return pberrors.ErrMessageNotFound
+		}
+
+		roomID = message.RoomID.String()
+	}
+
+	log.L.Printf("Updating notification %s in room %s.", n.ID, roomID)
+
+	n = applyTemplates(a, n)
+	text, formattedText := d.getBodies(n)
+
+	// Clients that do not support edits display the fallback, see https://spec.matrix.org/latest/client-server-api/#event-replacements
+	_, err := d.replaceMessage(d.sender(a), roomID, d.msgType(n), text, formattedText, n.ID, "* "+text, "* "+formattedText)
+
+	return rateLimitError(err)
+}
+
 // DeleteNotification sends a notification to a given user that another notification is deleted
+// If the deletion asks for redaction, the notification is redacted instead.
 func (d *Dispatcher) DeleteNotification(a *model.Application, n *model.DeleteNotification) error {
+	if n.Redact {
+		return d.redactNotification(a, n)
+	}
+
 	log.L.Printf("Sending delete notification to room %s", a.MatrixID)
 	var oldFormattedBody string
 	var oldBody string
 
 	// Get the message we want to delete
-	deleteMessage, err := d.getMessage(a, n.ID)
+	deleteMessage, err := d.findMessage(a, n)
 	if err != nil {
 		log.L.Println(err)
 		return pberrors.ErrMessageNotFound
@@ -130,20 +212,107 @@ func (d *Dispatcher) DeleteNotification(a *model.Application, n *model.DeleteNot
 		return err
 	}
 
+	// Deleting a notice does not notify either.
+	msgType := MsgTypeText
+	if content := deleteMessage.Content.AsMessage(); content != nil && content.MsgType == event.MsgNotice {
+		msgType = MsgTypeNotice
+	}
+
 	// Update the message with strikethrough
 	newBody := fmt.Sprintf("<del>%s</del>\n- deleted", oldBody)
 	newFormattedBody := fmt.Sprintf("<del>%s</del><br>- deleted", oldFormattedBody)
 
-	_, err = d.replaceMessage(a, newBody, newFormattedBody, deleteMessage.ID.String(), oldBody, oldFormattedBody)
+	_, err = d.replaceMessage(d.sender(a), deleteMessage.RoomID.String(), msgType, newBody, newFormattedBody, deleteMessage.ID.String(), oldBody, oldFormattedBody)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.respondToMessage(a, "This message got deleted", "<i>This message got deleted.</i>", deleteMessage)
+	_, err = d.respondToMessage(d.sender(a), msgType, "This message got deleted", "<i>This message got deleted.</i>", deleteMessage)
 
 	return err
 }
 
+// Removes the content of a notification from the room with a redaction event
+func (d *Dispatcher) redactNotification(a *model.Application, n *model.DeleteNotification) error {
+	roomID := n.RoomID
+	if roomID == "" {
+		message, err := d.getMessage(a, n.ID)
+		if err != nil {
+			log.L.Println(err)
+			return pberrors.ErrMessageNotFound
+		}
+
+		roomID = message.RoomID.String()
+	}
+
+	reason := n.Reason
+	if reason == "" {
+		reason = "Notification deleted"
+	}
+
+	log.L.Printf("Redacting notification %s in room %s.", n.ID, roomID)
+
+	// Edits keep the content of earlier versions on the homeserver, so they are redacted as well.
+	edits, err := d.getEdits(roomID, n.ID)
+	if err != nil {
+		log.L.Printf("Cannot look up edits of notification %s, only redacting the original: %s", n.ID, err)
+	}
+
+	client := d.sender(a)
+
+	for _, edit := range edits {
+		if _, err := client.RedactEvent(context.Background(), mId.RoomID(roomID), edit, mautrix.ReqRedact{Reason: reason}); err != nil {
+			log.L.Printf("Cannot redact edit %s of notification %s: %s", edit, n.ID, err)
+		}
+	}
+
+	_, err = client.RedactEvent(context.Background(), mId.RoomID(roomID), mId.EventID(n.ID), mautrix.ReqRedact{Reason: reason})
+
+	return rateLimitError(err)
+}
+
+// Returns the IDs of the events that replaced the content of a message, following the pages of the relations until the last one
+func (d *Dispatcher) getEdits(roomID, messageID string) ([]mId.EventID, error) {
+	edits := make([]mId.EventID, 0)
+	query := map[string]string{"limit": "100"}
+
+	for {
+		var resp struct {
+			Chunk     []*event.Event `json:"chunk"`
+			NextBatch string         `json:"next_batch"`
+		}
+
+		urlPath := d.mautrixClient.BuildURLWithQuery(mautrix.ClientURLPath{"v1", "rooms", roomID, "relations", messageID, "m.replace"}, query)
+		if _, err := d.mautrixClient.MakeRequest(context.Background(), http.MethodGet, urlPath, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, edit := range resp.Chunk {
+			edits = append(edits, edit.ID)
+		}
+
+		// Homeservers that hand out the same token again would otherwise be asked forever.
+		if resp.NextBatch == "" || resp.NextBatch == query["from"] {
+			return edits, nil
+		}
+
+		query["from"] = resp.NextBatch
+	}
+}
+
+// Builds the plain and the HTML-formatted body of a notification
+func (d *Dispatcher) getBodies(n *model.Notification) (text, formattedText string) {
+	plainMessage := strings.TrimSpace(n.Message)
+	plainTitle := strings.TrimSpace(n.Title)
+	message := d.getFormattedMessage(n)
+	title := d.getFormattedTitle(n) // Does not append <br /><br /> anymore
+
+	text = fmt.Sprintf("%s\n\n%s", plainTitle, plainMessage)
+	formattedText = fmt.Sprintf("%s<br /><br />%s", title, message) // Append <br /><br /> here
+
+	return text, formattedText
+}
+
 // HTML-formats the title
 func (d *Dispatcher) getFormattedTitle(n *model.Notification) string {
 	trimmedTitle := strings.TrimSpace(n.Title)
@@ -189,20 +358,47 @@ func (d *Dispatcher) getFormattedMessage(n *model.Notification) string {
 
 // Maps priorities to hex colors
 func (d *Dispatcher) priorityToColor(prio int) string {
-	switch {
-	case prio < 0:
-		return "#828282"
-	case prio <= 3: // info - default color
-		return ""
-	case prio <= 10: // low - yellow
-		return "#edd711"
-	case prio <= 20: // mid - orange
-		return "#ed6d11"
-	case prio > 20: // high - red
-		return "#ed1f11"
-	}
-
-	return ""
+	return d.formatting.PriorityBand(prio).Color
+}
+
+// Mentions the owner of the application or the whole room, so that clients notify even if the room is muted for regular messages
+func (d *Dispatcher) addMention(evt *MessageEvent, a *model.Application, mention string) {
+	switch mention {
+	case configuration.MentionRoom:
+		withMentions(evt, nil, true)
+	case configuration.MentionOwner:
+		// Subscribers and other members of the room are not the owner, so only the Matrix ID of the owner is mentioned.
+		owner, err := d.db.GetUserByID(a.UserID)
+		if err != nil || owner == nil {
+			log.L.Printf("Cannot look up the owner of application %s, sending without mention: %v", a.Name, err)
+			return
+		}
+
+		withMentions(evt, []string{owner.MatrixID}, false)
+	}
+}
+
+// Adds mentions to a message event and prefixes its bodies with them, as clients only highlight mentions that are part of the text
+func withMentions(evt *MessageEvent, userIDs []string, room bool) {
+	if len(userIDs) == 0 && !room {
+		return
+	}
+
+	evt.Mentions = &Mentions{UserIDs: userIDs, Room: room}
+
+	var text, formattedText []string
+	if room {
+		text = append(text, "@room")
+		formattedText = append(formattedText, "@room")
+	}
+
+	for _, userID := range userIDs {
+		text = append(text, userID)
+		formattedText = append(formattedText, fmt.Sprintf("<a href='https://matrix.to/#/%s'>%s</a>", userID, html.EscapeString(userID)))
+	}
+
+	evt.Body = strings.Join(text, " ") + ": " + evt.Body
+	evt.FormattedBody = strings.Join(formattedText, " ") + ": " + evt.FormattedBody
 }
 
 // Maps a priority to a color tag
@@ -214,35 +410,60 @@ func (d *Dispatcher) coloredText(color string, text string) string {
 	return "<font data-mx-color='" + color + "'>" + text + "</font>"
 }
 
-// Searches in the messages list for the given id
+// Fetches the message directly if the room it was sent to is known, and searches the room history otherwise
+func (d *Dispatcher) findMessage(a *model.Application, n *model.DeleteNotification) (*event.Event, error) {
+	if n.RoomID == "" {
+		return d.getMessage(a, n.ID)
+	}
+
+	message, err := d.mautrixClient.GetEvent(context.Background(), mId.RoomID(n.RoomID), mId.EventID(n.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	if message.RoomID == "" {
+		message.RoomID = mId.RoomID(n.RoomID)
+	}
+
+	return d.decryptMessage(message)
+}
+
+// Searches in the messages list for the given id, used for messages sent before event mappings were recorded
 func (d *Dispatcher) getMessage(a *model.Application, id string) (*event.Event, error) {
 	start := ""
 	end := ""
-	maxPages := 10 // Maximum pages to request (10 messages per page)
 
-	for i := 0; i < maxPages; i++ {
-		messages, err := d.mautrixClient.Messages(context.Background(), mId.RoomID(a.MatrixID), start, end, 'b', nil, 10)
+	for i := 0; i < d.historyScan.MaxPages; i++ {
+		messages, err := d.mautrixClient.Messages(context.Background(), mId.RoomID(a.MatrixID), start, end, 'b', nil, d.historyScan.PageSize)
 		if err != nil {
 			return nil, err
 		}
 
 		for _, event := range messages.Chunk {
 			if event.ID.String() == id {
-				return event, nil
+				if event.RoomID == "" {
+					event.RoomID = mId.RoomID(a.MatrixID)
+				}
+
+				return d.decryptMessage(event)
 			}
 		}
+
+		if messages.End == "" {
+			break
+		}
 		start = messages.End
 	}
 
 	return nil, pberrors.ErrMessageNotFound
 }
 
-// Replaces the content of a matrix message
-func (d *Dispatcher) replaceMessage(a *model.Application, newBody, newFormattedBody string, messageID string, oldBody, oldFormattedBody string) (*mautrix.RespSendEvent, error) {
+// Replaces the content of a matrix message, which only the sender of the message can do
+func (d *Dispatcher) replaceMessage(client *mautrix.Client, roomID string, msgType MsgType, newBody, newFormattedBody string, messageID string, oldBody, oldFormattedBody string) (*mautrix.RespSendEvent, error) {
 	newMessage := NewContent{
 		Body:          newBody,
 		FormattedBody: newFormattedBody,
-		MsgType:       MsgTypeText,
+		MsgType:       msgType,
 		Format:        MessageFormatHTML,
 	}
 
@@ -254,13 +475,13 @@ func (d *Dispatcher) replaceMessage(a *model.Application, newBody, newFormattedB
 	replaceEvent := MessageEvent{
 		Body:          oldBody,
 		FormattedBody: oldFormattedBody,
-		MsgType:       MsgTypeText,
+		MsgType:       msgType,
 		NewContent:    &newMessage,
 		RelatesTo:     &replaceRelation,
 		Format:        MessageFormatHTML,
 	}
 
-	sendEvent, err := d.mautrixClient.SendMessageEvent(context.Background(), mId.RoomID(a.MatrixID), event.EventMessage, &replaceEvent)
+	sendEvent, err := client.SendMessageEvent(context.Background(), mId.RoomID(roomID), event.EventMessage, &replaceEvent)
 	if err != nil {
 		log.L.Errorln(err)
 		return nil, err
@@ -270,7 +491,7 @@ func (d *Dispatcher) replaceMessage(a *model.Application, newBody, newFormattedB
 }
 
 // Sends a notification in response to another matrix message event
-func (d *Dispatcher) respondToMessage(a *model.Application, body, formattedBody string, respondMessage *event.Event) (*mautrix.RespSendEvent, error) {
+func (d *Dispatcher) respondToMessage(client *mautrix.Client, msgType MsgType, body, formattedBody string, respondMessage *event.Event) (*mautrix.RespSendEvent, error) {
 	oldBody, oldFormattedBody, err := bodiesFromMessage(respondMessage)
 	if err != nil {
 		return nil, err
@@ -283,7 +504,7 @@ func (d *Dispatcher) respondToMessage(a *model.Application, body, formattedBody
 	notificationEvent := MessageEvent{
 		FormattedBody: newFormattedBody,
 		Body:          newBody,
-		MsgType:       MsgTypeText,
+		MsgType:       msgType,
 		Format:        MessageFormatHTML,
 	}
 
@@ -295,7 +516,7 @@ func (d *Dispatcher) respondToMessage(a *model.Application, body, formattedBody
 	}
 	notificationEvent.RelatesTo = &notificationRelation
 
-	sendEvent, err := d.mautrixClient.SendMessageEvent(context.Background(), mId.RoomID(a.MatrixID), event.EventMessage, &notificationEvent)
+	sendEvent, err := client.SendMessageEvent(context.Background(), respondMessage.RoomID, event.EventMessage, &notificationEvent)
 	if err != nil {
 		log.L.Errorln(err)
 		return nil, err
@@ -306,6 +527,12 @@ func (d *Dispatcher) respondToMessage(a *model.Application, body, formattedBody
 
 // Extracts body and formatted body from a matrix message event
 func bodiesFromMessage(message *event.Event) (body, formattedBody string, err error) {
+	if message.Content.Parsed == nil {
+		if err := message.Content.ParseRaw(message.Type); err != nil {
+			return "", "", err
+		}
+	}
+
 	msgContent := message.Content.AsMessage()
 	if msgContent == nil {
 		return "", "", pberrors.ErrMessageNotFound
@@ -0,0 +1,200 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+)
+
+func TestDispatcher_PriorityBand(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &Dispatcher{formatting: configuration.Formatting{PriorityBands: []configuration.PriorityBand{
+		{Min: 0, MsgType: configuration.MsgTypeNotice},
+		{Min: 4, MsgType: configuration.MsgTypeText},
+		{Min: 8, MsgType: configuration.MsgTypeText, Mention: configuration.MentionOwner, Color: "#ed1f11"},
+	}}}
+
+	assert.Equal(configuration.MsgTypeNotice, d.formatting.PriorityBand(-5).MsgType, "Priorities below the lowest band should use it")
+	assert.Equal(configuration.MsgTypeNotice, d.formatting.PriorityBand(3).MsgType)
+	assert.Equal(configuration.MsgTypeText, d.formatting.PriorityBand(4).MsgType)
+	assert.Equal(configuration.MentionOwner, d.formatting.PriorityBand(20).Mention)
+	assert.Equal("#ed1f11", d.priorityToColor(8))
+
+	d = &Dispatcher{}
+	assert.Equal("#828282", d.priorityToColor(-1), "Default bands should keep the previous colors")
+	assert.Equal("", d.priorityToColor(3))
+	assert.Equal("#edd711", d.priorityToColor(10))
+	assert.Equal("#ed6d11", d.priorityToColor(20))
+	assert.Equal("#ed1f11", d.priorityToColor(21))
+}
+
+func TestDispatcher_WithMentions(t *testing.T) {
+	assert := assert.New(t)
+
+	evt := &MessageEvent{Body: "Disk\n\nfull", FormattedBody: "<b>Disk</b><br /><br />full"}
+	withMentions(evt, []string{"@alice:example.com"}, false)
+
+	assert.Equal([]string{"@alice:example.com"}, evt.Mentions.UserIDs)
+	assert.Equal("@alice:example.com: Disk\n\nfull", evt.Body)
+	assert.Equal("<a href='https://matrix.to/#/@alice:example.com'>@alice:example.com</a>: <b>Disk</b><br /><br />full", evt.FormattedBody)
+
+	evt = &MessageEvent{Body: "Disk", FormattedBody: "Disk"}
+	withMentions(evt, nil, true)
+
+	assert.True(evt.Mentions.Room)
+	assert.Equal("@room: Disk", evt.Body)
+
+	evt = &MessageEvent{Body: "Disk"}
+	withMentions(evt, nil, false)
+	assert.Nil(evt.Mentions, "Messages without mentions should not carry an empty mentions object")
+}
+
+func TestDispatcher_AddMention(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &Dispatcher{db: &memoryDatabase{users: map[uint]*model.User{1: {ID: 1, MatrixID: "@alice:example.com"}}}}
+
+	evt := &MessageEvent{Body: "Disk", FormattedBody: "Disk"}
+	d.addMention(evt, &model.Application{Name: "backup", UserID: 1}, configuration.MentionOwner)
+	assert.Equal([]string{"@alice:example.com"}, evt.Mentions.UserIDs, "Only the owner should be mentioned, not other members of the room")
+	assert.False(evt.Mentions.Room)
+
+	evt = &MessageEvent{Body: "Disk", FormattedBody: "Disk"}
+	d.addMention(evt, &model.Application{Name: "deleted", UserID: 2}, configuration.MentionOwner)
+	assert.Nil(evt.Mentions, "Notifications should be sent without mention if the owner cannot be looked up")
+}
+
+func TestDispatcher_ApplyTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	n := &model.Notification{Title: "Backup", Message: "failed", Priority: 5, Extras: map[string]interface{}{"host": "db1"}}
+
+	a := &model.Application{Name: "cron"}
+	assert.Same(n, applyTemplates(a, n), "Applications without templates should send notifications as they are")
+
+	a = &model.Application{Name: "cron", TitleTemplate: "{{ .Application }}: {{ .Title }}", MessageTemplate: "{{ .Message }} on {{ .Extras.host }}"}
+	rendered := applyTemplates(a, n)
+	assert.Equal("cron: Backup", rendered.Title)
+	assert.Equal("failed on db1", rendered.Message)
+	assert.Equal("Backup", n.Title, "Rendering should not change the original notification")
+
+	digest := &model.Notification{Title: "Digest", Message: "3 notifications", Digest: true}
+	assert.Same(digest, applyTemplates(a, digest), "Digests should not be rendered")
+
+	a = &model.Application{Name: "cron", MessageTemplate: "{{ .Message | nonexistent }}"}
+	assert.Same(n, applyTemplates(a, n), "Failing templates should fall back to the notification")
+
+	a = &model.Application{Name: "cron", MessageTemplate: "<b>{{ .Message }}</b> {{ json .Extras }}", TemplateEngine: model.TemplateEngineHTML}
+	rendered = applyTemplates(a, n)
+	_, formattedText := (&Dispatcher{}).getBodies(rendered)
+	assert.Contains(formattedText, "<b>failed</b>")
+	assert.Equal(contentTypeHTML, getContentType(rendered.Extras))
+	assert.Equal(contentTypePlain, getContentType(n.Extras), "The extras of the original notification should not change")
+
+	rendered = applyTemplates(a, &model.Notification{Title: "Backup & <restore>", Message: "failed"})
+	_, formattedText = (&Dispatcher{}).getBodies(rendered)
+	assert.Contains(formattedText, "Backup &amp; &lt;restore&gt;", "Titles without a template should be escaped in HTML notifications")
+}
+
+// A homeserver that hands out the edits of a message in pages of two
+type relationsHomeserver struct {
+	fakeHomeserver
+	edits int
+}
+
+func (h *relationsHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/_matrix/client/v1/rooms/!ops:example.com/relations/$message/m.replace") {
+		h.fakeHomeserver.ServeHTTP(w, r)
+		return
+	}
+
+	from := 0
+	_, _ = fmt.Sscanf(r.URL.Query().Get("from"), "page%d", &from)
+
+	chunk := make([]string, 0, 2)
+	for i := from; i < from+2 && i < h.edits; i++ {
+		chunk = append(chunk, fmt.Sprintf(`{"event_id": "$edit%d", "type": "m.room.message", "content": {}}`, i))
+	}
+
+	next := ""
+	if from+2 < h.edits {
+		next = fmt.Sprintf(`, "next_batch": "page%d"`, from+2)
+	}
+
+	_, _ = fmt.Fprintf(w, `{"chunk": [%s]%s}`, strings.Join(chunk, ","), next)
+}
+
+func TestDispatcher_GetEdits(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &relationsHomeserver{fakeHomeserver: fakeHomeserver{validToken: "configured"}, edits: 5}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	d, err := Create(configuration.Matrix{Homeserver: server.URL, Username: "bot", AccessToken: "configured"}, &memoryDatabase{}, configuration.Formatting{}, configuration.HistoryScan{})
+	require.NoError(err)
+
+	edits, err := d.getEdits("!ops:example.com", "$message")
+	require.NoError(err)
+	assert.Len(edits, 5, "Edits on later pages of the relations should be found as well")
+	assert.Equal("$edit4", edits[4].String())
+}
+
+// A homeserver that records the content of the messages sent to it
+type eventsHomeserver struct {
+	fakeHomeserver
+	sent []map[string]interface{}
+}
+
+func (h *eventsHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.URL.Path, "/send/m.room.message/") {
+		h.fakeHomeserver.ServeHTTP(w, r)
+		return
+	}
+
+	var content map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&content)
+	h.sent = append(h.sent, content)
+
+	_, _ = w.Write([]byte(`{"event_id": "$edit"}`))
+}
+
+func TestDispatcher_UpdateNotificationMsgType(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	homeserver := &eventsHomeserver{fakeHomeserver: fakeHomeserver{validToken: "configured"}}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	formatting := configuration.Formatting{PriorityBands: []configuration.PriorityBand{
+		{Min: 0, MsgType: configuration.MsgTypeNotice},
+		{Min: 4, MsgType: configuration.MsgTypeText},
+	}}
+
+	d, err := Create(configuration.Matrix{Homeserver: server.URL, Username: "bot", AccessToken: "configured"}, &memoryDatabase{}, formatting, configuration.HistoryScan{})
+	require.NoError(err)
+
+	a := &model.Application{Name: "test", MatrixID: "!ops:example.com"}
+
+	require.NoError(d.UpdateNotification(a, &model.Notification{ID: "$message", Message: "low", Priority: 2}, "!ops:example.com"))
+	require.NoError(d.UpdateNotification(a, &model.Notification{ID: "$message", Message: "silent", Priority: 6, Silent: true}, "!ops:example.com"))
+	require.NoError(d.UpdateNotification(a, &model.Notification{ID: "$message", Message: "high", Priority: 6}, "!ops:example.com"))
+
+	require.Len(homeserver.sent, 3)
+	for i, msgType := range []string{"m.notice", "m.notice", "m.text"} {
+		assert.Equalf(msgType, homeserver.sent[i]["msgtype"], "Edit %d should be sent with the msgtype of its priority band", i)
+		assert.Equalf(msgType, homeserver.sent[i]["m.new_content"].(map[string]interface{})["msgtype"], "Edit %d should show the msgtype of its priority band", i)
+	}
+}
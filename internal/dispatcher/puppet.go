@@ -0,0 +1,151 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix"
+	mId "maunium.net/go/mautrix/id"
+
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+// The virtual user of an application, together with the room it joined
+type puppet struct {
+	client *mautrix.Client
+	roomID string
+}
+
+// Returns the Matrix ID of the virtual user of an application
+func (d *Dispatcher) puppetID(a *model.Application) mId.UserID {
+	return mId.NewUserID(d.settings.AppService.PuppetLocalpart(a.ID), d.mautrixClient.UserID.Homeserver())
+}
+
+// Checks whether a Matrix ID belongs to the virtual user of an application
+func (d *Dispatcher) isPuppet(userID mId.UserID) bool {
+	if !d.settings.AppService.Enabled || userID.Homeserver() != d.mautrixClient.UserID.Homeserver() {
+		return false
+	}
+
+	_, ok := d.settings.AppService.PuppetApplicationID(userID.String())
+
+	return ok
+}
+
+// Returns a client that acts as the given virtual user with the token of the application service
+func (d *Dispatcher) puppetClient(userID mId.UserID) (*mautrix.Client, error) {
+	client, err := mautrix.NewClient(d.settings.Homeserver, userID, d.settings.AppService.ASToken)
+	if err != nil {
+		return nil, err
+	}
+
+	client.SetAppServiceUserID = true
+
+	return client, nil
+}
+
+// Returns the client that sends to the channel of an application, which is its virtual user in application service mode.
+// If the virtual user cannot be set up, PushBits itself sends instead.
+func (d *Dispatcher) sender(a *model.Application) *mautrix.Client {
+	if !d.settings.AppService.Enabled {
+		return d.mautrixClient
+	}
+
+	if p, ok := d.puppets.Load(a.ID); ok && p.(*puppet).roomID == a.MatrixID {
+		return p.(*puppet).client
+	}
+
+	client, err := d.setUpPuppet(a)
+	if err != nil {
+		log.L.Printf("Cannot set up the virtual user of application %s, sending as %s instead: %s", a.Name, d.mautrixClient.UserID, err)
+		return d.mautrixClient
+	}
+
+	return client
+}
+
+// Registers the virtual user of an application, gives it the name and image of the application, and lets it join the channel
+func (d *Dispatcher) setUpPuppet(a *model.Application) (*mautrix.Client, error) {
+	userID := d.puppetID(a)
+
+	client, err := d.puppetClient(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = client.Register(context.Background(), &mautrix.ReqRegister{
+		Username:     userID.Localpart(),
+		Type:         mautrix.AuthTypeAppservice,
+		InhibitLogin: true,
+	})
+	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+		return nil, err
+	}
+
+	if err := client.SetDisplayName(context.Background(), a.Name); err != nil {
+		return nil, err
+	}
+
+	if a.Avatar != "" {
+		avatar, err := mId.ParseContentURI(a.Avatar)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := client.SetAvatarURL(context.Background(), avatar); err != nil {
+			return nil, err
+		}
+	}
+
+	// The virtual user might be a member of the room already, or might have been invited by someone else.
+	if _, err := d.mautrixClient.InviteUser(context.Background(), mId.RoomID(a.MatrixID), &mautrix.ReqInviteUser{UserID: userID}); err != nil {
+		log.L.Debugf("Cannot invite %s to room %s: %s", userID, a.MatrixID, err)
+	}
+
+	if _, err := client.JoinRoomByID(context.Background(), mId.RoomID(a.MatrixID)); err != nil {
+		return nil, err
+	}
+
+	log.L.Printf("Sending notifications of application %s as %s.", a.Name, userID)
+
+	d.puppets.Store(a.ID, &puppet{client: client, roomID: a.MatrixID})
+
+	return client, nil
+}
+
+// Lets the virtual user of an application leave its channel
+func (d *Dispatcher) removePuppet(a *model.Application) {
+	if !d.settings.AppService.Enabled {
+		return
+	}
+
+	d.puppets.Delete(a.ID)
+
+	client, err := d.puppetClient(d.puppetID(a))
+	if err != nil {
+		return
+	}
+
+	if _, err := client.LeaveRoom(context.Background(), mId.RoomID(a.MatrixID)); err != nil {
+		log.L.Debugf("Cannot remove the virtual user of application %s from room %s: %s", a.Name, a.MatrixID, err)
+	}
+}
+
+// JoinAsPuppet lets the virtual user of an application join a room it was invited to.
+func (d *Dispatcher) JoinAsPuppet(a *model.Application, roomID string) error {
+	if !d.settings.AppService.Enabled {
+		return errors.New("the application service mode is not enabled for this Matrix identity")
+	}
+
+	client, err := d.puppetClient(d.puppetID(a))
+	if err != nil {
+		return err
+	}
+
+	log.L.Printf("Joining room %s as the virtual user of application %s.", roomID, a.Name)
+
+	_, err = client.JoinRoomByID(context.Background(), mId.RoomID(roomID))
+
+	return err
+}
@@ -0,0 +1,161 @@
+// Package expiry provides a sweeper that deletes notifications once their expiry time has passed.
+package expiry
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+	GetExpiredStoredNotifications(now time.Time, limit int) ([]model.StoredNotification, error)
+	DeleteStoredNotification(n *model.StoredNotification) error
+}
+
+// The Dispatcher interface for deleting notifications.
+type Dispatcher interface {
+	DeleteNotification(a *model.Application, n *model.DeleteNotification) error
+}
+
+const batchSize = 50
+
+// Sweeper holds information for deleting expired notifications.
+type Sweeper struct {
+	db       Database
+	dp       Dispatcher
+	settings configuration.Expiry
+	now      func() time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	started  atomic.Bool
+	stopOnce sync.Once
+}
+
+// Create instanciates a sweeper for expired notifications.
+func Create(db Database, dp Dispatcher, settings configuration.Expiry) *Sweeper {
+	return &Sweeper{
+		db:       db,
+		dp:       dp,
+		settings: settings,
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start launches the background deletion of expired notifications, beginning with those that expired while PushBits was not running.
+func (s *Sweeper) Start() {
+	log.L.Printf("Starting expiry sweeper with an interval of %s.", s.settings.SweepInterval)
+
+	s.started.Store(true)
+	go s.run()
+}
+
+// Close stops the background deletion and waits for a running sweep to finish.
+func (s *Sweeper) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.started.Load() {
+			<-s.done
+		}
+	})
+}
+
+func (s *Sweeper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.settings.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		s.sweep()
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deletes all notifications that are expired right now
+func (s *Sweeper) sweep() {
+	for {
+		expired, err := s.db.GetExpiredStoredNotifications(s.now(), batchSize)
+		if err != nil {
+			log.L.Printf("Cannot fetch expired notifications: %s", err)
+			return
+		}
+
+		removed := 0
+		for i := range expired {
+			if s.expire(&expired[i]) {
+				removed++
+			}
+		}
+
+		// Notifications that could not be deleted are retried with the next sweep.
+		if len(expired) < batchSize || removed == 0 {
+			return
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+}
+
+// Deletes an expired notification and removes it from the message history, returning false if it should be retried later
+func (s *Sweeper) expire(n *model.StoredNotification) bool {
+	application, err := s.db.GetApplicationByID(n.ApplicationID)
+	if err != nil || application == nil {
+		return s.remove(n)
+	}
+
+	// Suppressed notifications were never sent, so they only need to be removed from the history.
+	if n.EventID != "" {
+		mode := n.ExpiryMode
+		if mode == "" {
+			mode = s.settings.Mode
+		}
+
+		err = s.dp.DeleteNotification(application, &model.DeleteNotification{
+			ID:     n.EventID,
+			Date:   s.now(),
+			RoomID: n.RoomID,
+			Redact: mode == model.ExpiryModeRedact,
+			Reason: "Notification expired",
+		})
+
+		switch {
+		case errors.Is(err, pberrors.ErrMessageNotFound), errors.Is(err, pberrors.ErrUnknownBackend):
+			log.L.Printf("Cannot delete expired notification %s of application %s anymore: %s", n.EventID, application.Name, err)
+		case err != nil:
+			log.L.Printf("Cannot delete expired notification %s of application %s, retrying later: %s", n.EventID, application.Name, err)
+			return false
+		default:
+			log.L.Printf("Deleted expired notification %s of application %s.", n.EventID, application.Name)
+		}
+	}
+
+	return s.remove(n)
+}
+
+func (s *Sweeper) remove(n *model.StoredNotification) bool {
+	if err := s.db.DeleteStoredNotification(n); err != nil {
+		log.L.Printf("Cannot remove expired notification %d from message history: %s", n.ID, err)
+		return false
+	}
+
+	return true
+}
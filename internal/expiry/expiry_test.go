@@ -0,0 +1,79 @@
+package expiry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+func store(db *mockups.MemoryDatabase, id uint, expiresIn int, mode string, now time.Time) {
+	notification := model.Notification{Message: "123456", ExpiresIn: expiresIn, ExpiryMode: mode, Date: now, ApplicationID: 1}
+	stored := model.NewStoredNotification(&notification, "!room:example.com", fmt.Sprintf("$event%d", id))
+	stored.ID = id
+	db.Stored = append(db.Stored, stored)
+}
+
+// Returns the IDs of the notifications left in the message history
+func storedIDs(db *mockups.MemoryDatabase) []uint {
+	ids := make([]uint, 0, len(db.Stored))
+	for _, n := range db.Stored {
+		ids = append(ids, n.ID)
+	}
+	return ids
+}
+
+func TestExpiry_Sweep(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	dp := &mockups.RecordingDispatcher{}
+
+	store(db, 1, 60, "", now)
+	store(db, 2, 60, model.ExpiryModeRedact, now)
+	store(db, 3, 3600, "", now)
+	store(db, 4, 0, "", now)
+
+	s := Create(db, dp, configuration.Expiry{SweepInterval: time.Minute, Mode: model.ExpiryModeStrikethrough})
+	s.now = func() time.Time { return now.Add(2 * time.Minute) }
+	s.sweep()
+
+	assert.Len(dp.Deleted, 2)
+	for _, deleted := range dp.Deleted {
+		assert.Equal("!room:example.com", deleted.RoomID)
+		assert.Equal(deleted.ID == "$event2", deleted.Redact, "Only the notification asking for redaction should be redacted")
+	}
+
+	assert.NotContains(storedIDs(db), uint(1))
+	assert.NotContains(storedIDs(db), uint(2))
+	assert.Contains(storedIDs(db), uint(3), "Notification should be kept until it expires")
+	assert.Contains(storedIDs(db), uint(4), "Notification without expiry should be kept")
+}
+
+func TestExpiry_Retry(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	dp := &mockups.RecordingDispatcher{Err: errors.New("homeserver unavailable")}
+
+	store(db, 1, 60, "", now)
+
+	s := Create(db, dp, configuration.Expiry{SweepInterval: time.Minute})
+	s.now = func() time.Time { return now.Add(2 * time.Minute) }
+
+	s.sweep()
+	assert.Contains(storedIDs(db), uint(1), "Notification should be kept for the next sweep")
+
+	dp.Err = pberrors.ErrMessageNotFound
+	s.sweep()
+	assert.NotContains(storedIDs(db), uint(1), "Notification that does not exist anymore should be removed from the history")
+}
@@ -1,6 +1,12 @@
 package model
 
-import "strings"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
 
 // AlertmanagerWebhook is used to pass notifications over webhook pushes.
 type AlertmanagerWebhook struct {
@@ -21,6 +27,56 @@ type AlertmanagerAlert struct {
 	StartsAt    string            `json:"startsAt"`
 	EndsAt      string            `json:"endsAt"`
 	Status      string            `json:"status"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// Alert states as reported by Alertmanager.
+const (
+	AlertStatusFiring   = "firing"
+	AlertStatusResolved = "resolved"
+)
+
+// MaxFingerprintLength is the longest fingerprint that is tracked as it is.
+const MaxFingerprintLength = 64
+
+// TrackedAlert holds the state of an alert and the message it was last reported with.
+type TrackedAlert struct {
+	ID            uint   `gorm:"AUTO_INCREMENT;primary_key"`
+	ApplicationID uint   `gorm:"uniqueIndex:idx_tracked_alert"`
+	Fingerprint   string `gorm:"type:string;size:64;uniqueIndex:idx_tracked_alert"`
+	Status        string `gorm:"type:string;size:16"`
+	EventID       string `gorm:"type:string"`
+	QueueID       uint
+	UpdatedAt     time.Time
+}
+
+// GetFingerprint returns the fingerprint sent by Alertmanager or, if there is none, a hash of the alert's labels.
+// Fingerprints longer than MaxFingerprintLength are hashed, so that they fit into the tracked alerts.
+func (alert *AlertmanagerAlert) GetFingerprint() string {
+	if len(alert.Fingerprint) > MaxFingerprintLength {
+		hash := sha256.Sum256([]byte(alert.Fingerprint))
+		return hex.EncodeToString(hash[:])
+	}
+
+	if alert.Fingerprint != "" {
+		return alert.Fingerprint
+	}
+
+	names := make([]string, 0, len(alert.Labels))
+	for name := range alert.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(alert.Labels[name]))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:16]
 }
 
 // ToNotification converts an Alertmanager alert into a Notification
@@ -29,9 +85,9 @@ func (alert *AlertmanagerAlert) ToNotification(titleAnnotation, messageAnnotatio
 	message := strings.Builder{}
 
 	switch alert.Status {
-	case "firing":
+	case AlertStatusFiring:
 		title.WriteString("[FIR] ")
-	case "resolved":
+	case AlertStatusResolved:
 		title.WriteString("[RES] ")
 	}
 	message.WriteString("STATUS: ")
@@ -1,5 +1,15 @@
 package model
 
+import "time"
+
+// Names of the backends an application can be bound to.
+const (
+	BackendMatrix  = "matrix"
+	BackendSMTP    = "smtp"
+	BackendWebhook = "webhook"
+	BackendLog     = "log"
+)
+
 // Application holds information like the name, the token, and the associated user of an application.
 type Application struct {
 	ID       uint   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
@@ -7,17 +17,80 @@ type Application struct {
 	UserID   uint   `json:"-"`
 	Name     string `gorm:"type:string" json:"name"`
 	MatrixID string `gorm:"type:string" json:"-"`
+	Backend  string `gorm:"type:string;size:32;default:matrix" json:"backend"`
+	// The mxc URI of the image of the application, which is used as the avatar of its channel.
+	Avatar string `gorm:"type:string" json:"avatar,omitempty"`
+	// The ID or alias of an existing room the notifications are posted to, empty if PushBits created the channel.
+	Room string `gorm:"type:string" json:"room_id,omitempty"`
+	// The name of the Matrix identity whose account owns the channel, empty for the default account.
+	MatrixIdentity string `gorm:"type:string;size:64" json:"matrix_identity,omitempty"`
+	Target         string `gorm:"type:string" json:"target,omitempty"`
+	// Replies and reactions to notifications are posted to this URL, signed with the callback secret.
+	CallbackURL    string `gorm:"type:string" json:"callback_url,omitempty"`
+	CallbackSecret string `gorm:"type:string;size:64" json:"callback_secret,omitempty"`
+	// Delivery state that can be changed with commands in the channel of the application.
+	Muted          bool       `gorm:"default:false" json:"muted"`
+	MutedUntil     *time.Time `json:"muted_until,omitempty"`
+	MinPriority    int        `gorm:"default:0" json:"min_priority"`
+	TokenCreatedAt time.Time  `json:"-"`
+	// Deleted notifications are redacted instead of being struck through, unless the request asks otherwise.
+	RedactOnDelete bool `gorm:"default:false" json:"redact_on_delete"`
+	// Notifications are collected and sent as one digest per interval in seconds, unless they reach the bypass priority.
+	DigestInterval       int `gorm:"default:0" json:"digest_interval"`
+	DigestBypassPriority int `gorm:"default:0" json:"digest_bypass_priority"`
+	// Title and message of notifications are rendered with these templates of the text or html engine, if they are not empty.
+	TitleTemplate   string `gorm:"type:text" json:"title_template,omitempty"`
+	MessageTemplate string `gorm:"type:text" json:"message_template,omitempty"`
+	TemplateEngine  string `gorm:"type:string;size:16" json:"template_engine,omitempty"`
+}
+
+// IsMuted checks whether notifications of the application are currently muted.
+func (a *Application) IsMuted(now time.Time) bool {
+	return a.Muted && (a.MutedUntil == nil || now.Before(*a.MutedUntil))
+}
+
+// Suppresses checks whether a notification should not be delivered because of the delivery state of the application.
+func (a *Application) Suppresses(n *Notification, now time.Time) bool {
+	return a.IsMuted(now) || n.Priority < a.MinPriority
+}
+
+// Batches checks whether a notification should be held back for the next digest of the application.
+// A bypass priority of zero or less means that all notifications are batched.
+func (a *Application) Batches(n *Notification) bool {
+	if a.DigestInterval <= 0 || n.Digest {
+		return false
+	}
+
+	return a.DigestBypassPriority <= 0 || n.Priority < a.DigestBypassPriority
+}
+
+// IsBoundToRoom checks whether the application posts to an existing room instead of a channel created for it.
+func (a *Application) IsBoundToRoom() bool {
+	return a.Room != ""
 }
 
 // CreateApplication is used to process queries for creating applications.
 type CreateApplication struct {
 	Name                string `form:"name" query:"name" json:"name" binding:"required"`
 	StrictCompatibility bool   `form:"strict_compatibility" query:"strict_compatibility" json:"strict_compatibility"`
+	Backend             string `form:"backend" query:"backend" json:"backend"`
+	Target              string `form:"target" query:"target" json:"target"`
+	MatrixIdentity      string `form:"matrix_identity" query:"matrix_identity" json:"matrix_identity"`
+	RoomID              string `form:"room_id" query:"room_id" json:"room_id"`
 }
 
 // UpdateApplication is used to process queries for updating applications.
 type UpdateApplication struct {
-	Name                *string `form:"new_name" query:"new_name" json:"new_name"`
-	RefreshToken        *bool   `form:"refresh_token" query:"refresh_token" json:"refresh_token"`
-	StrictCompatibility *bool   `form:"strict_compatibility" query:"strict_compatibility" json:"strict_compatibility"`
+	Name                  *string `form:"new_name" query:"new_name" json:"new_name"`
+	RefreshToken          *bool   `form:"refresh_token" query:"refresh_token" json:"refresh_token"`
+	StrictCompatibility   *bool   `form:"strict_compatibility" query:"strict_compatibility" json:"strict_compatibility"`
+	CallbackURL           *string `form:"callback_url" query:"callback_url" json:"callback_url"`
+	RefreshCallbackSecret *bool   `form:"refresh_callback_secret" query:"refresh_callback_secret" json:"refresh_callback_secret"`
+	RedactOnDelete        *bool   `form:"redact_on_delete" query:"redact_on_delete" json:"redact_on_delete"`
+	DigestInterval        *int    `form:"digest_interval" query:"digest_interval" json:"digest_interval"`
+	DigestBypassPriority  *int    `form:"digest_bypass_priority" query:"digest_bypass_priority" json:"digest_bypass_priority"`
+	RoomID                *string `form:"room_id" query:"room_id" json:"room_id"`
+	TitleTemplate         *string `form:"title_template" query:"title_template" json:"title_template"`
+	MessageTemplate       *string `form:"message_template" query:"message_template" json:"message_template"`
+	TemplateEngine        *string `form:"template_engine" query:"template_engine" json:"template_engine"`
 }
@@ -0,0 +1,14 @@
+package model
+
+// Client holds the token that a Gotify client of a user connects to the stream with.
+type Client struct {
+	ID     uint   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
+	Token  string `gorm:"type:string;size:64;unique" json:"token"`
+	UserID uint   `gorm:"index" json:"-"`
+	Name   string `gorm:"type:string" json:"name"`
+}
+
+// CreateClient is used to process queries for creating clients.
+type CreateClient struct {
+	Name string `form:"name" query:"name" json:"name" binding:"required"`
+}
@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// Types of interactions of users with notifications.
+const (
+	InteractionReply    = "reply"
+	InteractionReaction = "reaction"
+	InteractionCommand  = "command"
+)
+
+// Interaction holds information on a reply or a reaction of a user to a notification, or on a command sent to the channel of an application.
+type Interaction struct {
+	Type          string
+	RoomID        string
+	EventID       string
+	TargetEventID string
+	Sender        string
+	Content       string
+	Date          time.Time
+}
+
+// CallbackPayload is posted to the callback URL of an application when a user interacts with one of its notifications.
+type CallbackPayload struct {
+	Type          string             `json:"type"`
+	ApplicationID uint               `json:"appid"`
+	Message       StoredNotification `json:"message"`
+	Sender        string             `json:"sender"`
+	Content       string             `json:"content"`
+	EventID       string             `json:"event_id"`
+	Date          time.Time          `json:"date"`
+}
@@ -0,0 +1,63 @@
+package model
+
+import "time"
+
+// StoredNotification holds a notification that was sent, as listed in the message history.
+type StoredNotification struct {
+	ID            uint                   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
+	ApplicationID uint                   `gorm:"index" json:"appid"`
+	Message       string                 `json:"message"`
+	Title         string                 `json:"title"`
+	Priority      int                    `json:"priority"`
+	Extras        map[string]interface{} `gorm:"serializer:json" json:"extras,omitempty"`
+	Date          time.Time              `json:"date"`
+	EventID       string                 `gorm:"type:string;index" json:"event_id"`
+	RoomID        string                 `gorm:"type:string" json:"-"`
+	CollapseKey   string                 `gorm:"type:string;size:128;index" json:"collapse_key,omitempty"`
+	CollapseCount int                    `gorm:"default:1" json:"collapse_count,omitempty"`
+	ExpiresAt     *time.Time             `gorm:"index" json:"expires_at,omitempty"`
+	ExpiryMode    string                 `gorm:"type:string;size:16" json:"-"`
+}
+
+// TableName overrides the table name used for stored notifications.
+func (StoredNotification) TableName() string {
+	return "notifications"
+}
+
+// NewStoredNotification creates a history entry for a notification that was sent to a Matrix room as the given event.
+func NewStoredNotification(n *Notification, roomID, eventID string) *StoredNotification {
+	return &StoredNotification{
+		ApplicationID: n.ApplicationID,
+		Message:       n.Message,
+		Title:         n.Title,
+		Priority:      n.Priority,
+		Extras:        n.Extras,
+		Date:          n.Date,
+		EventID:       eventID,
+		RoomID:        roomID,
+		CollapseKey:   n.CollapseKey,
+		CollapseCount: 1,
+		ExpiresAt:     n.ExpiresAt(),
+		ExpiryMode:    n.ExpiryMode,
+	}
+}
+
+// Paging holds information about a page of the message history.
+type Paging struct {
+	Size  int    `json:"size"`
+	Since uint   `json:"since"`
+	Limit int    `json:"limit"`
+	Next  string `json:"next,omitempty"`
+}
+
+// PagedMessages holds a page of the message history together with information for requesting the next page.
+type PagedMessages struct {
+	Paging   Paging               `json:"paging"`
+	Messages []StoredNotification `json:"messages"`
+}
+
+// MessagePagingQuery is used to process queries for paging through the message history.
+type MessagePagingQuery struct {
+	Limit int  `form:"limit,default=100" query:"limit" json:"limit" binding:"min=1,max=200"`
+	Since uint `form:"since" query:"since" json:"since"`
+}
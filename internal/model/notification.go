@@ -2,37 +2,152 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/pushbits/server/internal/pberrors"
 )
 
 // Notification holds information like the message, the title, and the priority of a notification.
 type Notification struct {
 	ID            string                 `json:"id"`
 	URLEncodedID  string                 `json:"id_url_encoded"`
+	QueueID       uint                   `json:"queue_id,omitempty" form:"-" query:"-"`
+	ScheduledID   uint                   `json:"scheduled_id,omitempty" form:"-" query:"-"`
 	ApplicationID uint                   `json:"appid"`
 	Message       string                 `json:"message" form:"message" query:"message" binding:"required"`
 	Title         string                 `json:"title" form:"title" query:"title"`
 	Priority      int                    `json:"priority" form:"priority" query:"priority"`
 	Extras        map[string]interface{} `json:"extras,omitempty" form:"-" query:"-"`
 	Date          time.Time              `json:"date"`
+	// Notifications with the same collapse key edit the previous one within the collapse window (in seconds) instead of posting again.
+	CollapseKey    string `json:"collapse_key,omitempty" form:"collapse_key" query:"collapse_key"`
+	CollapseWindow int    `json:"collapse_window,omitempty" form:"collapse_window" query:"collapse_window"`
+	// Notifications are held back until the given point in time or for the given duration, like 10m.
+	DeliverAt *time.Time `json:"deliver_at,omitempty" form:"deliver_at" query:"deliver_at" time_format:"2006-01-02T15:04:05Z07:00"`
+	Delay     string     `json:"delay,omitempty" form:"delay" query:"delay"`
+	// Notifications are deleted the given number of seconds after they were sent, either by redaction or by striking them through.
+	ExpiresIn  int    `json:"expires_in,omitempty" form:"expires_in" query:"expires_in"`
+	ExpiryMode string `json:"expiry_mode,omitempty" form:"expiry_mode" query:"expiry_mode"`
+	// Silent notifications are sent in a way that does not ping the user, for example during quiet hours.
+	Silent bool `json:"-" form:"-" query:"-"`
+	// Digests combine notifications that were held back and are never held back themselves by the digest interval of an application.
+	Digest bool `json:"-" form:"-" query:"-"`
 }
 
+// Ways of deleting a notification when it expires.
+const (
+	ExpiryModeStrikethrough = "strikethrough"
+	ExpiryModeRedact        = "redact"
+)
+
+// CollapseKeyExtra is the key of the Gotify-style extras entry that can be used instead of the collapse key field.
+const CollapseKeyExtra = "pushbits::collapse_key"
+
+// MaxCollapseKeyLength is the number of characters the message history keeps of collapse keys.
+const MaxCollapseKeyLength = 128
+
 // Sanitize sets explicit defaults for a notification.
 func (n *Notification) Sanitize(application *Application) {
 	n.ID = ""
 	n.URLEncodedID = ""
+	n.QueueID = 0
+	n.ScheduledID = 0
 	n.ApplicationID = application.ID
 	if strings.TrimSpace(n.Title) == "" {
 		n.Title = application.Name
 	}
 	n.Date = time.Now()
+	if n.CollapseKey == "" {
+		if key, ok := n.Extras[CollapseKeyExtra].(string); ok {
+			n.CollapseKey = key
+		}
+	}
+	if n.ExpiresIn < 0 {
+		n.ExpiresIn = 0
+	}
+}
+
+// ValidCollapseKey checks whether a collapse key fits into the message history.
+func ValidCollapseKey(key string) bool {
+	return utf8.RuneCountInString(key) <= MaxCollapseKeyLength
+}
+
+// MaxExpiresIn is the longest time in seconds after which a notification can expire.
+const MaxExpiresIn = 365 * 24 * 60 * 60
+
+// ValidExpiresIn checks whether the expiry of a notification is within MaxExpiresIn, so that its expiry time can be represented.
+func ValidExpiresIn(seconds int) bool {
+	return seconds <= MaxExpiresIn
+}
+
+// ValidExpiryMode checks whether the expiry mode is known, an empty mode stands for the configured default.
+func ValidExpiryMode(mode string) bool {
+	return mode == "" || mode == ExpiryModeStrikethrough || mode == ExpiryModeRedact
+}
+
+// ExpiresAt returns when the notification expires, or nil if it does not.
+func (n *Notification) ExpiresAt() *time.Time {
+	if n.ExpiresIn <= 0 {
+		return nil
+	}
+
+	expiresAt := n.Date.Add(time.Duration(n.ExpiresIn) * time.Second)
+
+	return &expiresAt
+}
+
+// ScheduledTime returns when the notification should be delivered, or the zero time if it should be delivered right away.
+func (n *Notification) ScheduledTime(now time.Time) (time.Time, error) {
+	if n.DeliverAt != nil && n.Delay != "" {
+		return time.Time{}, pberrors.ErrInvalidSchedule
+	}
+
+	deliverAt := time.Time{}
+	if n.DeliverAt != nil {
+		deliverAt = *n.DeliverAt
+	}
+
+	if n.Delay != "" {
+		delay, err := time.ParseDuration(n.Delay)
+		if err != nil || delay < 0 {
+			return time.Time{}, pberrors.ErrInvalidSchedule
+		}
+
+		deliverAt = now.Add(delay)
+	}
+
+	if !deliverAt.After(now) {
+		return time.Time{}, nil
+	}
+
+	return deliverAt, nil
+}
+
+// ContentKey returns a key that is the same for notifications with identical title, message, and priority.
+func (n *Notification) ContentKey() string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", n.Title, n.Message, n.Priority)))
+	return "content:" + hex.EncodeToString(hash[:])[:32]
 }
 
 // DeleteNotification holds information like the message ID of a deletion notification.
 type DeleteNotification struct {
-	ID   string    `json:"id" form:"id"`
-	Date time.Time `json:"date"`
+	ID     string    `json:"id" form:"id"`
+	Date   time.Time `json:"date"`
+	RoomID string    `json:"-" form:"-"`
+	// Redact removes the event instead of striking it through, giving the reason to the homeserver.
+	Redact bool   `json:"-" form:"-"`
+	Reason string `json:"-" form:"-"`
+}
+
+// DeleteNotificationQuery is used to process queries for deleting notifications.
+type DeleteNotificationQuery struct {
+	Redact *bool  `form:"redact" query:"redact" json:"redact"`
+	Reason string `form:"reason" query:"reason" json:"reason"`
 }
 
 // NotificationExtras is need to document Notification.Extras in a format that the tool can read.
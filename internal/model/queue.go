@@ -0,0 +1,66 @@
+package model
+
+import "time"
+
+// QueueStatus describes the delivery state of a queued notification.
+type QueueStatus string
+
+// Delivery states of a queued notification.
+const (
+	QueueStatusPending    QueueStatus = "pending"
+	QueueStatusDelivered  QueueStatus = "delivered"
+	QueueStatusDead       QueueStatus = "dead"
+	QueueStatusSuppressed QueueStatus = "suppressed"
+)
+
+// QueuedNotification holds a notification that is delivered in the background, together with its delivery state.
+type QueuedNotification struct {
+	ID            uint                   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
+	ApplicationID uint                   `gorm:"index" json:"appid"`
+	Message       string                 `json:"message"`
+	Title         string                 `json:"title"`
+	Priority      int                    `json:"priority"`
+	Extras        map[string]interface{} `gorm:"serializer:json" json:"extras,omitempty"`
+	Date          time.Time              `json:"date"`
+	Status        QueueStatus            `gorm:"type:string;size:16;index" json:"status"`
+	Attempts      int                    `json:"attempts"`
+	NextAttempt   time.Time              `gorm:"index" json:"next_attempt"`
+	LastError     string                 `json:"last_error,omitempty"`
+	MessageID     string                 `gorm:"type:string" json:"message_id,omitempty"`
+	CollapseKey   string                 `gorm:"type:string;size:128" json:"collapse_key,omitempty"`
+	ExpiresIn     int                    `json:"expires_in,omitempty"`
+	ExpiryMode    string                 `gorm:"type:string;size:16" json:"expiry_mode,omitempty"`
+}
+
+// NewQueuedNotification creates a pending queue entry for a sanitized notification.
+func NewQueuedNotification(n *Notification) *QueuedNotification {
+	return &QueuedNotification{
+		ApplicationID: n.ApplicationID,
+		Message:       n.Message,
+		Title:         n.Title,
+		Priority:      n.Priority,
+		Extras:        n.Extras,
+		Date:          n.Date,
+		Status:        QueueStatusPending,
+		NextAttempt:   n.Date,
+		CollapseKey:   n.CollapseKey,
+		ExpiresIn:     n.ExpiresIn,
+		ExpiryMode:    n.ExpiryMode,
+	}
+}
+
+// ToNotification converts a queue entry back into the notification it was created from.
+func (q *QueuedNotification) ToNotification() *Notification {
+	return &Notification{
+		QueueID:       q.ID,
+		ApplicationID: q.ApplicationID,
+		Message:       q.Message,
+		Title:         q.Title,
+		Priority:      q.Priority,
+		Extras:        q.Extras,
+		Date:          q.Date,
+		CollapseKey:   q.CollapseKey,
+		ExpiresIn:     q.ExpiresIn,
+		ExpiryMode:    q.ExpiryMode,
+	}
+}
@@ -0,0 +1,233 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezones of users must be available without the zoneinfo of the system
+)
+
+// Ways of delivering notifications during quiet hours.
+const (
+	QuietModeDigest = "digest"
+	QuietModeNotice = "notice"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// QuietPeriod describes the quiet hours on a set of weekdays, in minutes after midnight.
+// If the start is after the end, the quiet hours on these days are before the end and after the start.
+type QuietPeriod struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// QuietSchedule is a list of quiet periods, for example parsed from "mon-fri 22:00-07:00; sat-sun".
+type QuietSchedule []QuietPeriod
+
+// ParseQuietSchedule parses quiet periods separated by semicolons.
+// Each period consists of weekdays, like "mon-fri" or "sat,sun", and an optional time range, which defaults to the whole day.
+func ParseQuietSchedule(spec string) (QuietSchedule, error) {
+	schedule := make(QuietSchedule, 0)
+
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(strings.ToLower(part))
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid quiet period %q", strings.TrimSpace(part))
+		}
+
+		period := QuietPeriod{Start: 0, End: 24 * 60}
+
+		if err := parseDays(fields[0], &period.Days); err != nil {
+			return nil, err
+		}
+
+		if len(fields) == 2 {
+			var err error
+			if period.Start, period.End, err = parseTimeRange(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		schedule = append(schedule, period)
+	}
+
+	return schedule, nil
+}
+
+func parseDays(spec string, days *[7]bool) error {
+	if spec == "daily" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+
+		from, ok := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid weekdays %q", item)
+		}
+
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseTimeRange(spec string) (int, int, error) {
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid time range %q", spec)
+	}
+
+	start, err := parseClock(first)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := parseClock(last)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start == end {
+		return 0, 0, fmt.Errorf("empty time range %q", spec)
+	}
+
+	return start, end, nil
+}
+
+// Parses a time of day like 07:30 into minutes after midnight, accepting 24:00 as the end of the day
+func parseClock(spec string) (int, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(spec, "%d:%d", &hours, &minutes); err != nil || n != 2 || len(spec) != 5 {
+		return 0, fmt.Errorf("invalid time %q", spec)
+	}
+
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time %q", spec)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// Contains checks whether the given time, in the timezone of the schedule, is within a quiet period.
+func (s QuietSchedule) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, period := range s {
+		if !period.Days[t.Weekday()] {
+			continue
+		}
+
+		if period.Start < period.End && minute >= period.Start && minute < period.End {
+			return true
+		}
+
+		if period.Start > period.End && (minute >= period.Start || minute < period.End) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateQuietHours checks the timezone, the schedule, and the mode of the quiet hours of a user.
+func (u *User) ValidateQuietHours() error {
+	if _, err := time.LoadLocation(u.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", u.Timezone)
+	}
+
+	if _, err := ParseQuietSchedule(u.QuietHours); err != nil {
+		return err
+	}
+
+	if u.QuietMode != "" && u.QuietMode != QuietModeDigest && u.QuietMode != QuietModeNotice {
+		return errors.New("quiet mode must be digest or notice")
+	}
+
+	return nil
+}
+
+// IsQuiet checks whether the given time is within the quiet hours of the user.
+// Users with an invalid timezone or schedule have no quiet hours.
+func (u *User) IsQuiet(now time.Time) bool {
+	if u.QuietHours == "" {
+		return false
+	}
+
+	location, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return false
+	}
+
+	schedule, err := ParseQuietSchedule(u.QuietHours)
+	if err != nil {
+		return false
+	}
+
+	return schedule.Contains(now.In(location))
+}
+
+// Reasons for holding back a notification, each with its own digests.
+const (
+	HeldKindQuiet = "quiet"
+	HeldKindBatch = "batch"
+)
+
+// HeldNotification holds a notification that arrived during the quiet hours of a user or is batched by its application,
+// and is delivered with the next digest.
+type HeldNotification struct {
+	ID            uint                   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
+	ApplicationID uint                   `gorm:"index" json:"appid"`
+	Kind          string                 `gorm:"type:string;size:16;default:quiet;index" json:"-"`
+	Message       string                 `json:"message"`
+	Title         string                 `json:"title"`
+	Priority      int                    `json:"priority"`
+	Extras        map[string]interface{} `gorm:"serializer:json" json:"extras,omitempty"`
+	Date          time.Time              `json:"date"`
+}
+
+// IsHTML checks whether the sender marked the held notification as HTML, like the digests of batched notifications.
+func (n *HeldNotification) IsHTML() bool {
+	return isHTML(n.Extras)
+}
+
+// NewHeldNotification creates a digest entry of the given kind for a sanitized notification.
+func NewHeldNotification(a *Application, n *Notification, kind string) *HeldNotification {
+	return &HeldNotification{
+		ApplicationID: a.ID,
+		Kind:          kind,
+		Message:       n.Message,
+		Title:         n.Title,
+		Priority:      n.Priority,
+		Extras:        n.Extras,
+		Date:          n.Date,
+	}
+}
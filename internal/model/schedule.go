@@ -0,0 +1,67 @@
+package model
+
+import "time"
+
+// ScheduleStatus describes the state of a scheduled notification.
+type ScheduleStatus string
+
+// States of a scheduled notification.
+const (
+	ScheduleStatusPending   ScheduleStatus = "pending"
+	ScheduleStatusDelivered ScheduleStatus = "delivered"
+	ScheduleStatusFailed    ScheduleStatus = "failed"
+)
+
+// ScheduledNotification holds a notification that is held back until it is due for delivery.
+type ScheduledNotification struct {
+	ID            uint                   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
+	ApplicationID uint                   `gorm:"index" json:"appid"`
+	Message       string                 `json:"message"`
+	Title         string                 `json:"title"`
+	Priority      int                    `json:"priority"`
+	Extras        map[string]interface{} `gorm:"serializer:json" json:"extras,omitempty"`
+	CollapseKey   string                 `gorm:"type:string;size:128" json:"collapse_key,omitempty"`
+	ExpiresIn     int                    `json:"expires_in,omitempty"`
+	ExpiryMode    string                 `gorm:"type:string;size:16" json:"expiry_mode,omitempty"`
+	Date          time.Time              `json:"date"`
+	DeliverAt     time.Time              `gorm:"index" json:"deliver_at"`
+	Status        ScheduleStatus         `gorm:"type:string;size:16;index" json:"status"`
+	Attempts      int                    `json:"attempts"`
+	NextAttempt   time.Time              `gorm:"index" json:"-"`
+	LastError     string                 `json:"last_error,omitempty"`
+	MessageID     string                 `gorm:"type:string" json:"message_id,omitempty"`
+	QueueID       uint                   `json:"queue_id,omitempty"`
+}
+
+// NewScheduledNotification creates a pending schedule entry for a sanitized notification.
+func NewScheduledNotification(n *Notification, deliverAt time.Time) *ScheduledNotification {
+	return &ScheduledNotification{
+		ApplicationID: n.ApplicationID,
+		Message:       n.Message,
+		Title:         n.Title,
+		Priority:      n.Priority,
+		Extras:        n.Extras,
+		CollapseKey:   n.CollapseKey,
+		ExpiresIn:     n.ExpiresIn,
+		ExpiryMode:    n.ExpiryMode,
+		Date:          n.Date,
+		DeliverAt:     deliverAt,
+		NextAttempt:   deliverAt,
+		Status:        ScheduleStatusPending,
+	}
+}
+
+// ToNotification converts a schedule entry into the notification that is delivered when it is due.
+func (s *ScheduledNotification) ToNotification(now time.Time) *Notification {
+	return &Notification{
+		ApplicationID: s.ApplicationID,
+		Message:       s.Message,
+		Title:         s.Title,
+		Priority:      s.Priority,
+		Extras:        s.Extras,
+		CollapseKey:   s.CollapseKey,
+		ExpiresIn:     s.ExpiresIn,
+		ExpiryMode:    s.ExpiryMode,
+		Date:          now,
+	}
+}
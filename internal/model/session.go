@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// MatrixSession holds the device and access token of the Matrix account notifications are sent from, so they can be reused across restarts.
+// Sessions are unique per homeserver and user name, as identities on different homeservers can share a user name.
+type MatrixSession struct {
+	ID          uint   `gorm:"AUTO_INCREMENT;primary_key"`
+	Homeserver  string `gorm:"type:string;size:255;uniqueIndex:idx_matrix_session"`
+	Username    string `gorm:"type:string;size:255;uniqueIndex:idx_matrix_session"`
+	UserID      string `gorm:"type:string"`
+	DeviceID    string `gorm:"type:string"`
+	AccessToken string `gorm:"type:string"`
+	UpdatedAt   time.Time
+}
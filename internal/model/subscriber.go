@@ -0,0 +1,39 @@
+package model
+
+// Subscriber is an additional recipient of the notifications of an application, who is invited to its channel.
+// Subscribers that are PushBits users are also linked to the user, so their subscriptions end when the user is deleted.
+type Subscriber struct {
+	ID            uint   `gorm:"AUTO_INCREMENT;primary_key" json:"id"`
+	ApplicationID uint   `gorm:"index" json:"appid"`
+	MatrixID      string `gorm:"type:string" json:"matrix_id"`
+	UserID        *uint  `gorm:"index" json:"user_id,omitempty"`
+}
+
+// CreateSubscriber is used to process queries for adding subscribers, which are given either by Matrix ID or as PushBits user.
+type CreateSubscriber struct {
+	MatrixID string `form:"matrix_id" query:"matrix_id" json:"matrix_id"`
+	UserID   *uint  `form:"user_id" query:"user_id" json:"user_id"`
+}
+
+// Recipients returns the Matrix IDs of the owner and the subscribers of an application, without duplicates.
+func Recipients(owner *User, subscribers []Subscriber) []string {
+	seen := make(map[string]bool)
+	recipients := make([]string, 0, len(subscribers)+1)
+
+	add := func(matrixID string) {
+		if matrixID != "" && !seen[matrixID] {
+			seen[matrixID] = true
+			recipients = append(recipients, matrixID)
+		}
+	}
+
+	if owner != nil {
+		add(owner.MatrixID)
+	}
+
+	for _, s := range subscribers {
+		add(s.MatrixID)
+	}
+
+	return recipients
+}
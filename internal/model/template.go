@@ -0,0 +1,173 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	htmlTemplate "html/template"
+	"io"
+	"strings"
+	textTemplate "text/template"
+	"time"
+
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// Engines the title and message templates of applications are parsed with.
+const (
+	TemplateEngineText = "text"
+	TemplateEngineHTML = "html"
+)
+
+// TemplateData holds the fields of a notification that title and message templates can refer to.
+type TemplateData struct {
+	Application string
+	Title       string
+	Message     string
+	Priority    int
+	Extras      map[string]interface{}
+	Date        time.Time
+}
+
+// Functions available in templates besides the builtin ones
+var templateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// Parses a template with the template engine of the application
+func (a *Application) parseTemplate(name, text string) (executor, error) {
+	switch a.TemplateEngine {
+	case "", TemplateEngineText:
+		t, err := textTemplate.New(name).Funcs(textTemplate.FuncMap(templateFuncs)).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case TemplateEngineHTML:
+		t, err := htmlTemplate.New(name).Funcs(htmlTemplate.FuncMap(templateFuncs)).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	default:
+		return nil, pberrors.ErrInvalidTemplate
+	}
+}
+
+// HasTemplates checks whether the title or the message of notifications are rendered with templates.
+func (a *Application) HasTemplates() bool {
+	return a.TitleTemplate != "" || a.MessageTemplate != ""
+}
+
+// ValidateTemplates checks that the templates of the application can be parsed with its template engine.
+func (a *Application) ValidateTemplates() error {
+	for name, text := range map[string]string{"title": a.TitleTemplate, "message": a.MessageTemplate} {
+		if _, err := a.parseTemplate(name, text); err != nil {
+			return pberrors.ErrInvalidTemplate
+		}
+	}
+
+	return nil
+}
+
+// Renders a template, an empty template keeps the original text
+func (a *Application) render(name, text, original string, data *TemplateData) (string, error) {
+	if text == "" {
+		return original, nil
+	}
+
+	t, err := a.parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Checks whether the extras of a notification mark it as HTML
+func isHTML(extras map[string]interface{}) bool {
+	display, ok := extras["client::display"].(map[string]interface{})
+	return ok && strings.EqualFold(fmt.Sprint(display["contentType"]), "text/html")
+}
+
+// RenderTemplates returns a copy of the notification whose title and message are rendered with the templates of the application.
+// Messages rendered with the html engine are marked as HTML, with the title or message that has no template escaped.
+// Errors of parsing and executing the templates are returned as they are.
+func (a *Application) RenderTemplates(n *Notification) (*Notification, error) {
+	data := &TemplateData{
+		Application: a.Name,
+		Title:       n.Title,
+		Message:     n.Message,
+		Priority:    n.Priority,
+		Extras:      n.Extras,
+		Date:        n.Date,
+	}
+
+	title, err := a.render("title", a.TitleTemplate, n.Title, data)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := a.render("message", a.MessageTemplate, n.Message, data)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := *n
+	rendered.Title = title
+	rendered.Message = message
+
+	if a.TemplateEngine == TemplateEngineHTML {
+		// Notifications the sender marked as HTML already do not need to be escaped.
+		if !isHTML(n.Extras) {
+			if a.TitleTemplate == "" {
+				rendered.Title = html.EscapeString(title)
+			}
+			if a.MessageTemplate == "" {
+				rendered.Message = html.EscapeString(message)
+			}
+		}
+
+		rendered.Extras = make(map[string]interface{}, len(n.Extras)+1)
+		for key, value := range n.Extras {
+			rendered.Extras[key] = value
+		}
+
+		rendered.Extras["client::display"] = map[string]interface{}{"contentType": "text/html"}
+	}
+
+	return &rendered, nil
+}
+
+// RenderTemplates is used to process queries for rendering a notification with the templates of an application without sending it.
+// Templates that are given replace the ones of the application, so that changes can be tried out before saving them.
+type RenderTemplates struct {
+	Message         string                 `json:"message"`
+	Title           string                 `json:"title"`
+	Priority        int                    `json:"priority"`
+	Extras          map[string]interface{} `json:"extras,omitempty"`
+	TitleTemplate   *string                `json:"title_template"`
+	MessageTemplate *string                `json:"message_template"`
+	TemplateEngine  *string                `json:"template_engine"`
+}
+
+// RenderedNotification holds the result of rendering a notification with templates, or the error that occurred.
+type RenderedNotification struct {
+	Title       string `json:"title"`
+	Message     string `json:"message"`
+	ContentType string `json:"content_type"`
+	Error       string `json:"error,omitempty"`
+}
@@ -13,6 +13,12 @@ type User struct {
 	IsAdmin      bool
 	MatrixID     string `gorm:"type:string"`
 	Applications []Application
+	// During quiet hours, notifications below the configured priority are held for a digest or sent as notices.
+	Timezone   string `gorm:"type:string;size:64"`
+	QuietHours string `gorm:"type:string"`
+	QuietMode  string `gorm:"type:string;size:16"`
+	// Applications of the user are created with this Matrix identity, the default account is used if it is empty.
+	MatrixIdentity string `gorm:"type:string;size:64"`
 }
 
 // ExternalUser represents a user for external purposes.
@@ -21,6 +27,12 @@ type ExternalUser struct {
 	Name     string `json:"name" form:"name" query:"name" binding:"required"`
 	IsAdmin  bool   `json:"is_admin" form:"is_admin" query:"is_admin"`
 	MatrixID string `json:"matrix_id" form:"matrix_id" query:"matrix_id" binding:"required"`
+	// The quiet hours are given as weekdays and time ranges in the timezone of the user, like "mon-fri 22:00-07:00; sat-sun".
+	Timezone   string `json:"timezone,omitempty" form:"timezone" query:"timezone"`
+	QuietHours string `json:"quiet_hours,omitempty" form:"quiet_hours" query:"quiet_hours"`
+	QuietMode  string `json:"quiet_mode,omitempty" form:"quiet_mode" query:"quiet_mode"`
+	// The name of the Matrix identity that sends the notifications of the user, empty for the default account.
+	MatrixIdentity string `json:"matrix_identity,omitempty" form:"matrix_identity" query:"matrix_identity"`
 }
 
 // UserCredentials holds information for authenticating a user.
@@ -59,20 +71,28 @@ func (u *CreateUser) IntoInternalUser(cm *credentials.Manager) (*User, error) {
 	}
 
 	return &User{
-		Name:         u.Name,
-		PasswordHash: passwordHash,
-		IsAdmin:      u.IsAdmin,
-		MatrixID:     u.MatrixID,
+		Name:           u.Name,
+		PasswordHash:   passwordHash,
+		IsAdmin:        u.IsAdmin,
+		MatrixID:       u.MatrixID,
+		Timezone:       u.Timezone,
+		QuietHours:     u.QuietHours,
+		QuietMode:      u.QuietMode,
+		MatrixIdentity: u.MatrixIdentity,
 	}, nil
 }
 
 // IntoExternalUser converts a User into a ExternalUser.
 func (u *User) IntoExternalUser() *ExternalUser {
 	return &ExternalUser{
-		ID:       u.ID,
-		Name:     u.Name,
-		IsAdmin:  u.IsAdmin,
-		MatrixID: u.MatrixID,
+		ID:             u.ID,
+		Name:           u.Name,
+		IsAdmin:        u.IsAdmin,
+		MatrixID:       u.MatrixID,
+		Timezone:       u.Timezone,
+		QuietHours:     u.QuietHours,
+		QuietMode:      u.QuietMode,
+		MatrixIdentity: u.MatrixIdentity,
 	}
 }
 
@@ -82,4 +102,10 @@ type UpdateUser struct {
 	Password *string `form:"password" query:"password" json:"password"`
 	IsAdmin  *bool   `form:"is_admin" query:"is_admin" json:"is_admin"`
 	MatrixID *string `form:"matrix_id" query:"matrix_id" json:"matrix_id"`
+	// An empty quiet hours schedule disables the quiet hours.
+	Timezone   *string `form:"timezone" query:"timezone" json:"timezone"`
+	QuietHours *string `form:"quiet_hours" query:"quiet_hours" json:"quiet_hours"`
+	QuietMode  *string `form:"quiet_mode" query:"quiet_mode" json:"quiet_mode"`
+	// Changing the Matrix identity moves the applications that use the previous identity of the user to the new one.
+	MatrixIdentity *string `form:"matrix_identity" query:"matrix_identity" json:"matrix_identity"`
 }
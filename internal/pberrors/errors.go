@@ -1,10 +1,143 @@
 // Package pberrors defines errors specific to PushBits
 package pberrors
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // ErrMessageNotFound indicates that a message does not exist
 var ErrMessageNotFound = errors.New("message not found")
 
 // ErrConfigTLSFilesInconsistent indicates that either just a certfile or a keyfile was provided
 var ErrConfigTLSFilesInconsistent = errors.New("TLS certfile and keyfile must either both be provided or omitted")
+
+// ErrConfigQueueInvalid indicates that the delivery queue is enabled without workers or attempts
+var ErrConfigQueueInvalid = errors.New("queue workers and max attempts must be at least 1 when the queue is enabled")
+
+// ErrConfigSchedulerInvalid indicates that the scheduler is configured without attempts or with non-positive intervals
+var ErrConfigSchedulerInvalid = errors.New("scheduler max attempts must be at least 1 and its intervals must be positive")
+
+// ErrConfigExpiryInvalid indicates that the expiry mode is unknown or the sweep interval is not positive
+var ErrConfigExpiryInvalid = errors.New("expiry mode must be strikethrough or redact and the sweep interval must be positive")
+
+// ErrInvalidExpiryMode indicates that a notification was sent with an unknown expiry mode
+var ErrInvalidExpiryMode = errors.New("expiry mode must be strikethrough or redact")
+
+// ErrInvalidCollapseKey indicates that a notification was sent with a collapse key that is too long to be stored
+var ErrInvalidCollapseKey = errors.New("collapse key must be at most 128 characters")
+
+// ErrScheduledCollapseKey indicates that a notification was scheduled with a collapse key, which only applies to notifications sent right away
+var ErrScheduledCollapseKey = errors.New("collapse_key cannot be combined with deliver_at or delay")
+
+// ErrInvalidExpiresIn indicates that a notification was sent with an expiry too far in the future
+var ErrInvalidExpiresIn = errors.New("expires_in must be at most one year")
+
+// ErrConfigQuietHoursInvalid indicates that quiet hours are enabled without a positive digest interval
+var ErrConfigQuietHoursInvalid = errors.New("the digest interval must be positive when quiet hours are enabled")
+
+// ErrConfigMatrixCredentialsMissing indicates that neither a password nor an access token is configured for the Matrix account
+var ErrConfigMatrixCredentialsMissing = errors.New("either a password or an access token is required for the Matrix account")
+
+// ErrConfigMatrixIdentitiesInvalid indicates that a Matrix identity lacks a unique name, a homeserver, or a user name
+var ErrConfigMatrixIdentitiesInvalid = errors.New("every Matrix identity needs a unique name, a homeserver, and a user name")
+
+// ErrConfigAppServiceInvalid indicates that the application service mode lacks its ID, tokens, or user prefix, or is combined with encryption
+var ErrConfigAppServiceInvalid = errors.New("the application service needs an ID, an AS token, an HS token, and a user prefix, and cannot be used with encryption")
+
+// ErrUnknownMatrixIdentity indicates that a user or an application is assigned to a Matrix identity that is not configured
+var ErrUnknownMatrixIdentity = errors.New("unknown Matrix identity")
+
+// ErrInvalidSubscriber indicates that a subscriber is given neither by a valid Matrix ID nor as existing user
+var ErrInvalidSubscriber = errors.New("a subscriber needs either a Matrix ID like @user:example.com or the ID of an existing user")
+
+// ErrSubscriberExists indicates that a Matrix ID already receives the notifications of an application
+var ErrSubscriberExists = errors.New("the Matrix ID already receives the notifications of this application")
+
+// ErrSubscribersNotSupported indicates that the backend of an application cannot deliver to subscribers
+var ErrSubscribersNotSupported = errors.New("the backend of this application does not support subscribers")
+
+// ErrInvalidTemplate indicates that a template of an application cannot be parsed or uses an unknown template engine
+var ErrInvalidTemplate = errors.New("templates must be valid for the template engine, which is text or html")
+
+// ErrInvalidImage indicates that an uploaded image is missing, too large, or not in a supported format
+var ErrInvalidImage = errors.New("the image must be a PNG, JPEG, GIF, or WebP file of at most 5 MiB, uploaded as form field file")
+
+// ErrImagesNotSupported indicates that the backend of an application cannot show images
+var ErrImagesNotSupported = errors.New("the backend of this application does not support images")
+
+// ErrInvalidRoom indicates that an application cannot be bound to the given room
+var ErrInvalidRoom = errors.New("a room must be given by an ID like !room:example.com or an alias like #room:example.com and requires the matrix backend")
+
+// ErrRoomNotFound indicates that the room an application should be bound to does not exist
+var ErrRoomNotFound = errors.New("the room does not exist")
+
+// ErrRoomInUse indicates that another application is already relayed to the room an application should be bound to
+var ErrRoomInUse = errors.New("another application is already relayed to the room")
+
+// ErrRoomForbidden indicates that the Matrix account cannot join the room an application should be bound to or cannot post there
+var ErrRoomForbidden = errors.New("the Matrix account is not allowed to join the room or to post messages there")
+
+// ErrConfigBatchingInvalid indicates that the poll interval for batched notifications is not positive
+var ErrConfigBatchingInvalid = errors.New("the poll interval for batched notifications must be positive")
+
+// ErrInvalidDigestSettings indicates that the digest settings of an application cannot be used
+var ErrInvalidDigestSettings = errors.New("digest interval and bypass priority must not be negative")
+
+// ErrConfigPriorityBandsInvalid indicates that priority bands are not in ascending order or use unknown message types or mentions
+var ErrConfigPriorityBandsInvalid = errors.New("priority bands must be in ascending order of their minimum, with msgtype text or notice and mention owner, room, or none")
+
+// ErrInvalidSchedule indicates that the requested delivery time of a notification cannot be used
+var ErrInvalidSchedule = errors.New("only one of deliver_at and a non-negative delay may be given")
+
+// ErrConfigPickleKeyMissing indicates that encryption is enabled without a key for protecting the crypto store
+var ErrConfigPickleKeyMissing = errors.New("a pickle key must be provided when encryption is enabled")
+
+// ErrConfigEncryptionDialect indicates that encryption is enabled with a database that cannot hold the crypto store
+var ErrConfigEncryptionDialect = errors.New("encryption requires sqlite3 or postgres as database dialect")
+
+// ErrEncryptionUnsupported indicates that encryption is enabled but PushBits was built without support for it
+var ErrEncryptionUnsupported = errors.New("encryption is enabled but PushBits was built without the goolm tag")
+
+// ErrConfigRateLimitInvalid indicates that rate limiting is enabled with buckets that cannot hold a single token
+var ErrConfigRateLimitInvalid = errors.New("rate limit bursts must be at least 1 and the summary interval must be positive when rate limiting is enabled")
+
+// ErrConfigStreamInvalid indicates that the stream is configured with non-positive intervals or without a buffer
+var ErrConfigStreamInvalid = errors.New("the ping interval and the write timeout of the stream must be positive and its buffer size at least 1")
+
+// ErrConfigSMTPIncomplete indicates that the SMTP backend is enabled without a host or a sender address
+var ErrConfigSMTPIncomplete = errors.New("SMTP host and sender address must be provided when the SMTP backend is enabled")
+
+// ErrUnknownBackend indicates that an application is bound to a backend that is not enabled
+var ErrUnknownBackend = errors.New("backend is unknown or not enabled")
+
+// ErrInvalidTarget indicates that the target of an application cannot be used with its backend
+var ErrInvalidTarget = errors.New("target is not valid for the backend of the application")
+
+// ErrInvalidCallbackURL indicates that the callback URL of an application is not an HTTP(S) URL
+var ErrInvalidCallbackURL = errors.New("callback URL must be an http or https URL")
+
+// ErrNotificationSuppressed indicates that a notification was not delivered because its application is muted or the priority is too low
+var ErrNotificationSuppressed = errors.New("notification suppressed by the delivery settings of the application")
+
+// ErrNotificationHeld indicates that a notification was held back for a digest, because of the quiet hours of the user or the digest interval of the application.
+// It wraps ErrNotificationSuppressed, as the notification was not delivered right away either.
+var ErrNotificationHeld = fmt.Errorf("notification held back for a digest: %w", ErrNotificationSuppressed)
+
+// ErrRateLimited indicates that an application sent more notifications than its rate limit allows
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RetryAfterError indicates that a request was rate limited and should not be retried before the given duration has passed
+type RetryAfterError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s: %v", e.RetryAfter, e.Err)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,237 @@
+// Package queue provides a persistent queue for delivering notifications in the background.
+package queue
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+	CreateQueuedNotification(q *model.QueuedNotification) error
+	UpdateQueuedNotification(q *model.QueuedNotification) error
+	GetDueQueuedNotifications(now time.Time, limit int) ([]model.QueuedNotification, error)
+	CreateStoredNotification(n *model.StoredNotification) error
+}
+
+// The Dispatcher interface for relaying notifications.
+type Dispatcher interface {
+	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+}
+
+// The Stream interface for pushing delivered notifications to connected clients.
+type Stream interface {
+	Publish(a *model.Application, n *model.StoredNotification)
+}
+
+// Queue holds information for delivering queued notifications.
+type Queue struct {
+	db       Database
+	dp       Dispatcher
+	stream   Stream
+	settings configuration.Queue
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	started  atomic.Bool
+	stopOnce sync.Once
+}
+
+// Create instanciates a delivery queue. If a stream is given, notifications are pushed to it once they are in the message history.
+func Create(db Database, dp Dispatcher, stream Stream, settings configuration.Queue) *Queue {
+	return &Queue{
+		db:       db,
+		dp:       dp,
+		stream:   stream,
+		settings: settings,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start launches the background delivery of queued notifications.
+func (q *Queue) Start() {
+	log.L.Printf("Starting delivery queue with %d worker(s).", q.settings.Workers)
+
+	q.started.Store(true)
+	go q.run()
+}
+
+// Close stops the background delivery and waits for running deliveries to finish.
+func (q *Queue) Close() {
+	q.stopOnce.Do(func() {
+		log.L.Print("Stopping delivery queue.")
+
+		close(q.stop)
+		if q.started.Load() {
+			<-q.done
+		}
+	})
+}
+
+// Enqueue stores a sanitized notification so that it is delivered in the background.
+func (q *Queue) Enqueue(a *model.Application, n *model.Notification) (*model.QueuedNotification, error) {
+	queued := model.NewQueuedNotification(n)
+	queued.ApplicationID = a.ID
+
+	if err := q.db.CreateQueuedNotification(queued); err != nil {
+		return nil, err
+	}
+
+	log.L.Printf("Queued notification %d for application %s.", queued.ID, a.Name)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return queued, nil
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.deliverDue()
+
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// Delivers all notifications that are currently due, using the configured number of workers
+func (q *Queue) deliverDue() {
+	for {
+		due, err := q.db.GetDueQueuedNotifications(time.Now(), q.settings.Workers*10)
+		if err != nil {
+			log.L.Printf("Cannot fetch queued notifications: %s", err)
+			return
+		}
+
+		if len(due) == 0 {
+			return
+		}
+
+		jobs := make(chan *model.QueuedNotification)
+		var wg sync.WaitGroup
+
+		for i := 0; i < q.settings.Workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for queued := range jobs {
+					q.deliver(queued)
+				}
+			}()
+		}
+
+		for i := range due {
+			jobs <- &due[i]
+		}
+		close(jobs)
+		wg.Wait()
+
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (q *Queue) deliver(queued *model.QueuedNotification) {
+	queued.Attempts++
+
+	application, err := q.db.GetApplicationByID(queued.ApplicationID)
+	if err != nil || application == nil {
+		log.L.Printf("Application of queued notification %d does not exist anymore.", queued.ID)
+		q.markDead(queued, errors.New("application not found"))
+		return
+	}
+
+	notification := queued.ToNotification()
+
+	messageID, err := q.dp.SendNotification(application, notification)
+	switch {
+	case errors.Is(err, pberrors.ErrNotificationSuppressed):
+		queued.Status = model.QueueStatusSuppressed
+		queued.LastError = ""
+
+		stored := model.NewStoredNotification(notification, application.MatrixID, "")
+		if err := q.db.CreateStoredNotification(stored); err != nil {
+			log.L.Printf("Cannot add notification %d to message history: %s", queued.ID, err)
+		} else if q.stream != nil {
+			q.stream.Publish(application, stored)
+		}
+	case err == nil:
+		queued.Status = model.QueueStatusDelivered
+		queued.MessageID = messageID
+		queued.LastError = ""
+
+		stored := model.NewStoredNotification(notification, application.MatrixID, messageID)
+		if err := q.db.CreateStoredNotification(stored); err != nil {
+			log.L.Printf("Cannot add notification %d to message history: %s", queued.ID, err)
+		} else if q.stream != nil {
+			q.stream.Publish(application, stored)
+		}
+	case queued.Attempts >= q.settings.MaxAttempts:
+		log.L.Printf("Giving up on queued notification %d after %d attempt(s).", queued.ID, queued.Attempts)
+		q.markDead(queued, err)
+		return
+	default:
+		delay := q.backoff(queued.Attempts, err)
+		log.L.Printf("Delivery of queued notification %d failed, retrying in %s: %s", queued.ID, delay, err)
+		queued.LastError = err.Error()
+		queued.NextAttempt = time.Now().Add(delay)
+	}
+
+	q.save(queued)
+}
+
+func (q *Queue) markDead(queued *model.QueuedNotification, err error) {
+	queued.Status = model.QueueStatusDead
+	queued.LastError = err.Error()
+
+	q.save(queued)
+}
+
+func (q *Queue) save(queued *model.QueuedNotification) {
+	if err := q.db.UpdateQueuedNotification(queued); err != nil {
+		log.L.Printf("Cannot update queued notification %d: %s", queued.ID, err)
+	}
+}
+
+// Computes the delay before the next attempt, honoring a delay requested by the homeserver
+func (q *Queue) backoff(attempts int, err error) time.Duration {
+	delay := q.settings.MinBackoff
+	for i := 1; i < attempts && delay < q.settings.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > q.settings.MaxBackoff {
+		delay = q.settings.MaxBackoff
+	}
+
+	var retryAfter *pberrors.RetryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.RetryAfter > delay {
+		delay = retryAfter.RetryAfter
+	}
+
+	return delay
+}
@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+func testSettings() configuration.Queue {
+	return configuration.Queue{
+		Enabled:      true,
+		Workers:      2,
+		MaxAttempts:  2,
+		PollInterval: time.Hour,
+		MinBackoff:   time.Second,
+		MaxBackoff:   10 * time.Second,
+	}
+}
+
+func TestQueue_Backoff(t *testing.T) {
+	assert := assert.New(t)
+
+	q := Create(mockups.GetMemoryDatabase(), &mockups.RecordingDispatcher{}, nil, testSettings())
+	failure := errors.New("failure")
+
+	assert.Equal(time.Second, q.backoff(1, failure))
+	assert.Equal(2*time.Second, q.backoff(2, failure))
+	assert.Equal(8*time.Second, q.backoff(4, failure))
+	assert.Equal(10*time.Second, q.backoff(10, failure))
+	assert.Equal(time.Minute, q.backoff(1, &pberrors.RetryAfterError{RetryAfter: time.Minute, Err: failure}))
+}
+
+func TestQueue_Deliver(t *testing.T) {
+	assert := assert.New(t)
+
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	application := mockups.GetApplication1()
+	notification := model.Notification{Message: "message"}
+	notification.Sanitize(application)
+
+	q := Create(db, &mockups.RecordingDispatcher{}, nil, testSettings())
+	queued, err := q.Enqueue(application, &notification)
+	assert.NoError(err)
+
+	q.deliverDue()
+	assert.Equal(model.QueueStatusDelivered, db.Queued[queued.ID].Status)
+	assert.Equal("$event", db.Queued[queued.ID].MessageID)
+}
+
+func TestQueue_DeadLetter(t *testing.T) {
+	assert := assert.New(t)
+
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	application := mockups.GetApplication1()
+	notification := model.Notification{Message: "message"}
+	notification.Sanitize(application)
+
+	q := Create(db, &mockups.RecordingDispatcher{Err: errors.New("homeserver unavailable")}, nil, testSettings())
+	queued, err := q.Enqueue(application, &notification)
+	assert.NoError(err)
+
+	q.deliverDue()
+	assert.Equal(model.QueueStatusPending, db.Queued[queued.ID].Status)
+	assert.Equal(1, db.Queued[queued.ID].Attempts)
+
+	db.Queued[queued.ID].NextAttempt = time.Now()
+	q.deliverDue()
+	assert.Equal(model.QueueStatusDead, db.Queued[queued.ID].Status)
+	assert.Equal("homeserver unavailable", db.Queued[queued.ID].LastError)
+}
+
+func TestQueue_Stream(t *testing.T) {
+	assert := assert.New(t)
+
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	application := mockups.GetApplication1()
+	stream := &mockups.MockStream{}
+
+	enqueue := func(message string) {
+		notification := model.Notification{Message: message}
+		notification.Sanitize(application)
+
+		q := Create(db, &mockups.RecordingDispatcher{Err: pberrors.ErrNotificationHeld}, stream, testSettings())
+		_, err := q.Enqueue(application, &notification)
+		assert.NoError(err)
+
+		q.deliverDue()
+	}
+
+	enqueue("held")
+	if assert.Len(stream.Published, 1, "Notifications held back for a digest should be streamed") {
+		assert.Equal(uint(1), stream.Published[0].ID)
+		assert.Equal("held", stream.Published[0].Message)
+	}
+
+	db.StoreErr = errors.New("disk full")
+	enqueue("lost")
+	assert.Len(stream.Published, 1, "Notifications that are not in the message history should not be streamed")
+}
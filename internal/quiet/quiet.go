@@ -0,0 +1,233 @@
+// Package quiet provides the quiet hours of users, during which notifications are held for a digest or sent as notices.
+package quiet
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+	GetUserByID(ID uint) (*model.User, error)
+	CreateHeldNotification(h *model.HeldNotification) error
+	GetHeldApplicationIDs(kind string) ([]uint, error)
+	GetHeldNotifications(applicationID uint, kind string) ([]model.HeldNotification, error)
+	DeleteHeldNotifications(applicationID uint, kind string, lastID uint) error
+}
+
+// The Dispatcher interface for sending digests.
+type Dispatcher interface {
+	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+}
+
+// The maximum number of held notifications listed in a digest, the remaining ones are only counted
+const maxDigestEntries = 50
+
+// Hours holds information for applying the quiet hours of users and for delivering digests.
+type Hours struct {
+	db       Database
+	dp       Dispatcher
+	settings configuration.QuietHours
+	now      func() time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	started  atomic.Bool
+	stopOnce sync.Once
+}
+
+// Create instanciates the quiet hours policy.
+func Create(db Database, dp Dispatcher, settings configuration.QuietHours) *Hours {
+	return &Hours{
+		db:       db,
+		dp:       dp,
+		settings: settings,
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Returns the owner of the application if the notification arrives during their quiet hours, or nil.
+// Notifications with a priority of at least the configured one are not affected.
+func (h *Hours) quietUser(a *model.Application, n *model.Notification, now time.Time) *model.User {
+	if n.Priority >= h.settings.Priority {
+		return nil
+	}
+
+	user, err := h.db.GetUserByID(a.UserID)
+	if err != nil || user == nil || !user.IsQuiet(now) {
+		return nil
+	}
+
+	return user
+}
+
+// Holds checks whether a notification is held back for the next digest because it arrives during the quiet hours of the user.
+func (h *Hours) Holds(a *model.Application, n *model.Notification, now time.Time) bool {
+	user := h.quietUser(a, n, now)
+	return user != nil && user.QuietMode != model.QuietModeNotice
+}
+
+// Mark marks a notification as silent if it arrives during the quiet hours of the user.
+// Edits of sent notifications cannot be held back for a digest, so they are sent as notices whatever the quiet mode of the user is.
+func (h *Hours) Mark(a *model.Application, n *model.Notification, now time.Time) {
+	if h.quietUser(a, n, now) != nil {
+		n.Silent = true
+	}
+}
+
+// Apply holds a notification back for the next digest or marks it as silent if it arrives during the quiet hours of the user.
+// Notifications with a priority of at least the configured one are not affected.
+func (h *Hours) Apply(a *model.Application, n *model.Notification, now time.Time) (bool, error) {
+	user := h.quietUser(a, n, now)
+	if user == nil {
+		return false, nil
+	}
+
+	if user.QuietMode == model.QuietModeNotice {
+		log.L.Debugf("Sending notification for application %s as notice during quiet hours.", a.Name)
+		n.Silent = true
+		return false, nil
+	}
+
+	if err := h.db.CreateHeldNotification(model.NewHeldNotification(a, n, model.HeldKindQuiet)); err != nil {
+		return false, err
+	}
+
+	log.L.Printf("Holding notification for application %s until the quiet hours of user %s end.", a.Name, user.Name)
+
+	return true, nil
+}
+
+// Start launches the background delivery of digests, beginning with those whose quiet hours ended while PushBits was not running.
+func (h *Hours) Start() {
+	h.started.Store(true)
+	go h.run()
+}
+
+// Close stops the delivery of digests.
+func (h *Hours) Close() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+		if h.started.Load() {
+			<-h.done
+		}
+	})
+}
+
+func (h *Hours) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.settings.DigestInterval)
+	defer ticker.Stop()
+
+	for {
+		h.deliverDigests()
+
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends a digest for every application whose user is not in quiet hours anymore
+func (h *Hours) deliverDigests() {
+	ids, err := h.db.GetHeldApplicationIDs(model.HeldKindQuiet)
+	if err != nil {
+		log.L.Printf("Cannot fetch applications with held notifications: %s", err)
+		return
+	}
+
+	for _, id := range ids {
+		application, err := h.db.GetApplicationByID(id)
+		if err != nil || application == nil {
+			continue
+		}
+
+		user, err := h.db.GetUserByID(application.UserID)
+		if err != nil || user == nil || user.IsQuiet(h.now()) {
+			continue
+		}
+
+		if err := h.sendDigest(application, user); err != nil {
+			log.L.Printf("Cannot send digest for application %s: %s", application.Name, err)
+		}
+	}
+}
+
+func (h *Hours) sendDigest(application *model.Application, user *model.User) error {
+	held, err := h.db.GetHeldNotifications(application.ID, model.HeldKindQuiet)
+	if err != nil || len(held) == 0 {
+		return err
+	}
+
+	notification := model.Notification{
+		Title:   fmt.Sprintf("%d notification(s) during quiet hours", len(held)),
+		Message: digestMessage(held, user),
+		Extras: map[string]interface{}{
+			"client::display": map[string]interface{}{"contentType": "text/html"},
+		},
+		Digest: true,
+	}
+	notification.Sanitize(application)
+
+	for _, n := range held {
+		if n.Priority > notification.Priority {
+			notification.Priority = n.Priority
+		}
+	}
+
+	// A digest that is suppressed by the delivery state of the application is dropped like any other notification.
+	// Digests only go to Matrix: the notifications they summarize were added to the message history and streamed when they were held.
+	if _, err := h.dp.SendNotification(application, &notification); err != nil && !errors.Is(err, pberrors.ErrNotificationSuppressed) {
+		return err
+	}
+
+	log.L.Printf("Sent digest of %d held notification(s) for application %s.", len(held), application.Name)
+
+	return h.db.DeleteHeldNotifications(application.ID, model.HeldKindQuiet, held[len(held)-1].ID)
+}
+
+// Lists the held notifications with the time they arrived at in the timezone of the user.
+// Held notifications marked as HTML, like batch digests, keep their markup, all others are escaped.
+func digestMessage(held []model.HeldNotification, user *model.User) string {
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	var b strings.Builder
+	b.WriteString("<ul>")
+
+	for i, n := range held {
+		if i == maxDigestEntries {
+			fmt.Fprintf(&b, "<li>… and %d more</li>", len(held)-i)
+			break
+		}
+
+		title, message := strings.TrimSpace(n.Title), strings.TrimSpace(n.Message)
+		if !n.IsHTML() {
+			title = html.EscapeString(title)
+			message = strings.ReplaceAll(html.EscapeString(message), "\n", " ")
+		}
+
+		fmt.Fprintf(&b, "<li>%s <b>%s</b>: %s</li>", n.Date.In(location).Format("15:04"), title, message)
+	}
+
+	b.WriteString("</ul>")
+
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package quiet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+// Returns a database with the first application, which is owned by the given user
+func userDatabase(user *model.User) *mockups.MemoryDatabase {
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	db.Users[mockups.GetApplication1().UserID] = user
+	return db
+}
+
+func TestQuietSchedule_Contains(t *testing.T) {
+	assert := assert.New(t)
+
+	schedule, err := model.ParseQuietSchedule("mon-fri 22:00-07:00; sat,sun")
+	require.NoError(t, err)
+
+	// 2024-01-01 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	assert.True(schedule.Contains(at(1, 6, 59)), "Monday morning should be quiet")
+	assert.False(schedule.Contains(at(1, 7, 0)), "Monday after 07:00 should not be quiet")
+	assert.False(schedule.Contains(at(3, 21, 59)), "Wednesday evening before 22:00 should not be quiet")
+	assert.True(schedule.Contains(at(3, 22, 0)), "Wednesday night should be quiet")
+	assert.True(schedule.Contains(at(6, 12, 0)), "Saturday should be quiet all day")
+	assert.True(schedule.Contains(at(7, 23, 59)), "Sunday should be quiet all day")
+}
+
+func TestQuietSchedule_Invalid(t *testing.T) {
+	for _, spec := range []string{"monday", "mon-fri 22:00", "mon 25:00-07:00", "mon 7:00-08:00", "mon 08:00-08:00", "mon 08:00-09:00 extra"} {
+		_, err := model.ParseQuietSchedule(spec)
+		assert.Errorf(t, err, "Schedule %q should be invalid", spec)
+	}
+
+	_, err := model.ParseQuietSchedule("fri-mon 00:00-24:00; daily 12:00-13:00")
+	assert.NoError(t, err)
+}
+
+func TestQuietHours_UserTimezone(t *testing.T) {
+	user := model.User{Timezone: "America/New_York", QuietHours: "daily 22:00-07:00"}
+
+	// 03:00 UTC is 22:00 in New York in winter.
+	assert.True(t, user.IsQuiet(time.Date(2024, 1, 10, 3, 0, 0, 0, time.UTC)))
+	assert.False(t, user.IsQuiet(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)))
+	assert.Error(t, (&model.User{Timezone: "Mars/Olympus_Mons"}).ValidateQuietHours())
+}
+
+func TestQuietHours_Digest(t *testing.T) {
+	assert := assert.New(t)
+
+	db := userDatabase(&model.User{Name: "user", QuietHours: "daily 22:00-07:00"})
+	dp := &mockups.RecordingDispatcher{}
+	h := Create(db, dp, configuration.QuietHours{Enabled: true, Priority: 10, DigestInterval: time.Minute})
+
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return night }
+	application := mockups.GetApplication1()
+
+	low := model.Notification{Title: "Backup", Message: "done", Priority: 2, Date: night}
+	held, err := h.Apply(application, &low, night)
+	assert.NoError(err)
+	assert.True(held, "Low priority notification should be held during quiet hours")
+
+	high := model.Notification{Title: "Disk", Message: "full", Priority: 10, Date: night}
+	held, err = h.Apply(application, &high, night)
+	assert.NoError(err)
+	assert.False(held, "High priority notification should be delivered during quiet hours")
+
+	h.deliverDigests()
+	assert.Empty(dp.Sent, "Digest should not be sent during quiet hours")
+
+	h.now = func() time.Time { return night.Add(9 * time.Hour) }
+	h.deliverDigests()
+	if assert.Len(dp.Sent, 1) {
+		assert.Equal("1 notification(s) during quiet hours", dp.Sent[0].Title)
+		assert.Equal("<ul><li>23:00 <b>Backup</b>: done</li></ul>", dp.Sent[0].Message)
+	}
+	assert.Empty(db.Held)
+}
+
+func TestQuietHours_DigestHTML(t *testing.T) {
+	assert := assert.New(t)
+
+	db := userDatabase(&model.User{Name: "user", QuietHours: "daily 22:00-07:00"})
+	dp := &mockups.RecordingDispatcher{}
+	h := Create(db, dp, configuration.QuietHours{Enabled: true, Priority: 10, DigestInterval: time.Minute})
+
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return night }
+	application := mockups.GetApplication1()
+
+	plain := model.Notification{Title: "Build", Message: "a < b", Priority: 2, Date: night}
+	digest := model.Notification{
+		Title:   "Digest of 2 notification(s)",
+		Message: "<ul><li><b>Backup</b> (2×): done</li></ul>",
+		Extras: map[string]interface{}{
+			"client::display": map[string]interface{}{"contentType": "text/html"},
+		},
+		Priority: 2,
+		Date:     night,
+	}
+
+	for _, n := range []*model.Notification{&plain, &digest} {
+		held, err := h.Apply(application, n, night)
+		assert.NoError(err)
+		assert.True(held)
+	}
+
+	h.now = func() time.Time { return night.Add(9 * time.Hour) }
+	h.deliverDigests()
+	if assert.Len(dp.Sent, 1) {
+		assert.Equal("<ul><li>23:00 <b>Build</b>: a &lt; b</li><li>23:00 <b>Digest of 2 notification(s)</b>: <ul><li><b>Backup</b> (2×): done</li></ul></li></ul>", dp.Sent[0].Message)
+		assert.Equal(map[string]interface{}{"contentType": "text/html"}, dp.Sent[0].Extras["client::display"])
+	}
+}
+
+func TestQuietHours_Notice(t *testing.T) {
+	db := userDatabase(&model.User{QuietHours: "daily", QuietMode: model.QuietModeNotice})
+	h := Create(db, &mockups.RecordingDispatcher{}, configuration.QuietHours{Enabled: true, Priority: 10, DigestInterval: time.Minute})
+
+	notification := model.Notification{Message: "done", Priority: 2}
+	held, err := h.Apply(mockups.GetApplication1(), &notification, time.Now())
+
+	assert.NoError(t, err)
+	assert.False(t, held)
+	assert.True(t, notification.Silent, "Notification should be sent as notice")
+	assert.Empty(t, db.Held)
+}
+
+func TestQuietHours_Mark(t *testing.T) {
+	db := userDatabase(&model.User{QuietHours: "daily"})
+	h := Create(db, &mockups.RecordingDispatcher{}, configuration.QuietHours{Enabled: true, Priority: 10, DigestInterval: time.Minute})
+
+	edit := model.Notification{Message: "done", Priority: 2}
+	h.Mark(mockups.GetApplication1(), &edit, time.Now())
+	assert.True(t, edit.Silent, "Edits during quiet hours should be sent as notices")
+	assert.Empty(t, db.Held, "Edits should not be held back")
+
+	urgent := model.Notification{Message: "down", Priority: 10}
+	h.Mark(mockups.GetApplication1(), &urgent, time.Now())
+	assert.False(t, urgent.Silent)
+}
@@ -0,0 +1,311 @@
+// Package ratelimit provides token-bucket rate limits for notifications, per application and per Matrix account.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/pushbits/server/internal/authentication"
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+	CreateStoredNotification(n *model.StoredNotification) error
+}
+
+// The Dispatcher interface for relaying summaries of suppressed notifications.
+type Dispatcher interface {
+	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+}
+
+type bucket struct {
+	rate   float64 // Tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(perMinute float64, burst int, now time.Time) *bucket {
+	return &bucket{rate: perMinute / 60, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// Refills the bucket for the time passed since the last call and takes n tokens if there is at least one.
+// Taking more tokens than are left puts the bucket in debt, so that requests costing more than the burst are not rejected forever.
+// If there is no token, it returns the time until the next one is available.
+func (b *bucket) take(now time.Time, n int) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+
+	if b.rate <= 0 {
+		return false, time.Hour
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) isFull(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Limiter holds the token buckets of applications and of the Matrix accounts, one for each Matrix identity.
+type Limiter struct {
+	db           Database
+	dp           Dispatcher
+	settings     configuration.RateLimit
+	now          func() time.Time
+	mutex        sync.Mutex
+	applications map[uint]*bucket
+	accounts     map[string]*bucket
+	suppressed   map[uint]int
+	stop         chan struct{}
+	done         chan struct{}
+	started      atomic.Bool
+	stopOnce     sync.Once
+}
+
+// Create instanciates a rate limiter.
+func Create(db Database, dp Dispatcher, settings configuration.RateLimit) *Limiter {
+	l := &Limiter{
+		db:           db,
+		dp:           dp,
+		settings:     settings,
+		now:          time.Now,
+		applications: make(map[uint]*bucket),
+		accounts:     make(map[string]*bucket),
+		suppressed:   make(map[uint]int),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	return l
+}
+
+// Takes n tokens from the bucket of the application.
+// The caller must hold the mutex.
+func (l *Limiter) take(a *model.Application, n int) (bool, time.Duration) {
+	now := l.now()
+
+	b, ok := l.applications[a.ID]
+	if !ok {
+		b = newBucket(l.settings.ApplicationPerMinute, l.settings.ApplicationBurst, now)
+		l.applications[a.ID] = b
+	}
+
+	return b.take(now, n)
+}
+
+// Allow checks whether the application may send another notification right now.
+// If not, it returns the time after which the next notification is allowed.
+func (l *Limiter) Allow(a *model.Application) (bool, time.Duration) {
+	return l.AllowN(a, 1)
+}
+
+// AllowN checks whether the application may send n more notifications right now.
+// If not, it returns the time after which the next notification is allowed.
+func (l *Limiter) AllowN(a *model.Application, n int) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	allowed, retryAfter := l.take(a, n)
+	if !allowed && l.settings.Coalesce {
+		l.suppressed[a.ID] += n
+	}
+
+	return allowed, retryAfter
+}
+
+// AllowAccount checks whether the Matrix account an application is relayed with may send another message right now.
+// Every message sent, edited or redacted by the account counts, no matter if it was requested via HTTP or by a background job.
+// Applications relayed with other backends are not limited.
+func (l *Limiter) AllowAccount(a *model.Application) (bool, time.Duration) {
+	if a.Backend != "" && a.Backend != model.BackendMatrix {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+
+	account, ok := l.accounts[a.MatrixIdentity]
+	if !ok {
+		account = newBucket(l.settings.AccountPerMinute, l.settings.AccountBurst, now)
+		l.accounts[a.MatrixIdentity] = account
+	}
+
+	return account.take(now, 1)
+}
+
+// Limit aborts a request with n notifications if the application exceeds its rate limit and returns whether the request may proceed.
+// If overflowing notifications are coalesced, the request is accepted instead and the notifications are counted for a summary.
+func (l *Limiter) Limit(ctx *gin.Context, a *model.Application, n int) bool {
+	allowed, retryAfter := l.AllowN(a, n)
+	if allowed {
+		return true
+	}
+
+	if l.settings.Coalesce {
+		log.L.Debugf("Coalescing %d notification(s) of application %s that exceed the rate limit.", n, a.Name)
+		ctx.AbortWithStatusJSON(http.StatusAccepted, gin.H{"suppressed": true})
+		return false
+	}
+
+	log.L.Printf("Rejecting %d notification(s) of application %s that exceed the rate limit.", n, a.Name)
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	ctx.AbortWithError(http.StatusTooManyRequests, pberrors.ErrRateLimited)
+
+	return false
+}
+
+// Middleware returns a Gin middleware which rejects requests of applications that exceed their rate limit, counting each request as one notification.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		application := authentication.GetApplication(ctx)
+		if application == nil {
+			return
+		}
+
+		l.Limit(ctx, application, 1)
+	}
+}
+
+// Start launches the background delivery of summaries for coalesced notifications.
+func (l *Limiter) Start() {
+	l.started.Store(true)
+	go l.run()
+}
+
+// Close stops the delivery of summaries.
+// Coalesced notifications are only counted in memory, so the summaries the rate limit allows are sent one last time.
+func (l *Limiter) Close() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		if l.started.Load() {
+			<-l.done
+		}
+
+		l.flush()
+
+		l.mutex.Lock()
+		for id, count := range l.suppressed {
+			log.L.Printf("Dropping summary of %d suppressed notification(s) for application %d on shutdown.", count, id)
+		}
+		l.mutex.Unlock()
+	})
+}
+
+func (l *Limiter) run() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.settings.SummaryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
+
+// Takes the count of coalesced notifications of an application, if its rate limit allows sending a summary
+func (l *Limiter) takeSuppressed(a *model.Application) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	count := l.suppressed[a.ID]
+	if count == 0 {
+		return 0
+	}
+
+	if allowed, _ := l.take(a, 1); !allowed {
+		return 0
+	}
+
+	delete(l.suppressed, a.ID)
+
+	return count
+}
+
+// Sends a summary for every application with coalesced notifications whose rate limit allows it again
+func (l *Limiter) flush() {
+	l.mutex.Lock()
+	ids := make([]uint, 0, len(l.suppressed))
+	for id := range l.suppressed {
+		ids = append(ids, id)
+	}
+
+	// Buckets of applications and accounts that have been quiet for long enough are not needed anymore.
+	now := l.now()
+	for id, b := range l.applications {
+		if _, pending := l.suppressed[id]; !pending && b.isFull(now) {
+			delete(l.applications, id)
+		}
+	}
+	for identity, b := range l.accounts {
+		if b.isFull(now) {
+			delete(l.accounts, identity)
+		}
+	}
+	l.mutex.Unlock()
+
+	for _, id := range ids {
+		application, err := l.db.GetApplicationByID(id)
+		if err != nil || application == nil {
+			l.mutex.Lock()
+			delete(l.suppressed, id)
+			l.mutex.Unlock()
+			continue
+		}
+
+		count := l.takeSuppressed(application)
+		if count == 0 {
+			continue
+		}
+
+		err = l.sendSummary(application, count)
+		if err == nil || errors.Is(err, pberrors.ErrNotificationSuppressed) {
+			continue
+		}
+
+		// Summaries that fail, for example because the account is rate limited, are retried with the next flush.
+		log.L.Printf("Cannot send summary of suppressed notifications for application %s: %s", application.Name, err)
+		l.mutex.Lock()
+		l.suppressed[application.ID] += count
+		l.mutex.Unlock()
+	}
+}
+
+func (l *Limiter) sendSummary(application *model.Application, count int) error {
+	notification := model.Notification{
+		Message: fmt.Sprintf("%d messages were suppressed because the application exceeded its rate limit.", count),
+	}
+	notification.Sanitize(application)
+
+	messageID, err := l.dp.SendNotification(application, &notification)
+	if err != nil {
+		return err
+	}
+
+	return l.db.CreateStoredNotification(model.NewStoredNotification(&notification, application.MatrixID, messageID))
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+var settings = configuration.RateLimit{
+	Enabled:              true,
+	ApplicationPerMinute: 60,
+	ApplicationBurst:     2,
+	AccountPerMinute:     60,
+	AccountBurst:         3,
+	SummaryInterval:      time.Minute,
+}
+
+func setup(s configuration.RateLimit) (*Limiter, *mockups.MemoryDatabase, *mockups.RecordingDispatcher, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	db := mockups.GetMemoryDatabase(&model.Application{ID: 1, Name: "first"}, &model.Application{ID: 2, Name: "second"})
+	dp := &mockups.RecordingDispatcher{}
+
+	l := Create(db, dp, s)
+	l.now = func() time.Time { return now }
+
+	return l, db, dp, &now
+}
+
+func TestLimiter_ApplicationBucket(t *testing.T) {
+	l, db, _, now := setup(settings)
+	a := db.Applications[1]
+
+	allowed, _ := l.Allow(a)
+	assert.True(t, allowed)
+	allowed, _ = l.Allow(a)
+	assert.True(t, allowed)
+
+	allowed, retryAfter := l.Allow(a)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+
+	*now = now.Add(time.Second)
+	allowed, _ = l.Allow(a)
+	assert.True(t, allowed)
+}
+
+func TestLimiter_AllowN(t *testing.T) {
+	l, db, _, now := setup(settings)
+	a := db.Applications[1]
+
+	// Requests costing more than the burst are allowed, but have to be paid off before the next one.
+	allowed, _ := l.AllowN(a, 5)
+	assert.True(t, allowed)
+
+	allowed, retryAfter := l.Allow(a)
+	assert.False(t, allowed)
+	assert.Equal(t, 4*time.Second, retryAfter)
+
+	*now = now.Add(4 * time.Second)
+	allowed, _ = l.Allow(a)
+	assert.True(t, allowed)
+}
+
+func TestLimiter_AccountBucket(t *testing.T) {
+	l, db, _, _ := setup(settings)
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := l.AllowAccount(db.Applications[1])
+		assert.True(t, allowed)
+	}
+
+	allowed, _ := l.AllowAccount(db.Applications[2])
+	assert.True(t, allowed)
+
+	// The account bucket is shared by all applications of the account.
+	allowed, _ = l.AllowAccount(db.Applications[2])
+	assert.False(t, allowed)
+
+	// Applications relayed with other backends are not limited by the account bucket.
+	allowed, _ = l.AllowAccount(&model.Application{ID: 3, Backend: model.BackendLog})
+	assert.True(t, allowed)
+
+	// Applications relayed via another Matrix identity use the bucket of that account.
+	allowed, _ = l.AllowAccount(&model.Application{ID: 4, MatrixIdentity: "internal"})
+	assert.True(t, allowed)
+
+	// The account bucket does not take from the bucket of the application.
+	assert.NotContains(t, l.applications, uint(2))
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, db, _, _ := setup(settings)
+
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Set("app", db.Applications[1])
+		l.Middleware()(ctx)
+		if !ctx.IsAborted() {
+			ctx.Status(http.StatusOK)
+		}
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request().Code)
+	assert.Equal(t, http.StatusOK, request().Code)
+
+	w := request()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestLimiter_Coalesce(t *testing.T) {
+	s := settings
+	s.Coalesce = true
+	l, db, dp, now := setup(s)
+	a := db.Applications[1]
+
+	for i := 0; i < 5; i++ {
+		l.Allow(a)
+	}
+
+	// The bucket is still empty, so no summary can be sent yet.
+	l.flush()
+	assert.Empty(t, dp.Sent)
+
+	*now = now.Add(time.Minute)
+	l.flush()
+
+	require.Len(t, dp.Sent, 1)
+	assert.Contains(t, dp.Sent[0].Message, "3 messages were suppressed")
+	require.Len(t, db.Stored, 1)
+	assert.Equal(t, "$event", db.Stored[0].EventID)
+
+	l.flush()
+	assert.Len(t, dp.Sent, 1)
+}
+
+func TestLimiter_CoalesceRetry(t *testing.T) {
+	s := settings
+	s.Coalesce = true
+	l, db, dp, now := setup(s)
+	a := db.Applications[1]
+
+	for i := 0; i < 3; i++ {
+		l.Allow(a)
+	}
+
+	// A summary that cannot be sent because the account is rate limited is sent with the next flush.
+	dp.Err = &pberrors.RetryAfterError{RetryAfter: time.Second, Err: pberrors.ErrRateLimited}
+	*now = now.Add(time.Minute)
+	l.flush()
+	assert.Empty(t, dp.Sent)
+
+	dp.Err = nil
+	l.flush()
+	require.Len(t, dp.Sent, 1)
+	assert.Contains(t, dp.Sent[0].Message, "1 messages were suppressed")
+}
+
+func TestLimiter_CloseSendsSummaries(t *testing.T) {
+	s := settings
+	s.Coalesce = true
+	l, db, dp, now := setup(s)
+
+	for i := 0; i < 4; i++ {
+		l.Allow(db.Applications[1])
+	}
+
+	*now = now.Add(time.Minute)
+	l.Close()
+
+	require.Len(t, dp.Sent, 1)
+	assert.Contains(t, dp.Sent[0].Message, "2 messages were suppressed")
+}
@@ -7,16 +7,21 @@ import (
 
 	"github.com/pushbits/server/internal/api"
 	"github.com/pushbits/server/internal/api/alertmanager"
+	"github.com/pushbits/server/internal/appservice"
 	"github.com/pushbits/server/internal/authentication"
 	"github.com/pushbits/server/internal/authentication/credentials"
+	"github.com/pushbits/server/internal/backend"
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/database"
-	"github.com/pushbits/server/internal/dispatcher"
 	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/queue"
+	"github.com/pushbits/server/internal/ratelimit"
+	"github.com/pushbits/server/internal/scheduler"
+	"github.com/pushbits/server/internal/stream"
 )
 
 // Create a Gin engine and setup all routes.
-func Create(debug bool, trustedProxies []string, cm *credentials.Manager, db *database.Database, dp *dispatcher.Dispatcher, alertmanagerConfig *configuration.Alertmanager) (*gin.Engine, error) {
+func Create(debug bool, trustedProxies []string, cm *credentials.Manager, db *database.Database, dp *backend.Registry, q *queue.Queue, s *scheduler.Scheduler, limiter *ratelimit.Limiter, appService *appservice.Listener, hub *stream.Hub, matrixIdentities []string, dedupConfig *configuration.Dedup, alertmanagerConfig *configuration.Alertmanager) (*gin.Engine, error) {
 	log.L.Println("Setting up HTTP routes.")
 
 	if !debug {
@@ -25,15 +30,28 @@ func Create(debug bool, trustedProxies []string, cm *credentials.Manager, db *da
 
 	auth := authentication.Authenticator{DB: db}
 
-	applicationHandler := api.ApplicationHandler{DB: db, DP: dp}
+	applicationHandler := api.ApplicationHandler{DB: db, DP: dp, MatrixIdentities: matrixIdentities}
+	clientHandler := api.ClientHandler{DB: db, Stream: hub}
 	healthHandler := api.HealthHandler{DB: db}
-	notificationHandler := api.NotificationHandler{DB: db, DP: dp}
+	notificationHandler := api.NotificationHandler{DB: db, DP: dp, Scheduler: s, Stream: hub, Dedup: *dedupConfig}
 	userHandler := api.UserHandler{AH: &applicationHandler, CM: cm, DB: db, DP: dp}
-	alertmanagerHandler := alertmanager.Handler{DP: dp, Settings: alertmanager.HandlerSettings{
+	alertmanagerHandler := alertmanager.Handler{DB: db, DP: dp, Stream: hub, Settings: alertmanager.HandlerSettings{
 		TitleAnnotation:   alertmanagerConfig.AnnotationTitle,
 		MessageAnnotation: alertmanagerConfig.AnnotationMessage,
+		TrackAlerts:       alertmanagerConfig.TrackAlerts,
 	}}
 
+	if q != nil {
+		notificationHandler.Queue = q
+		alertmanagerHandler.Queue = q
+	}
+
+	rateLimit := func(*gin.Context) {}
+	if limiter != nil {
+		rateLimit = limiter.Middleware()
+		alertmanagerHandler.Limiter = limiter
+	}
+
 	r := gin.New()
 	r.Use(log.GinLogger(log.L), gin.Recovery())
 
@@ -58,13 +76,50 @@ func Create(debug bool, trustedProxies []string, cm *credentials.Manager, db *da
 		applicationGroup.GET("/:id", api.RequireIDInURI(), applicationHandler.GetApplication)
 		applicationGroup.DELETE("/:id", api.RequireIDInURI(), applicationHandler.DeleteApplication)
 		applicationGroup.PUT("/:id", api.RequireIDInURI(), applicationHandler.UpdateApplication)
+
+		applicationGroup.POST("/:id/image", api.RequireIDInURI(), applicationHandler.UploadApplicationImage)
+		applicationGroup.POST("/:id/render", api.RequireIDInURI(), applicationHandler.RenderApplicationTemplates)
+
+		applicationGroup.GET("/:id/message", api.RequireIDInURI(), applicationHandler.GetApplicationMessages)
+		applicationGroup.DELETE("/:id/message", api.RequireIDInURI(), applicationHandler.DeleteApplicationMessages)
+
+		applicationGroup.GET("/:id/subscribers", api.RequireIDInURI(), applicationHandler.GetSubscribers)
+		applicationGroup.POST("/:id/subscribers", api.RequireIDInURI(), applicationHandler.AddSubscriber)
+		applicationGroup.DELETE("/:id/subscribers/:subscriberid", api.RequireIDInURI(), api.RequireSubscriberIDInURI(), applicationHandler.RemoveSubscriber)
+	}
+
+	clientGroup := r.Group("/client")
+	clientGroup.Use(auth.RequireUser())
+	{
+		clientGroup.POST("", clientHandler.CreateClient)
+		clientGroup.GET("", clientHandler.GetClients)
+		clientGroup.DELETE("/:id", api.RequireIDInURI(), clientHandler.DeleteClient)
 	}
 
 	r.GET("/health", healthHandler.Health)
 
-	r.POST("/message", auth.RequireApplicationToken(), notificationHandler.CreateNotification)
+	r.GET("/message", auth.RequireUser(), notificationHandler.GetMessages)
+	r.POST("/message", auth.RequireApplicationToken(), rateLimit, notificationHandler.CreateNotification)
+	r.PUT("/message/:messageid", api.RequireMessageIDInURI(), auth.RequireApplicationToken(), notificationHandler.UpdateNotification)
 	r.DELETE("/message/:messageid", api.RequireMessageIDInURI(), auth.RequireApplicationToken(), notificationHandler.DeleteNotification)
 
+	r.GET("/stream", auth.RequireClientToken(), hub.Stream)
+
+	queueGroup := r.Group("/queue")
+	queueGroup.Use(auth.RequireApplicationToken())
+	{
+		queueGroup.GET("", notificationHandler.GetQueuedNotifications)
+		queueGroup.GET("/:id", api.RequireIDInURI(), notificationHandler.GetQueuedNotification)
+	}
+
+	scheduleGroup := r.Group("/schedule")
+	scheduleGroup.Use(auth.RequireApplicationToken())
+	{
+		scheduleGroup.GET("", notificationHandler.GetScheduledNotifications)
+		scheduleGroup.GET("/:id", api.RequireIDInURI(), notificationHandler.GetScheduledNotification)
+		scheduleGroup.DELETE("/:id", api.RequireIDInURI(), notificationHandler.CancelScheduledNotification)
+	}
+
 	userGroup := r.Group("/user")
 	userGroup.Use(auth.RequireAdmin())
 	{
@@ -78,5 +133,14 @@ func Create(debug bool, trustedProxies []string, cm *credentials.Manager, db *da
 
 	r.POST("/alert", auth.RequireApplicationToken(), alertmanagerHandler.CreateAlert)
 
+	if appService != nil {
+		appServiceGroup := r.Group("/_matrix/app/v1")
+		appServiceGroup.Use(appService.RequireHomeserverToken())
+		{
+			appServiceGroup.PUT("/transactions/:txnid", appService.PutTransaction)
+			appServiceGroup.GET("/users/:userid", appService.GetUser)
+		}
+	}
+
 	return r, nil
 }
@@ -0,0 +1,265 @@
+// Package scheduler provides a persistent schedule for notifications that are held back until a later time.
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+)
+
+// The Database interface for encapsulating database access.
+type Database interface {
+	GetApplicationByID(ID uint) (*model.Application, error)
+	CreateScheduledNotification(s *model.ScheduledNotification) error
+	UpdateScheduledNotification(s *model.ScheduledNotification) error
+	GetScheduledNotification(ID uint) (*model.ScheduledNotification, error)
+	DeleteScheduledNotification(s *model.ScheduledNotification) error
+	GetDueScheduledNotifications(now time.Time, limit int) ([]model.ScheduledNotification, error)
+	CreateStoredNotification(n *model.StoredNotification) error
+}
+
+// The Dispatcher interface for relaying notifications.
+type Dispatcher interface {
+	SendNotification(a *model.Application, n *model.Notification) (id string, err error)
+}
+
+// The Stream interface for pushing delivered notifications to connected clients.
+type Stream interface {
+	Publish(a *model.Application, n *model.StoredNotification)
+}
+
+// The Queue interface for handing due notifications to the delivery queue.
+type Queue interface {
+	Enqueue(a *model.Application, n *model.Notification) (*model.QueuedNotification, error)
+}
+
+const batchSize = 50
+
+// Scheduler holds information for delivering scheduled notifications.
+type Scheduler struct {
+	db       Database
+	dp       Dispatcher
+	queue    Queue
+	stream   Stream
+	settings configuration.Scheduler
+	now      func() time.Time
+	mutex    sync.Mutex
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	started  atomic.Bool
+	stopOnce sync.Once
+}
+
+// Create instanciates a scheduler. If a queue is given, due notifications are handed to it instead of being sent right away.
+// If a stream is given, notifications that are sent right away are pushed to it once they are in the message history.
+func Create(db Database, dp Dispatcher, queue Queue, stream Stream, settings configuration.Scheduler) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		dp:       dp,
+		queue:    queue,
+		stream:   stream,
+		settings: settings,
+		now:      time.Now,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Schedule stores a sanitized notification so that it is delivered at the given time.
+func (s *Scheduler) Schedule(a *model.Application, n *model.Notification, deliverAt time.Time) (*model.ScheduledNotification, error) {
+	scheduled := model.NewScheduledNotification(n, deliverAt)
+	scheduled.ApplicationID = a.ID
+
+	if err := s.db.CreateScheduledNotification(scheduled); err != nil {
+		return nil, err
+	}
+
+	log.L.Printf("Scheduled notification %d for application %s at %s.", scheduled.ID, a.Name, deliverAt.Format(time.RFC3339))
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return scheduled, nil
+}
+
+// Cancel removes a pending notification of an application from the schedule.
+// It returns ErrMessageNotFound if there is no such notification or if it was already delivered.
+func (s *Scheduler) Cancel(a *model.Application, id uint) error {
+	// Holding the lock ensures that the notification is not being delivered right now.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scheduled, err := s.db.GetScheduledNotification(id)
+	if err != nil || scheduled == nil || scheduled.ApplicationID != a.ID || scheduled.Status != model.ScheduleStatusPending {
+		return pberrors.ErrMessageNotFound
+	}
+
+	if err := s.db.DeleteScheduledNotification(scheduled); err != nil {
+		return err
+	}
+
+	log.L.Printf("Cancelled scheduled notification %d for application %s.", id, a.Name)
+
+	return nil
+}
+
+// CatchUp delivers all notifications that became due while PushBits was not running.
+func (s *Scheduler) CatchUp() {
+	log.L.Print("Delivering missed scheduled notifications.")
+
+	s.deliverDue()
+}
+
+// Start launches the background delivery of scheduled notifications.
+func (s *Scheduler) Start() {
+	log.L.Print("Starting scheduler.")
+
+	s.started.Store(true)
+	go s.run()
+}
+
+// Close stops the background delivery and waits for running deliveries to finish.
+func (s *Scheduler) Close() {
+	s.stopOnce.Do(func() {
+		log.L.Print("Stopping scheduler.")
+
+		close(s.stop)
+		if s.started.Load() {
+			<-s.done
+		}
+	})
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+
+		s.deliverDue()
+	}
+}
+
+// Delivers all notifications that are currently due
+func (s *Scheduler) deliverDue() {
+	// Deliveries must not overlap, otherwise a notification could be sent twice.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		due, err := s.db.GetDueScheduledNotifications(s.now(), batchSize)
+		if err != nil {
+			log.L.Printf("Cannot fetch scheduled notifications: %s", err)
+			return
+		}
+
+		for i := range due {
+			s.deliver(&due[i])
+		}
+
+		if len(due) < batchSize {
+			return
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (s *Scheduler) deliver(scheduled *model.ScheduledNotification) {
+	scheduled.Attempts++
+
+	application, err := s.db.GetApplicationByID(scheduled.ApplicationID)
+	if err != nil || application == nil {
+		log.L.Printf("Application of scheduled notification %d does not exist anymore.", scheduled.ID)
+		s.markFailed(scheduled, errors.New("application not found"))
+		return
+	}
+
+	notification := scheduled.ToNotification(s.now())
+
+	if s.queue != nil {
+		queued, err := s.queue.Enqueue(application, notification)
+		if err == nil {
+			scheduled.Status = model.ScheduleStatusDelivered
+			scheduled.QueueID = queued.ID
+			scheduled.LastError = ""
+			s.save(scheduled)
+			return
+		}
+
+		s.retry(scheduled, err)
+		return
+	}
+
+	messageID, err := s.dp.SendNotification(application, notification)
+	if errors.Is(err, pberrors.ErrNotificationSuppressed) {
+		messageID = ""
+	} else if err != nil {
+		s.retry(scheduled, err)
+		return
+	}
+
+	scheduled.Status = model.ScheduleStatusDelivered
+	scheduled.MessageID = messageID
+	scheduled.LastError = ""
+
+	stored := model.NewStoredNotification(notification, application.MatrixID, messageID)
+	if err := s.db.CreateStoredNotification(stored); err != nil {
+		log.L.Printf("Cannot add notification %d to message history: %s", scheduled.ID, err)
+	} else if s.stream != nil {
+		s.stream.Publish(application, stored)
+	}
+
+	log.L.Printf("Delivered scheduled notification %d for application %s.", scheduled.ID, application.Name)
+
+	s.save(scheduled)
+}
+
+func (s *Scheduler) retry(scheduled *model.ScheduledNotification, err error) {
+	if scheduled.Attempts >= s.settings.MaxAttempts {
+		log.L.Printf("Giving up on scheduled notification %d after %d attempt(s).", scheduled.ID, scheduled.Attempts)
+		s.markFailed(scheduled, err)
+		return
+	}
+
+	log.L.Printf("Delivery of scheduled notification %d failed, retrying in %s: %s", scheduled.ID, s.settings.RetryInterval, err)
+	scheduled.LastError = err.Error()
+	scheduled.NextAttempt = s.now().Add(s.settings.RetryInterval)
+
+	s.save(scheduled)
+}
+
+func (s *Scheduler) markFailed(scheduled *model.ScheduledNotification, err error) {
+	scheduled.Status = model.ScheduleStatusFailed
+	scheduled.LastError = err.Error()
+
+	s.save(scheduled)
+}
+
+func (s *Scheduler) save(scheduled *model.ScheduledNotification) {
+	if err := s.db.UpdateScheduledNotification(scheduled); err != nil {
+		log.L.Printf("Cannot update scheduled notification %d: %s", scheduled.ID, err)
+	}
+}
@@ -0,0 +1,101 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+	"github.com/pushbits/server/internal/pberrors"
+	"github.com/pushbits/server/tests/mockups"
+)
+
+func testSettings() configuration.Scheduler {
+	return configuration.Scheduler{
+		PollInterval:  time.Hour,
+		MaxAttempts:   2,
+		RetryInterval: time.Minute,
+	}
+}
+
+func setup(dp Dispatcher, queue Queue) (*Scheduler, *mockups.MemoryDatabase, *time.Time) {
+	db := mockups.GetMemoryDatabase(mockups.GetApplication1())
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s := Create(db, dp, queue, nil, testSettings())
+	s.now = func() time.Time { return now }
+
+	return s, db, &now
+}
+
+func schedule(t *testing.T, s *Scheduler, deliverAt time.Time) *model.ScheduledNotification {
+	application := mockups.GetApplication1()
+	notification := model.Notification{Message: "message"}
+	notification.Sanitize(application)
+
+	scheduled, err := s.Schedule(application, &notification, deliverAt)
+	assert.NoError(t, err)
+
+	return scheduled
+}
+
+func TestScheduler_DeliverWhenDue(t *testing.T) {
+	assert := assert.New(t)
+
+	s, db, now := setup(&mockups.RecordingDispatcher{}, nil)
+	scheduled := schedule(t, s, now.Add(time.Hour))
+
+	s.CatchUp()
+	assert.Equal(model.ScheduleStatusPending, db.Scheduled[scheduled.ID].Status, "Notification should be held back until it is due")
+
+	*now = now.Add(2 * time.Hour)
+	s.CatchUp()
+	assert.Equal(model.ScheduleStatusDelivered, db.Scheduled[scheduled.ID].Status, "Missed notification should be delivered")
+	assert.Equal("$event", db.Scheduled[scheduled.ID].MessageID)
+	assert.Len(db.Stored, 1)
+}
+
+func TestScheduler_DeliverViaQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	s, db, now := setup(&mockups.RecordingDispatcher{Err: errors.New("must not be called")}, &mockups.MockQueue{})
+	scheduled := schedule(t, s, *now)
+
+	s.CatchUp()
+	assert.Equal(model.ScheduleStatusDelivered, db.Scheduled[scheduled.ID].Status)
+	assert.Equal(uint(1), db.Scheduled[scheduled.ID].QueueID)
+	assert.Empty(db.Stored, "The queue adds the notification to the history")
+}
+
+func TestScheduler_Retry(t *testing.T) {
+	assert := assert.New(t)
+
+	s, db, now := setup(&mockups.RecordingDispatcher{Err: errors.New("homeserver unavailable")}, nil)
+	scheduled := schedule(t, s, *now)
+
+	s.CatchUp()
+	assert.Equal(model.ScheduleStatusPending, db.Scheduled[scheduled.ID].Status)
+	assert.Equal(now.Add(time.Minute), db.Scheduled[scheduled.ID].NextAttempt)
+
+	*now = now.Add(time.Minute)
+	s.CatchUp()
+	assert.Equal(model.ScheduleStatusFailed, db.Scheduled[scheduled.ID].Status)
+	assert.Equal("homeserver unavailable", db.Scheduled[scheduled.ID].LastError)
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	assert := assert.New(t)
+
+	s, db, now := setup(&mockups.RecordingDispatcher{}, nil)
+	pending := schedule(t, s, now.Add(time.Hour))
+	delivered := schedule(t, s, *now)
+	s.CatchUp()
+
+	assert.ErrorIs(s.Cancel(mockups.GetApplication2(), pending.ID), pberrors.ErrMessageNotFound, "Notifications of other applications cannot be cancelled")
+	assert.ErrorIs(s.Cancel(mockups.GetApplication1(), delivered.ID), pberrors.ErrMessageNotFound, "Delivered notifications cannot be cancelled")
+	assert.NoError(s.Cancel(mockups.GetApplication1(), pending.ID))
+	assert.NotContains(db.Scheduled, pending.ID)
+}
@@ -0,0 +1,264 @@
+// Package stream provides definitions and functionality related to pushing notifications to Gotify clients via WebSocket.
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"github.com/pushbits/server/internal/authentication"
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/log"
+	"github.com/pushbits/server/internal/model"
+)
+
+// Hub holds the stream connections of users and pushes their notifications to them.
+type Hub struct {
+	settings configuration.Stream
+	upgrader websocket.Upgrader
+	mutex    sync.Mutex
+	conns    map[uint]map[*connection]struct{}
+	closed   bool
+}
+
+// A stream connection of a client together with the notifications waiting to be written to it
+type connection struct {
+	clientID  uint
+	conn      *websocket.Conn
+	send      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Create instanciates a hub for stream connections.
+func Create(settings configuration.Stream) *Hub {
+	return &Hub{
+		settings: settings,
+		conns:    make(map[uint]map[*connection]struct{}),
+	}
+}
+
+// Publish pushes a notification that was sent for an application to the stream connections of its owner.
+// Connections that do not keep up with their notifications are closed.
+func (h *Hub) Publish(a *model.Application, n *model.StoredNotification) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		log.L.Printf("Cannot encode notification for the stream: %s", err)
+		return
+	}
+
+	var slow []*connection
+
+	h.mutex.Lock()
+	for c := range h.conns[a.UserID] {
+		select {
+		case c.send <- data:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mutex.Unlock()
+
+	// Closing can wait for the connection, which must not hold up other connections.
+	for _, c := range slow {
+		log.L.Printf("Closing stream connection of user %d, which does not keep up with its notifications.", a.UserID)
+		h.unregister(a.UserID, c)
+		c.close(websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+// Close closes all stream connections. Connections opened afterwards are refused.
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	h.closed = true
+
+	closing := make([]*connection, 0)
+	for userID, conns := range h.conns {
+		for c := range conns {
+			closing = append(closing, c)
+		}
+		delete(h.conns, userID)
+	}
+	h.mutex.Unlock()
+
+	// Closing can wait for the connection, which must not hold up publishing.
+	for _, c := range closing {
+		c.close(websocket.CloseGoingAway, "server shutdown")
+	}
+}
+
+// Disconnect closes the stream connections of a client that was deleted.
+func (h *Hub) Disconnect(clientID uint) {
+	h.mutex.Lock()
+	closing := make([]*connection, 0)
+	for userID, conns := range h.conns {
+		for c := range conns {
+			if c.clientID == clientID {
+				delete(conns, c)
+				closing = append(closing, c)
+			}
+		}
+
+		if len(conns) == 0 {
+			delete(h.conns, userID)
+		}
+	}
+	h.mutex.Unlock()
+
+	// Closing can wait for the connection, which must not hold up publishing.
+	for _, c := range closing {
+		c.close(websocket.ClosePolicyViolation, "client deleted")
+	}
+}
+
+// Adds a connection to those of the user. It returns false if the hub is already closed.
+func (h *Hub) register(userID uint, c *connection) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return false
+	}
+
+	if h.conns[userID] == nil {
+		h.conns[userID] = make(map[*connection]struct{})
+	}
+	h.conns[userID][c] = struct{}{}
+
+	return true
+}
+
+func (h *Hub) isClosed() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.closed
+}
+
+func (h *Hub) unregister(userID uint, c *connection) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.conns[userID], c)
+	if len(h.conns[userID]) == 0 {
+		delete(h.conns, userID)
+	}
+}
+
+// Stream godoc
+// @Summary Stream Messages
+// @Description Receive the notifications of the user via WebSocket as they are sent, compatible with Gotify
+// @ID get-stream
+// @Tags Stream
+// @Produce json
+// @Param token query string true "Client token, can also be provided in the header"
+// @Success 101 {object} model.StoredNotification
+// @Failure 403,400,503 ""
+// @Router /stream [get]
+func (h *Hub) Stream(ctx *gin.Context) {
+	user := authentication.GetUser(ctx)
+	if user == nil {
+		return
+	}
+
+	client := authentication.GetClient(ctx)
+	if client == nil {
+		return
+	}
+
+	if h.isClosed() {
+		ctx.AbortWithError(http.StatusServiceUnavailable, errors.New("the server is shutting down"))
+		return
+	}
+
+	// The upgrader responds to failed handshakes itself.
+	conn, err := h.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		log.L.Printf("Cannot open stream connection for user %s: %s", user.Name, err)
+		return
+	}
+
+	log.L.Printf("Opened stream connection for user %s.", user.Name)
+
+	c := &connection{
+		clientID: client.ID,
+		conn:     conn,
+		send:     make(chan []byte, h.settings.BufferSize),
+		closed:   make(chan struct{}),
+	}
+
+	// The hub can be closed while the connection is upgraded.
+	if !h.register(user.ID, c) {
+		c.close(websocket.CloseGoingAway, "server shutdown")
+		return
+	}
+
+	go c.write(h.settings)
+
+	c.read(h.settings)
+
+	h.unregister(user.ID, c)
+	c.close(websocket.CloseNormalClosure, "")
+
+	log.L.Printf("Closed stream connection for user %s.", user.Name)
+}
+
+// Discards what the client sends, which keeps handling pongs and notices when the connection is gone
+func (c *connection) read(settings configuration.Stream) {
+	// Clients that answer no ping for two intervals are considered gone.
+	timeout := 2 * settings.PingInterval
+
+	c.conn.SetReadLimit(512)
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// Writes notifications and pings to the connection until it is closed
+func (c *connection) write(settings configuration.Stream) {
+	ticker := time.NewTicker(settings.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(settings.WriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(settings.WriteTimeout)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Tells the client why the connection ends, if possible, and closes it
+func (c *connection) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		if code != websocket.CloseAbnormalClosure {
+			_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		}
+
+		_ = c.conn.Close()
+	})
+}
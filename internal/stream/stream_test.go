@@ -0,0 +1,222 @@
+package stream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pushbits/server/internal/configuration"
+	"github.com/pushbits/server/internal/model"
+)
+
+func testSettings() configuration.Stream {
+	return configuration.Stream{PingInterval: time.Minute, WriteTimeout: time.Second, BufferSize: 4}
+}
+
+// Serves the stream of the hub, with the user and the client given as query parameters instead of a client token
+func testServer(t *testing.T, h *Hub) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.GET("/stream", func(ctx *gin.Context) {
+		userID, _ := strconv.Atoi(ctx.Query("user"))
+		clientID, _ := strconv.Atoi(ctx.Query("client"))
+
+		ctx.Set("user", &model.User{ID: uint(userID), Name: "user" + ctx.Query("user")})
+		ctx.Set("client", &model.Client{ID: uint(clientID), UserID: uint(userID)})
+	}, h.Stream)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func dial(t *testing.T, server *httptest.Server, userID, clientID int) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?user=" + strconv.Itoa(userID) + "&client=" + strconv.Itoa(clientID)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Waits until the hub has registered the given number of connections for the user
+func waitForConnections(t *testing.T, h *Hub, userID uint, count int) {
+	require.Eventually(t, func() bool {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		return len(h.conns[userID]) == count
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStream_Publish(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	h := Create(testSettings())
+	server := testServer(t, h)
+
+	alice := dial(t, server, 1, 10)
+	bob := dial(t, server, 2, 20)
+	waitForConnections(t, h, 1, 1)
+	waitForConnections(t, h, 2, 1)
+
+	date := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	h.Publish(&model.Application{ID: 5, UserID: 1}, &model.StoredNotification{ID: 42, ApplicationID: 5, Title: "Backup", Message: "failed", Priority: 8, Date: date})
+
+	var message map[string]interface{}
+	require.NoError(alice.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(alice.ReadJSON(&message))
+
+	assert.Equal(float64(42), message["id"])
+	assert.Equal(float64(5), message["appid"])
+	assert.Equal("Backup", message["title"])
+	assert.Equal("failed", message["message"])
+	assert.Equal(float64(8), message["priority"])
+	assert.Equal("2026-10-17T12:00:00Z", message["date"])
+
+	require.NoError(bob.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, _, err := bob.ReadMessage()
+	assert.Error(err, "Notifications should only be pushed to the owner of the application")
+}
+
+func TestStream_Ping(t *testing.T) {
+	settings := testSettings()
+	settings.PingInterval = 20 * time.Millisecond
+
+	h := Create(settings)
+	server := testServer(t, h)
+
+	conn := dial(t, server, 1, 10)
+
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	// Control frames are only handled while reading.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Fatal("The connection should be pinged")
+	}
+
+	time.Sleep(5 * settings.PingInterval)
+	waitForConnections(t, h, 1, 1)
+}
+
+func TestStream_SlowConsumer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	settings := testSettings()
+	settings.BufferSize = 1
+
+	h := Create(settings)
+
+	// The connection is registered without a writer, so that notifications pile up like for a client that does not keep up.
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := h.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(err)
+	defer conn.Close()
+
+	slow := &connection{clientID: 10, conn: <-accepted, send: make(chan []byte, settings.BufferSize), closed: make(chan struct{})}
+	h.register(1, slow)
+
+	application := &model.Application{ID: 5, UserID: 1}
+	h.Publish(application, &model.StoredNotification{ID: 1})
+	waitForConnections(t, h, 1, 1)
+
+	h.Publish(application, &model.StoredNotification{ID: 2})
+	waitForConnections(t, h, 1, 0)
+
+	require.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseTryAgainLater), "Slow connections should be closed with try again later, not %v", err)
+}
+
+func TestStream_Disconnect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	h := Create(testSettings())
+	server := testServer(t, h)
+
+	deleted := dial(t, server, 1, 10)
+	kept := dial(t, server, 1, 11)
+	waitForConnections(t, h, 1, 2)
+
+	h.Disconnect(10)
+	waitForConnections(t, h, 1, 1)
+
+	require.NoError(deleted.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err := deleted.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation), "Connections of deleted clients should be closed, not %v", err)
+
+	h.Publish(&model.Application{ID: 5, UserID: 1}, &model.StoredNotification{ID: 1})
+
+	var message map[string]interface{}
+	require.NoError(kept.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(kept.ReadJSON(&message))
+	assert.Equal(float64(1), message["id"])
+}
+
+func TestStream_Close(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	h := Create(testSettings())
+	server := testServer(t, h)
+
+	open := dial(t, server, 1, 10)
+	waitForConnections(t, h, 1, 1)
+
+	h.Close()
+	waitForConnections(t, h, 1, 0)
+
+	require.NoError(open.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err := open.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseGoingAway), "Connections should be closed on shutdown, not %v", err)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?user=1&client=10"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if assert.Error(err, "Connections should be refused after shutdown") && resp != nil {
+		assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	assert.False(h.register(1, &connection{clientID: 10}), "Connections should not be registered after shutdown")
+	waitForConnections(t, h, 1, 0)
+}
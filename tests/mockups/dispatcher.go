@@ -2,6 +2,7 @@ package mockups
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pushbits/server/internal/configuration"
 	"github.com/pushbits/server/internal/model"
@@ -10,9 +11,13 @@ import (
 // MockDispatcher is a dispatcher used for testing - it does not need any storage interface
 type MockDispatcher struct{}
 
-// RegisterApplication mocks a functions to create a channel for an application.
-func (*MockDispatcher) RegisterApplication(id uint, name, _ string) (string, error) {
-	return fmt.Sprintf("%d-%s", id, name), nil
+// RegisterApplication mocks a functions to create a channel for an application, or to join the room it is bound to.
+func (*MockDispatcher) RegisterApplication(a *model.Application, _ *model.User) (string, error) {
+	if a.IsBoundToRoom() {
+		return a.Room, nil
+	}
+
+	return fmt.Sprintf("%d-%s", a.ID, a.Name), nil
 }
 
 // DeregisterApplication mocks a function to delete a channel for an application.
@@ -25,12 +30,75 @@ func (*MockDispatcher) UpdateApplication(_ *model.Application, _ *configuration.
 	return nil
 }
 
+// InviteSubscriber mocks a function to invite a subscriber to the channel of an application.
+func (*MockDispatcher) InviteSubscriber(_ *model.Application, _ string) error {
+	return nil
+}
+
+// RemoveSubscriber mocks a function to remove a subscriber from the channel of an application.
+func (*MockDispatcher) RemoveSubscriber(_ *model.Application, _ string) error {
+	return nil
+}
+
+// UploadAvatar mocks a function to store the image of an application.
+func (*MockDispatcher) UploadAvatar(a *model.Application, _ []byte, _ string) (string, error) {
+	return fmt.Sprintf("mxc://example.com/%d", a.ID), nil
+}
+
 // SendNotification mocks a function to send a notification to a given user.
 func (*MockDispatcher) SendNotification(_ *model.Application, _ *model.Notification) (id string, err error) {
 	return randStr(15), nil
 }
 
+// Admits mocks a function to check whether a notification would be sent right away, considering only the delivery state of the application.
+func (*MockDispatcher) Admits(a *model.Application, n *model.Notification) bool {
+	return !a.Suppresses(n, time.Now())
+}
+
+// UpdateNotification mocks a function to replace the content of a notification that was already sent.
+func (*MockDispatcher) UpdateNotification(_ *model.Application, _ *model.Notification, _ string) error {
+	return nil
+}
+
 // DeleteNotification mocks a function to send a notification to a given user that another notification is deleted
 func (*MockDispatcher) DeleteNotification(_ *model.Application, _ *model.DeleteNotification) error {
 	return nil
 }
+
+// RecordingDispatcher is a dispatcher used for testing - it records the notifications it is asked to send and fails with Err if set
+type RecordingDispatcher struct {
+	Sent    []model.Notification
+	Deleted []model.DeleteNotification
+	Notices []string
+	Err     error
+}
+
+// SendNotification mocks a function to send a notification, it returns the same message ID for every notification.
+func (d *RecordingDispatcher) SendNotification(_ *model.Application, n *model.Notification) (string, error) {
+	if d.Err != nil {
+		return "", d.Err
+	}
+
+	d.Sent = append(d.Sent, *n)
+	return "$event", nil
+}
+
+// DeleteNotification mocks a function to delete a notification that was already sent.
+func (d *RecordingDispatcher) DeleteNotification(_ *model.Application, n *model.DeleteNotification) error {
+	if d.Err != nil {
+		return d.Err
+	}
+
+	d.Deleted = append(d.Deleted, *n)
+	return nil
+}
+
+// SendNotice mocks a function to send a notice to the room of an application.
+func (d *RecordingDispatcher) SendNotice(_ *model.Application, text string) error {
+	if d.Err != nil {
+		return d.Err
+	}
+
+	d.Notices = append(d.Notices, text)
+	return nil
+}
@@ -0,0 +1,232 @@
+package mockups
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pushbits/server/internal/model"
+)
+
+// MemoryDatabase is a database used for testing - it keeps applications, users and notifications in memory
+type MemoryDatabase struct {
+	Applications map[uint]*model.Application
+	Users        map[uint]*model.User
+	Queued       map[uint]*model.QueuedNotification
+	Scheduled    map[uint]*model.ScheduledNotification
+	Stored       []*model.StoredNotification
+	Held         []model.HeldNotification
+	Updates      [][]string
+	StoreErr     error
+}
+
+// GetMemoryDatabase returns an in-memory database that holds the given applications
+func GetMemoryDatabase(applications ...*model.Application) *MemoryDatabase {
+	db := &MemoryDatabase{
+		Applications: make(map[uint]*model.Application),
+		Users:        make(map[uint]*model.User),
+		Queued:       make(map[uint]*model.QueuedNotification),
+		Scheduled:    make(map[uint]*model.ScheduledNotification),
+	}
+
+	for _, a := range applications {
+		db.Applications[a.ID] = a
+	}
+
+	return db
+}
+
+// GetApplicationByID mocks a function to get an application by its ID.
+func (db *MemoryDatabase) GetApplicationByID(id uint) (*model.Application, error) {
+	a, ok := db.Applications[id]
+	if !ok {
+		return nil, errors.New("application not found")
+	}
+
+	return a, nil
+}
+
+// GetApplicationByMatrixID mocks a function to get the application bound to a room.
+func (db *MemoryDatabase) GetApplicationByMatrixID(matrixID string) (*model.Application, error) {
+	for _, a := range db.Applications {
+		if a.MatrixID == matrixID {
+			return a, nil
+		}
+	}
+
+	return nil, errors.New("application not found")
+}
+
+// UpdateApplicationFields mocks a function to update the given fields of an application, it only records the field names.
+func (db *MemoryDatabase) UpdateApplicationFields(_ *model.Application, fields ...string) error {
+	db.Updates = append(db.Updates, fields)
+	return nil
+}
+
+// GetUserByID mocks a function to get a user by their ID.
+func (db *MemoryDatabase) GetUserByID(id uint) (*model.User, error) {
+	u, ok := db.Users[id]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+
+	return u, nil
+}
+
+// CreateQueuedNotification mocks a function to add a notification to the delivery queue.
+func (db *MemoryDatabase) CreateQueuedNotification(q *model.QueuedNotification) error {
+	q.ID = uint(len(db.Queued) + 1)
+	db.Queued[q.ID] = q
+	return nil
+}
+
+// UpdateQueuedNotification mocks a function to save the delivery state of a queued notification.
+func (db *MemoryDatabase) UpdateQueuedNotification(q *model.QueuedNotification) error {
+	db.Queued[q.ID] = q
+	return nil
+}
+
+// GetDueQueuedNotifications mocks a function to get the pending queued notifications that are due.
+func (db *MemoryDatabase) GetDueQueuedNotifications(now time.Time, _ int) ([]model.QueuedNotification, error) {
+	due := make([]model.QueuedNotification, 0)
+	for _, q := range db.Queued {
+		if q.Status == model.QueueStatusPending && !q.NextAttempt.After(now) {
+			due = append(due, *q)
+		}
+	}
+
+	return due, nil
+}
+
+// CreateScheduledNotification mocks a function to store a notification for delivery at a later time.
+func (db *MemoryDatabase) CreateScheduledNotification(s *model.ScheduledNotification) error {
+	s.ID = uint(len(db.Scheduled) + 1)
+	db.Scheduled[s.ID] = s
+	return nil
+}
+
+// UpdateScheduledNotification mocks a function to save the delivery state of a scheduled notification.
+func (db *MemoryDatabase) UpdateScheduledNotification(s *model.ScheduledNotification) error {
+	db.Scheduled[s.ID] = s
+	return nil
+}
+
+// GetScheduledNotification mocks a function to get a scheduled notification by its ID.
+func (db *MemoryDatabase) GetScheduledNotification(id uint) (*model.ScheduledNotification, error) {
+	s, ok := db.Scheduled[id]
+	if !ok {
+		return nil, errors.New("scheduled notification not found")
+	}
+
+	return s, nil
+}
+
+// DeleteScheduledNotification mocks a function to delete a scheduled notification.
+func (db *MemoryDatabase) DeleteScheduledNotification(s *model.ScheduledNotification) error {
+	delete(db.Scheduled, s.ID)
+	return nil
+}
+
+// GetDueScheduledNotifications mocks a function to get the pending scheduled notifications that are due.
+func (db *MemoryDatabase) GetDueScheduledNotifications(now time.Time, _ int) ([]model.ScheduledNotification, error) {
+	due := make([]model.ScheduledNotification, 0)
+	for _, s := range db.Scheduled {
+		if s.Status == model.ScheduleStatusPending && !s.NextAttempt.After(now) {
+			due = append(due, *s)
+		}
+	}
+
+	return due, nil
+}
+
+// CreateStoredNotification mocks a function to add a notification to the message history, it fails with StoreErr if set.
+func (db *MemoryDatabase) CreateStoredNotification(n *model.StoredNotification) error {
+	if db.StoreErr != nil {
+		return db.StoreErr
+	}
+
+	n.ID = uint(len(db.Stored) + 1)
+	db.Stored = append(db.Stored, n)
+	return nil
+}
+
+// GetLastDeliveredNotification mocks a function to get the last notification of an application that was sent to its channel.
+func (db *MemoryDatabase) GetLastDeliveredNotification(a *model.Application) (*model.StoredNotification, error) {
+	for i := len(db.Stored) - 1; i >= 0; i-- {
+		if db.Stored[i].ApplicationID == a.ID && db.Stored[i].EventID != "" {
+			return db.Stored[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetExpiredStoredNotifications mocks a function to get the notifications in the message history that expired.
+func (db *MemoryDatabase) GetExpiredStoredNotifications(now time.Time, _ int) ([]model.StoredNotification, error) {
+	expired := make([]model.StoredNotification, 0)
+	for _, n := range db.Stored {
+		if n.ExpiresAt != nil && !n.ExpiresAt.After(now) {
+			expired = append(expired, *n)
+		}
+	}
+
+	return expired, nil
+}
+
+// DeleteStoredNotification mocks a function to remove a notification from the message history.
+func (db *MemoryDatabase) DeleteStoredNotification(n *model.StoredNotification) error {
+	remaining := make([]*model.StoredNotification, 0, len(db.Stored))
+	for _, stored := range db.Stored {
+		if stored.ID != n.ID {
+			remaining = append(remaining, stored)
+		}
+	}
+
+	db.Stored = remaining
+	return nil
+}
+
+// CreateHeldNotification mocks a function to hold a notification back for a digest.
+func (db *MemoryDatabase) CreateHeldNotification(h *model.HeldNotification) error {
+	h.ID = uint(len(db.Held) + 1)
+	db.Held = append(db.Held, *h)
+	return nil
+}
+
+// GetHeldApplicationIDs mocks a function to get the applications with notifications held back for a digest of the given kind.
+func (db *MemoryDatabase) GetHeldApplicationIDs(kind string) ([]uint, error) {
+	ids := make([]uint, 0)
+	seen := make(map[uint]bool)
+	for _, h := range db.Held {
+		if h.Kind == kind && !seen[h.ApplicationID] {
+			seen[h.ApplicationID] = true
+			ids = append(ids, h.ApplicationID)
+		}
+	}
+
+	return ids, nil
+}
+
+// GetHeldNotifications mocks a function to get the notifications of an application held back for a digest of the given kind.
+func (db *MemoryDatabase) GetHeldNotifications(applicationID uint, kind string) ([]model.HeldNotification, error) {
+	held := make([]model.HeldNotification, 0)
+	for _, h := range db.Held {
+		if h.ApplicationID == applicationID && h.Kind == kind {
+			held = append(held, h)
+		}
+	}
+
+	return held, nil
+}
+
+// DeleteHeldNotifications mocks a function to delete the held notifications of an application up to the given ID.
+func (db *MemoryDatabase) DeleteHeldNotifications(applicationID uint, kind string, lastID uint) error {
+	remaining := make([]model.HeldNotification, 0, len(db.Held))
+	for _, h := range db.Held {
+		if h.ApplicationID != applicationID || h.Kind != kind || h.ID > lastID {
+			remaining = append(remaining, h)
+		}
+	}
+
+	db.Held = remaining
+	return nil
+}
@@ -0,0 +1,19 @@
+package mockups
+
+import "github.com/pushbits/server/internal/model"
+
+// MockQueue is a delivery queue used for testing - it only hands out IDs and never delivers anything
+type MockQueue struct {
+	lastID uint
+}
+
+// Enqueue mocks a function to store a notification for delivery in the background.
+func (q *MockQueue) Enqueue(a *model.Application, n *model.Notification) (*model.QueuedNotification, error) {
+	q.lastID++
+
+	queued := model.NewQueuedNotification(n)
+	queued.ID = q.lastID
+	queued.ApplicationID = a.ID
+
+	return queued, nil
+}
@@ -0,0 +1,19 @@
+package mockups
+
+import "github.com/pushbits/server/internal/model"
+
+// MockStream is a stream used for testing - it only records what is pushed to it
+type MockStream struct {
+	Published    []model.StoredNotification
+	Disconnected []uint
+}
+
+// Publish mocks a function to push a notification to the stream connections of the owner of an application.
+func (s *MockStream) Publish(_ *model.Application, n *model.StoredNotification) {
+	s.Published = append(s.Published, *n)
+}
+
+// Disconnect mocks a function to close the stream connections of a client.
+func (s *MockStream) Disconnect(clientID uint) {
+	s.Disconnected = append(s.Disconnected, clientID)
+}